@@ -18,7 +18,9 @@ import (
 	"xray-vpn-connect/internal/handlers"
 	"xray-vpn-connect/internal/middleware"
 	"xray-vpn-connect/internal/queue"
+	"xray-vpn-connect/internal/secrets"
 	"xray-vpn-connect/internal/services"
+	"xray-vpn-connect/internal/worker"
 )
 
 func main() {
@@ -54,6 +56,12 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to run migrations")
 	}
 
+	// Panel credentials are encrypted with the master key
+	box, err := secrets.NewBox(cfg.Security.PanelKey, cfg.Security.PanelPreviousKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid panel key, generate one with: go run ./cmd/rotate-keys -generate")
+	}
+
 	// Seed database
 	if cfg.App.Env == "development" {
 		if err := db.Seed(); err != nil {
@@ -61,8 +69,17 @@ func main() {
 		}
 	}
 
-	// Initialize RabbitMQ
-	q, err := queue.New(cfg.RabbitMQ.URL, cfg.RabbitMQ.Exchange)
+	// An in-memory queue is only consumed by a worker in the same process
+	if cfg.Queue.Driver == queue.DriverMemory && !cfg.App.AllInOne() {
+		log.Fatal().Msg("The memory queue driver needs app.mode all-in-one")
+	}
+
+	// Initialize task queue
+	q, err := queue.Open(cfg.Queue.Driver, cfg.RabbitMQ.URL, cfg.RabbitMQ.Exchange, queue.RetryPolicy{
+		MaxAttempts:    cfg.RabbitMQ.MaxAttempts,
+		RetryBaseDelay: cfg.RabbitMQ.RetryBaseDelay,
+		RetryMaxDelay:  cfg.RabbitMQ.RetryMaxDelay,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to connect to RabbitMQ")
 	}
@@ -71,10 +88,32 @@ func main() {
 	// Initialize services
 	userService := services.NewUserService(db, q)
 	telegramService := services.NewTelegramService(cfg)
-	paymentService := services.NewPaymentService(db, cfg, telegramService)
-	subscriptionService := services.NewSubscriptionService(db)
+	promoService := services.NewPromoCodeService(db)
+	subscriptionService := services.NewSubscriptionService(db, cfg, q, promoService)
+	referralService := services.NewReferralService(db, cfg, subscriptionService)
 	planService := services.NewPlanService(db)
+	notificationService := services.NewNotificationService(db, cfg, q, telegramService)
+	familyService := services.NewFamilyService(db, cfg, q, subscriptionService, notificationService)
 	connectionService := services.NewConnectionService(db, q)
+	panelService := services.NewXrayPanelService(db, box)
+	if _, err := panelService.EncryptLegacyPasswords(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to encrypt panel passwords")
+	}
+	serverService := services.NewServerService(db, cfg, panelService)
+	reconcileService := services.NewReconcileService(db, panelService)
+
+	// Payment providers, Telegram Stars is always available
+	paymentProviders := []services.PaymentProvider{
+		services.NewTelegramStarsProvider(telegramService, cfg),
+	}
+	if cfg.Payments.CryptoPay.APIToken != "" {
+		paymentProviders = append(paymentProviders, services.NewCryptoPayProvider(cfg))
+	}
+	if cfg.Payments.Mock.Enabled {
+		log.Warn().Msg("Mock payment provider is enabled, do not use in production")
+		paymentProviders = append(paymentProviders, services.NewMockPaymentProvider(cfg))
+	}
+	paymentService := services.NewPaymentService(db, cfg, referralService, paymentProviders...)
 
 	// Set webhook
 	if err := telegramService.SetWebhook(cfg.Telegram.WebhookURL); err != nil {
@@ -84,7 +123,7 @@ func main() {
 	}
 
 	// Initialize handlers
-	h := handlers.NewHandlers(userService, paymentService, subscriptionService, planService, connectionService, telegramService, db)
+	h := handlers.NewHandlers(userService, paymentService, subscriptionService, planService, connectionService, telegramService, promoService, referralService, familyService, serverService, reconcileService, panelService, q, db)
 
 	// Setup router
 	r := gin.New()
@@ -95,6 +134,22 @@ func main() {
 	// Setup routes
 	h.SetupRoutes(r, cfg, db)
 
+	// All-in-one mode runs the worker and the WebSocket server in this process
+	if cfg.App.AllInOne() {
+		if err := worker.New(cfg, db, q, box).Start(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to start worker")
+		}
+
+		wsService := services.NewWebSocketService(cfg)
+		go wsService.Run()
+		if err := wsService.ConsumeNotifications(q); err != nil {
+			log.Fatal().Err(err).Msg("Failed to consume WebSocket notification tasks")
+		}
+		r.GET("/ws", middleware.Auth(), wsService.HandleWebSocket)
+
+		log.Info().Str("driver", cfg.Queue.Driver).Msg("Running in all-in-one mode")
+	}
+
 	// Create HTTP server
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
@@ -130,5 +185,14 @@ func main() {
 		log.Error().Err(err).Msg("Server forced to shutdown")
 	}
 
+	// Let in-flight tasks of the embedded worker finish
+	if cfg.App.AllInOne() {
+		workerCtx, workerCancel := context.WithTimeout(context.Background(), cfg.Worker.ShutdownTimeout)
+		defer workerCancel()
+		if err := q.Shutdown(workerCtx); err != nil {
+			log.Error().Err(err).Msg("Failed to shut down task queue")
+		}
+	}
+
 	log.Info().Msg("Server exited")
 }
@@ -0,0 +1,78 @@
+// Command rotate-keys re-encrypts Xray panel credentials with the current master key.
+//
+// Rotation:
+//  1. Generate a new key: rotate-keys -generate
+//  2. Set it as PANEL_KEY and the old key as PANEL_PREVIOUS_KEY (or the *_FILE variants)
+//     for the API, the worker and this command, then restart them
+//  3. Run rotate-keys, every panel password is encrypted again with a new data key
+//  4. Remove PANEL_PREVIOUS_KEY
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/secrets"
+	"xray-vpn-connect/internal/services"
+)
+
+func main() {
+	generate := flag.Bool("generate", false, "print a new random master key and exit")
+	flag.Parse()
+
+	if *generate {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to generate key:", err)
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load config")
+	}
+
+	box, err := secrets.NewBox(cfg.Security.PanelKey, cfg.Security.PanelPreviousKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid panel key")
+	}
+
+	db, err := database.New(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect to database")
+	}
+	defer db.Close()
+
+	if err := db.AutoMigrate(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to run migrations")
+	}
+
+	panelService := services.NewXrayPanelService(db, box)
+
+	encrypted, err := panelService.EncryptLegacyPasswords()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to encrypt plaintext panel passwords")
+	}
+
+	rotated, err := panelService.RotateKeys()
+	if err != nil {
+		log.Fatal().Err(err).Int("rotated", rotated).Msg("Failed to rotate panel keys")
+	}
+
+	log.Info().
+		Str("key_id", box.PrimaryKeyID()).
+		Int("encrypted", encrypted).
+		Int("rotated", rotated).
+		Msg("Panel credentials re-encrypted, the previous key can be removed")
+}
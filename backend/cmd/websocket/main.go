@@ -12,7 +12,6 @@ import (
 	"xray-vpn-connect/internal/middleware"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
@@ -49,15 +48,24 @@ func main() {
 	}
 	defer db.Close()
 
-	// Initialize RabbitMQ
-	q, err := queue.New(cfg.RabbitMQ.URL, cfg.RabbitMQ.Exchange)
+	// An in-memory queue is not shared with the API, it only works in all-in-one mode
+	if cfg.Queue.Driver == queue.DriverMemory {
+		log.Fatal().Msg("The memory queue driver needs app.mode all-in-one, use the /ws endpoint of the API instead")
+	}
+
+	// Initialize task queue
+	q, err := queue.Open(cfg.Queue.Driver, cfg.RabbitMQ.URL, cfg.RabbitMQ.Exchange, queue.RetryPolicy{
+		MaxAttempts:    cfg.RabbitMQ.MaxAttempts,
+		RetryBaseDelay: cfg.RabbitMQ.RetryBaseDelay,
+		RetryMaxDelay:  cfg.RabbitMQ.RetryMaxDelay,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to connect to RabbitMQ")
 	}
 	defer q.Close()
 
 	// Initialize WebSocket service
-	wsService := services.NewWebSocketService()
+	wsService := services.NewWebSocketService(cfg)
 
 	// Start WebSocket service in a separate goroutine
 	go wsService.Run()
@@ -73,49 +81,25 @@ func main() {
 	r.Use(middleware.Recovery())
 	r.Use(middleware.Logger())
 	r.Use(middleware.CORS())
+
+	// Health check, notifications stop while RabbitMQ is disconnected
+	r.GET("/health", func(c *gin.Context) {
+		status := http.StatusOK
+		if !q.Connected() {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"status": http.StatusText(status), "rabbitmq": q.Connected(), "timestamp": time.Now().Unix()})
+	})
+
 	r.Use(middleware.Auth())
 
 	// WebSocket endpoint
 	r.GET("/ws", wsService.HandleWebSocket)
 
 	// Start consuming WebSocket notification tasks
-	go func() {
-		err := q.ConsumeTasks("websocket_notifications", func(task queue.Task) error {
-			log.Info().
-				Str("type", task.Type).
-				Str("user_id", task.UserID.String()).
-				Msg("Received WebSocket notification task")
-
-			// Convert task to WebSocket message
-			var userID *string
-			if id, exists := task.Data["user_id"]; exists {
-				if strID, ok := id.(string); ok {
-					userID = &strID
-				}
-			}
-
-			// Create WebSocket message
-			wsMessage := services.WebSocketMessage{
-				Type:      task.Type,
-				Timestamp: time.Now(),
-				Data:      task.Data,
-			}
-
-			// Set user ID if specified
-			if userID != nil {
-				if uid, err := parseUUID(*userID); err == nil {
-					wsMessage.UserID = &uid
-				}
-			}
-
-			// Broadcast message
-			wsService.BroadcastMessage(wsMessage)
-			return nil
-		})
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to consume WebSocket notification tasks")
-		}
-	}()
+	if err := wsService.ConsumeNotifications(q); err != nil {
+		log.Fatal().Err(err).Msg("Failed to consume WebSocket notification tasks")
+	}
 
 	// Create HTTP server for WebSocket endpoint
 	srv := &http.Server{
@@ -154,12 +138,3 @@ func main() {
 
 	log.Info().Msg("WebSocket server exited")
 }
-
-// parseUUID safely parses a string to UUID
-func parseUUID(s string) (uuid.UUID, error) {
-	id, err := uuid.Parse(s)
-	if err != nil {
-		return uuid.Nil, err
-	}
-	return id, nil
-}
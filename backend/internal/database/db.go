@@ -67,6 +67,10 @@ func New(cfg *config.Config) (*DB, error) {
 func (db *DB) AutoMigrate() error {
 	log.Info().Msg("Running database migrations...")
 
+	// Columns added by this run are backfilled once, after they are created
+	addsConnectionStatus := !db.DB.Migrator().HasColumn(&models.Connection{}, "status")
+	addsPricePaid := !db.DB.Migrator().HasColumn(&models.Subscription{}, "price_paid")
+
 	err := db.DB.AutoMigrate(
 		&models.User{},
 		&models.Plan{},
@@ -77,16 +81,43 @@ func (db *DB) AutoMigrate() error {
 		&models.SupportTicket{},
 		&models.TicketMessage{},
 		&models.ServerReport{},
+		&models.ServerHealthCheck{},
 		&models.ServerUser{},
 		&models.ReferralStats{},
 		&models.AuthSession{},
 		&models.BrowserSession{},
 		&models.Payment{}, // Add the Payment model
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+		&models.GiftCode{},
+		&models.ReferralReward{},
+		&models.PlanChange{},
+		&models.SubscriptionFreeze{},
+		&models.FamilyMember{},
+		&models.OutboxMessage{},
+		&models.ProcessedTask{},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	// Connections provisioned before the status column existed
+	if addsConnectionStatus {
+		if err := db.DB.Model(&models.Connection{}).
+			Where("status = ? AND connection_key <> ''", "pending").
+			Update("status", "ready").Error; err != nil {
+			return fmt.Errorf("failed to backfill connection status: %w", err)
+		}
+	}
+
+	// Subscriptions bought before the price was recorded, one plan period at list price
+	if addsPricePaid {
+		if err := db.DB.Exec(`UPDATE subscriptions SET price_paid = plans.price_stars
+			FROM plans WHERE plans.id = subscriptions.plan_id AND subscriptions.price_paid = 0`).Error; err != nil {
+			return fmt.Errorf("failed to backfill subscription price: %w", err)
+		}
+	}
+
 	log.Info().Msg("Database migrations completed successfully")
 	return nil
 }
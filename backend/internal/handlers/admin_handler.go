@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -10,14 +13,32 @@ import (
 
 	"xray-vpn-connect/internal/database"
 	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+	"xray-vpn-connect/internal/services"
 )
 
 type AdminHandler struct {
-	db *database.DB
+	db                  *database.DB
+	paymentService      *services.PaymentService
+	promoService        *services.PromoCodeService
+	subscriptionService *services.SubscriptionService
+	serverService       *services.ServerService
+	reconcileService    *services.ReconcileService
+	panelService        *services.XrayPanelService
+	queue               queue.TaskQueue
 }
 
-func NewAdminHandler(db *database.DB) *AdminHandler {
-	return &AdminHandler{db: db}
+func NewAdminHandler(db *database.DB, paymentService *services.PaymentService, promoService *services.PromoCodeService, subscriptionService *services.SubscriptionService, serverService *services.ServerService, reconcileService *services.ReconcileService, panelService *services.XrayPanelService, q queue.TaskQueue) *AdminHandler {
+	return &AdminHandler{
+		db:                  db,
+		paymentService:      paymentService,
+		promoService:        promoService,
+		subscriptionService: subscriptionService,
+		serverService:       serverService,
+		reconcileService:    reconcileService,
+		panelService:        panelService,
+		queue:               q,
+	}
 }
 
 // Stats
@@ -77,11 +98,13 @@ type CreateServerRequest struct {
 	Name           string   `json:"name" binding:"required"`
 	Country        string   `json:"country" binding:"required"`
 	Flag           string   `json:"flag" binding:"required"`
+	Group          string   `json:"group"` // Failover group, the country is used when empty
 	Protocol       string   `json:"protocol" binding:"required"`
 	Status         string   `json:"status"`
 	AdminMessage   *string  `json:"admin_message"`
 	MaxConnections int      `json:"max_connections"`
 	Host           string   `json:"host" binding:"required"`
+	Port           int      `json:"port"` // Inbound port, 443 if empty
 	XrayPanelID    string   `json:"xray_panel_id" binding:"required"`
 	InboundID      int      `json:"inbound_id"`
 	IsUserSpecific bool     `json:"is_user_specific"`   // Whether this server is for specific users only
@@ -110,7 +133,9 @@ func (h *AdminHandler) CreateServer(c *gin.Context) {
 		Name:           req.Name,
 		Country:        req.Country,
 		Flag:           req.Flag,
+		Group:          req.Group,
 		Host:           req.Host,
+		Port:           req.Port,
 		Protocol:       req.Protocol,
 		Status:         req.Status,
 		AdminMessage:   req.AdminMessage,
@@ -137,6 +162,10 @@ func (h *AdminHandler) CreateServer(c *gin.Context) {
 		server.MaxConnections = 1000
 	}
 
+	if server.Port == 0 {
+		server.Port = 443
+	}
+
 	if err := h.db.DB.Create(&server).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to create server")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create server"})
@@ -203,7 +232,11 @@ func (h *AdminHandler) UpdateServer(c *gin.Context) {
 	server.Name = req.Name
 	server.Country = req.Country
 	server.Flag = req.Flag
+	server.Group = req.Group
 	server.Host = req.Host
+	if req.Port > 0 {
+		server.Port = req.Port
+	}
 	server.Protocol = req.Protocol
 	server.Status = req.Status
 	server.AdminMessage = req.AdminMessage
@@ -292,6 +325,52 @@ func (h *AdminHandler) GetServerUsers(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"users": users})
 }
 
+// GetServerHealth returns the health check history and uptime of a server, ?hours= defaults to 24
+func (h *AdminHandler) GetServerHealth(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid server ID"})
+		return
+	}
+
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hours"})
+		return
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	var server models.Server
+	if err := h.db.DB.First(&server, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server not found"})
+		return
+	}
+
+	checks, err := h.serverService.HealthHistory(id, since)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get server health history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get server health history"})
+		return
+	}
+
+	uptime, err := h.serverService.Uptime(since)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get server uptime")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get server uptime"})
+		return
+	}
+
+	response := gin.H{
+		"server": server,
+		"checks": checks,
+	}
+	if value, ok := uptime[id]; ok {
+		response["uptime"] = value
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
 func (h *AdminHandler) DeleteServer(c *gin.Context) {
 	serverID := c.Param("id")
 	id, err := uuid.Parse(serverID)
@@ -392,6 +471,22 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+// CancelUserSubscription deactivates a user's subscription, family members lose access too
+func (h *AdminHandler) CancelUserSubscription(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := h.subscriptionService.CancelSubscription(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Subscription cancelled successfully"})
+}
+
 // Plan Management
 func (h *AdminHandler) GetAllPlans(c *gin.Context) {
 	var plans []models.Plan
@@ -410,6 +505,9 @@ type CreatePlanRequest struct {
 	DurationMonths int     `json:"duration_months" binding:"required"`
 	PriceStars     int64   `json:"price_stars" binding:"required"`
 	Discount       *string `json:"discount"`
+	TrafficLimitGB int64   `json:"traffic_limit_gb"` // 0 = unlimited
+	DeviceLimit    int     `json:"device_limit"`     // 0 = unlimited
+	MaxMembers     int     `json:"max_members"`      // family seats, 0 = personal plan
 }
 
 func (h *AdminHandler) CreatePlan(c *gin.Context) {
@@ -424,6 +522,9 @@ func (h *AdminHandler) CreatePlan(c *gin.Context) {
 		DurationMonths: req.DurationMonths,
 		PriceStars:     req.PriceStars,
 		Discount:       req.Discount,
+		TrafficLimitGB: req.TrafficLimitGB,
+		DeviceLimit:    req.DeviceLimit,
+		MaxMembers:     req.MaxMembers,
 		IsActive:       true,
 	}
 
@@ -460,6 +561,9 @@ func (h *AdminHandler) UpdatePlan(c *gin.Context) {
 	plan.DurationMonths = req.DurationMonths
 	plan.PriceStars = req.PriceStars
 	plan.Discount = req.Discount
+	plan.TrafficLimitGB = req.TrafficLimitGB
+	plan.DeviceLimit = req.DeviceLimit
+	plan.MaxMembers = req.MaxMembers
 
 	if err := h.db.DB.Save(&plan).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to update plan")
@@ -559,3 +663,490 @@ func (h *AdminHandler) GetAllXrayPanels(c *gin.Context) {
 
 	c.JSON(http.StatusOK, panels)
 }
+
+type XrayPanelRequest struct {
+	Name      string `json:"name" binding:"required"`
+	Type      string `json:"type"` // 3x-ui if empty
+	URL       string `json:"url" binding:"required"`
+	Username  string `json:"username" binding:"required"`
+	Password  string `json:"password"` // Required on create, kept when empty on update
+	InboundID int    `json:"inbound_id"`
+	IsActive  *bool  `json:"is_active"`
+}
+
+func (h *AdminHandler) CreateXrayPanel(c *gin.Context) {
+	var req XrayPanelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is required"})
+		return
+	}
+
+	panel := models.XrayPanel{
+		Name:      req.Name,
+		Type:      req.Type,
+		URL:       strings.TrimRight(req.URL, "/"),
+		Username:  req.Username,
+		Password:  req.Password,
+		InboundID: req.InboundID,
+		IsActive:  true,
+	}
+	if panel.Type == "" {
+		panel.Type = "3x-ui"
+	}
+	if req.IsActive != nil {
+		panel.IsActive = *req.IsActive
+	}
+
+	if err := h.panelService.CreatePanel(&panel); err != nil {
+		log.Error().Err(err).Msg("Failed to create Xray panel")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Xray panel"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, panel)
+}
+
+func (h *AdminHandler) UpdateXrayPanel(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid panel ID"})
+		return
+	}
+
+	var req XrayPanelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var panel models.XrayPanel
+	if err := h.db.DB.First(&panel, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Panel not found"})
+		return
+	}
+
+	panel.Name = req.Name
+	if req.Type != "" {
+		panel.Type = req.Type
+	}
+	panel.URL = strings.TrimRight(req.URL, "/")
+	panel.Username = req.Username
+	if req.Password != "" {
+		panel.Password = req.Password
+	}
+	panel.InboundID = req.InboundID
+	if req.IsActive != nil {
+		panel.IsActive = *req.IsActive
+	}
+
+	if err := h.panelService.UpdatePanel(id, &panel); err != nil {
+		log.Error().Err(err).Msg("Failed to update Xray panel")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update Xray panel"})
+		return
+	}
+
+	c.JSON(http.StatusOK, panel)
+}
+
+func (h *AdminHandler) DeleteXrayPanel(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid panel ID"})
+		return
+	}
+
+	if err := h.panelService.DeletePanel(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Panel deleted successfully"})
+}
+
+// TestXrayPanel logs in to a saved panel and returns its inbounds
+func (h *AdminHandler) TestXrayPanel(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid panel ID"})
+		return
+	}
+
+	var panel models.XrayPanel
+	if err := h.db.DB.First(&panel, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Panel not found"})
+		return
+	}
+
+	h.testXrayPanel(c, &panel)
+}
+
+type TestXrayPanelRequest struct {
+	URL      string `json:"url" binding:"required"`
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// TestXrayPanelCredentials checks panel credentials before the panel is saved
+func (h *AdminHandler) TestXrayPanelCredentials(c *gin.Context) {
+	var req TestXrayPanelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.testXrayPanel(c, &models.XrayPanel{
+		URL:      strings.TrimRight(req.URL, "/"),
+		Username: req.Username,
+		Password: req.Password,
+	})
+}
+
+func (h *AdminHandler) testXrayPanel(c *gin.Context, panel *models.XrayPanel) {
+	inbounds, err := h.panelService.TestPanel(panel)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "inbounds": inbounds})
+}
+
+// GetXrayPanelSync lists the panel inbounds and proposes servers for the unused ones
+func (h *AdminHandler) GetXrayPanelSync(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid panel ID"})
+		return
+	}
+
+	sync, err := h.panelService.SyncPlan(id)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sync)
+}
+
+type SyncXrayPanelRequest struct {
+	Import []services.ServerImport `json:"import" binding:"dive"` // Inbounds to create servers for
+}
+
+// SyncXrayPanel updates servers from their inbounds, flags servers whose inbound is gone
+// and creates servers for the imported inbounds
+func (h *AdminHandler) SyncXrayPanel(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid panel ID"})
+		return
+	}
+
+	var req SyncXrayPanelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sync, err := h.panelService.ApplySync(id, req.Import)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sync)
+}
+
+// GetReconcileDiff compares panel clients with connections without changing anything
+func (h *AdminHandler) GetReconcileDiff(c *gin.Context) {
+	report, err := h.reconcileService.Reconcile(true)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compare panels")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare panels"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// Reconcile fixes the differences between panels and connections, ?dry_run=true only reports them
+func (h *AdminHandler) Reconcile(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+
+	report, err := h.reconcileService.Reconcile(dryRun)
+	if errors.Is(err, services.ErrReconcileRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reconcile panels")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile panels"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// Queue Management
+
+// ReplayDeadLettersRequest selects dead lettered tasks to replay, no message IDs replays all
+type ReplayDeadLettersRequest struct {
+	Queue      string   `json:"queue"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+// GetDeadLetterStats returns the number of dead lettered tasks per queue
+func (h *AdminHandler) GetDeadLetterStats(c *gin.Context) {
+	stats, err := h.queue.DeadLetterStats()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to inspect dead letter queues")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to inspect dead letter queues"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"queues": stats})
+}
+
+// GetDeadLetters lists dead lettered tasks without removing them, ?queue= defaults to tasks
+func (h *AdminHandler) GetDeadLetters(c *gin.Context) {
+	queueName := c.DefaultQuery("queue", "tasks")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	letters, total, err := h.queue.DeadLetters(queueName, limit)
+	if err != nil {
+		log.Error().Err(err).Str("queue", queueName).Msg("Failed to read dead letter queue")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"queue":    queueName,
+		"messages": letters,
+		"total":    total,
+	})
+}
+
+// ReplayDeadLetters sends dead lettered tasks back to their queue with a fresh retry budget
+func (h *AdminHandler) ReplayDeadLetters(c *gin.Context) {
+	var req ReplayDeadLettersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Queue == "" {
+		req.Queue = "tasks"
+	}
+
+	replayed, err := h.queue.ReplayDeadLetters(req.Queue, req.MessageIDs)
+	if err != nil {
+		log.Error().Err(err).Str("queue", req.Queue).Msg("Failed to replay dead letters")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "replayed": replayed})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"queue": req.Queue, "replayed": replayed})
+}
+
+// PurgeDeadLetters drops all dead lettered tasks of a queue, ?queue= defaults to tasks
+func (h *AdminHandler) PurgeDeadLetters(c *gin.Context) {
+	queueName := c.DefaultQuery("queue", "tasks")
+
+	purged, err := h.queue.PurgeDeadLetters(queueName)
+	if err != nil {
+		log.Error().Err(err).Str("queue", queueName).Msg("Failed to purge dead letter queue")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"queue": queueName, "purged": purged})
+}
+
+// Payment Management
+func (h *AdminHandler) GetAllPayments(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	status := c.Query("status")
+	provider := c.Query("provider")
+
+	offset := (page - 1) * limit
+
+	var payments []models.Payment
+	var total int64
+
+	query := h.db.DB.Model(&models.Payment{})
+
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if provider != "" {
+		query = query.Where("provider = ?", provider)
+	}
+
+	query.Count(&total)
+
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&payments).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to get payments")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get payments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"payments": payments,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+func (h *AdminHandler) RefundPayment(c *gin.Context) {
+	paymentID := c.Param("id")
+	id, err := uuid.Parse(paymentID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment ID"})
+		return
+	}
+
+	payment, err := h.paymentService.RefundPayment(id)
+	if err != nil {
+		log.Error().Err(err).Str("payment_id", paymentID).Msg("Failed to refund payment")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, payment)
+}
+
+// Promo Code Management
+func (h *AdminHandler) GetAllPromoCodes(c *gin.Context) {
+	promos, err := h.promoService.ListPromoCodes()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get promo codes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get promo codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, promos)
+}
+
+type PromoCodeRequest struct {
+	Code           string      `json:"code" binding:"required"`
+	Description    *string     `json:"description"`
+	DiscountType   string      `json:"discount_type" binding:"required"` // percent, fixed
+	DiscountValue  int64       `json:"discount_value"`
+	BonusDays      int         `json:"bonus_days"`
+	MaxRedemptions int         `json:"max_redemptions"`
+	PerUserLimit   *int        `json:"per_user_limit"` // defaults to 1, 0 = unlimited
+	ValidFrom      *time.Time  `json:"valid_from"`
+	ValidUntil     *time.Time  `json:"valid_until"`
+	PlanIDs        []uuid.UUID `json:"plan_ids"` // empty = all plans
+	IsActive       *bool       `json:"is_active"`
+}
+
+func (r *PromoCodeRequest) apply(promo *models.PromoCode) {
+	promo.Code = r.Code
+	promo.Description = r.Description
+	promo.DiscountType = r.DiscountType
+	promo.DiscountValue = r.DiscountValue
+	promo.BonusDays = r.BonusDays
+	promo.MaxRedemptions = r.MaxRedemptions
+	if r.PerUserLimit != nil {
+		promo.PerUserLimit = *r.PerUserLimit
+	}
+	promo.ValidFrom = r.ValidFrom
+	promo.ValidUntil = r.ValidUntil
+	if r.IsActive != nil {
+		promo.IsActive = *r.IsActive
+	}
+}
+
+func (h *AdminHandler) CreatePromoCode(c *gin.Context) {
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	promo := models.PromoCode{
+		PerUserLimit: 1,
+		IsActive:     true,
+	}
+	req.apply(&promo)
+
+	if err := h.promoService.SavePromoCode(&promo, req.PlanIDs); err != nil {
+		log.Error().Err(err).Msg("Failed to create promo code")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, promo)
+}
+
+func (h *AdminHandler) UpdatePromoCode(c *gin.Context) {
+	promoID := c.Param("id")
+	id, err := uuid.Parse(promoID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
+
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	promo, err := h.promoService.GetPromoCode(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+		return
+	}
+
+	req.apply(promo)
+
+	if err := h.promoService.SavePromoCode(promo, req.PlanIDs); err != nil {
+		log.Error().Err(err).Msg("Failed to update promo code")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, promo)
+}
+
+func (h *AdminHandler) DeletePromoCode(c *gin.Context) {
+	promoID := c.Param("id")
+	id, err := uuid.Parse(promoID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
+
+	if err := h.promoService.DeletePromoCode(id); err != nil {
+		log.Error().Err(err).Msg("Failed to delete promo code")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete promo code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Promo code deleted successfully"})
+}
+
+func (h *AdminHandler) GetPromoCodeStats(c *gin.Context) {
+	promoID := c.Param("id")
+	id, err := uuid.Parse(promoID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
+
+	stats, err := h.promoService.GetPromoCodeStats(id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get promo code stats")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
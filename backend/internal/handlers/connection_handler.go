@@ -67,6 +67,7 @@ func (h *ConnectionHandler) CreateConnection(c *gin.Context) {
 		"config_url":       configURL,
 		"subscription_url": subscriptionURL,
 		"is_active":        connection.IsActive,
+		"status":           connection.Status,
 		"expires_at":       connection.ExpiresAt,
 		"created_at":       connection.CreatedAt,
 	}
@@ -100,6 +101,7 @@ func (h *ConnectionHandler) GetMyConnections(c *gin.Context) {
 		ConfigURL       string     `json:"config_url"`
 		SubscriptionURL string     `json:"subscription_url"`
 		IsActive        bool       `json:"is_active"`
+		Status          string     `json:"status"`
 		ExpiresAt       *time.Time `json:"expires_at"`
 		CreatedAt       time.Time  `json:"created_at"`
 		StatusMessage   string     `json:"status_message"`
@@ -108,8 +110,13 @@ func (h *ConnectionHandler) GetMyConnections(c *gin.Context) {
 	response := make([]ConnectionResponse, 0, len(connections))
 	for _, conn := range connections {
 		statusMessage := "Active"
-		if conn.ConnectionKey == "" {
-			statusMessage = "Being configured... Please refresh in a moment."
+		switch conn.Status {
+		case services.ConnectionStatusPending, services.ConnectionStatusProvisioning:
+			statusMessage = "Being configured..."
+		case services.ConnectionStatusFailed:
+			statusMessage = services.ConnectionFailedMessage
+		case services.ConnectionStatusDeprovisioning:
+			statusMessage = "Being removed..."
 		}
 
 		response = append(response, ConnectionResponse{
@@ -121,6 +128,7 @@ func (h *ConnectionHandler) GetMyConnections(c *gin.Context) {
 			ConfigURL:       conn.ConnectionKey,
 			SubscriptionURL: conn.SubscriptionLink,
 			IsActive:        conn.IsActive,
+			Status:          conn.Status,
 			ExpiresAt:       conn.ExpiresAt,
 			CreatedAt:       conn.CreatedAt,
 			StatusMessage:   statusMessage,
@@ -130,6 +138,35 @@ func (h *ConnectionHandler) GetMyConnections(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"connections": response})
 }
 
+// RetryConnection queues provisioning of a failed connection again
+func (h *ConnectionHandler) RetryConnection(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	connectionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid connection ID"})
+		return
+	}
+
+	connection, err := h.connectionService.RetryConnection(user.ID, connectionID)
+	if err != nil {
+		log.Error().Err(err).Str("connection_id", connectionID.String()).Msg("Failed to retry connection")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":     connection.ID,
+		"status": connection.Status,
+	})
+}
+
 func (h *ConnectionHandler) DeleteConnection(c *gin.Context) {
 	connectionID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/services"
+)
+
+type FamilyHandler struct {
+	familyService       *services.FamilyService
+	subscriptionService *services.SubscriptionService
+}
+
+func NewFamilyHandler(familyService *services.FamilyService, subscriptionService *services.SubscriptionService) *FamilyHandler {
+	return &FamilyHandler{
+		familyService:       familyService,
+		subscriptionService: subscriptionService,
+	}
+}
+
+type FamilyMemberResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Status     string     `json:"status"`
+	Username   string     `json:"username,omitempty"`
+	FirstName  string     `json:"first_name,omitempty"`
+	InviteLink string     `json:"invite_link,omitempty"` // pending invites only
+	JoinedAt   *time.Time `json:"joined_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (h *FamilyHandler) memberResponse(member models.FamilyMember) FamilyMemberResponse {
+	response := FamilyMemberResponse{
+		ID:        member.ID,
+		Status:    member.Status,
+		Username:  member.Username,
+		JoinedAt:  member.JoinedAt,
+		CreatedAt: member.CreatedAt,
+	}
+	if member.Status == services.FamilyMemberPending {
+		response.InviteLink = h.familyService.InviteLink(member.InviteCode)
+	}
+	if member.User != nil {
+		response.FirstName = member.User.FirstName
+		if member.User.Username != nil {
+			response.Username = *member.User.Username
+		}
+	}
+	return response
+}
+
+// GetFamily returns the family of the current user, as owner or as member
+func (h *FamilyHandler) GetFamily(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	membership, err := h.familyService.GetMembership(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get family membership")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get family"})
+		return
+	}
+	if membership != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"role":       "member",
+			"owner_name": membership.Owner.FirstName,
+			"joined_at":  membership.JoinedAt,
+		})
+		return
+	}
+
+	subscription, err := h.subscriptionService.GetActiveSubscription(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscription"})
+		return
+	}
+
+	members, err := h.familyService.GetMembers(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get family members")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get family"})
+		return
+	}
+
+	response := make([]FamilyMemberResponse, 0, len(members))
+	for _, member := range members {
+		response = append(response, h.memberResponse(member))
+	}
+
+	maxMembers := 0
+	if subscription != nil {
+		maxMembers = subscription.Plan.MaxMembers
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"role":        "owner",
+		"max_members": maxMembers,
+		"members":     response,
+	})
+}
+
+// InviteMember creates a family invite, optionally restricted to a Telegram username
+func (h *FamilyHandler) InviteMember(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"` // empty for a link anyone can use once
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, err := h.familyService.Invite(user.ID, req.Username)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, h.memberResponse(*member))
+}
+
+// RemoveMember revokes an invite or removes a member
+func (h *FamilyHandler) RemoveMember(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	memberID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member ID"})
+		return
+	}
+
+	if err := h.familyService.RemoveMember(user.ID, memberID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Family member removed"})
+}
+
+// JoinFamily accepts a family invite
+func (h *FamilyHandler) JoinFamily(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := h.familyService.Join(user.ID, req.Code); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "You joined the family plan"})
+}
+
+// LeaveFamily removes the current user from their family
+func (h *FamilyHandler) LeaveFamily(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	if err := h.familyService.Leave(user.ID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "You left the family plan"})
+}
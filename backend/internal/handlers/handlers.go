@@ -9,6 +9,7 @@ import (
 	"xray-vpn-connect/internal/config"
 	"xray-vpn-connect/internal/database"
 	"xray-vpn-connect/internal/middleware"
+	"xray-vpn-connect/internal/queue"
 	"xray-vpn-connect/internal/services"
 )
 
@@ -19,9 +20,11 @@ type Handlers struct {
 	ServerHandler       *ServerHandler
 	ConnectionHandler   *ConnectionHandler
 	AdminHandler        *AdminHandler
+	FamilyHandler       *FamilyHandler
 	SupportHandler      *SupportHandler
 	AuthHandler         *AuthHandler
 	WebHookHandler      *WebHookHandler
+	queue               queue.TaskQueue
 }
 
 func NewHandlers(
@@ -31,18 +34,27 @@ func NewHandlers(
 	planService *services.PlanService,
 	connectionService *services.ConnectionService,
 	telegramService *services.TelegramService,
+	promoService *services.PromoCodeService,
+	referralService *services.ReferralService,
+	familyService *services.FamilyService,
+	serverService *services.ServerService,
+	reconcileService *services.ReconcileService,
+	panelService *services.XrayPanelService,
+	q queue.TaskQueue,
 	db *database.DB,
 ) *Handlers {
 	return &Handlers{
-		UserHandler:         NewUserHandler(userService, paymentService, db),
+		UserHandler:         NewUserHandler(userService, paymentService, referralService, db),
 		SubscriptionHandler: NewSubscriptionHandler(subscriptionService, planService, userService),
 		PlanService:         planService,
-		ServerHandler:       NewServerHandler(db, userService),
+		ServerHandler:       NewServerHandler(db, userService, serverService),
 		ConnectionHandler:   NewConnectionHandler(connectionService, userService),
-		AdminHandler:        NewAdminHandler(db),
+		AdminHandler:        NewAdminHandler(db, paymentService, promoService, subscriptionService, serverService, reconcileService, panelService, q),
+		FamilyHandler:       NewFamilyHandler(familyService, subscriptionService),
 		SupportHandler:      NewSupportHandler(db, userService),
 		AuthHandler:         NewAuthHandler(db, userService),
-		WebHookHandler:      NewWebhookHandler(db, userService, paymentService, telegramService),
+		WebHookHandler:      NewWebhookHandler(db, userService, paymentService, subscriptionService, familyService, telegramService),
+		queue:               q,
 	}
 }
 
@@ -54,11 +66,16 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 	})
 
 	h.UserHandler.SetConfig(cfg)
+	h.SubscriptionHandler.SetConfig(cfg)
 	h.WebHookHandler.SetConfig(cfg)
 
-	// Health check
+	// Health check, the API keeps serving while RabbitMQ reconnects
 	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok", "timestamp": time.Now().Unix()})
+		c.JSON(http.StatusOK, gin.H{
+			"status":    "ok",
+			"rabbitmq":  h.queue.Connected(),
+			"timestamp": time.Now().Unix(),
+		})
 	})
 
 	// Readiness check
@@ -66,7 +83,11 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 		// Check database connection
 		sqlDB, err := db.DB.DB()
 		if err != nil || sqlDB.Ping() != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready"})
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": "database"})
+			return
+		}
+		if !h.queue.Connected() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": "rabbitmq"})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"status": "ready"})
@@ -78,6 +99,9 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 	// Telegram webhook endpoint (public)
 	r.POST("/webhook/telegram", h.WebHookHandler.HandleWebhook)
 
+	// Payment provider webhooks (public, verified by provider signature)
+	r.POST("/webhook/payments/:provider", h.WebHookHandler.HandlePaymentWebhook)
+
 	api := r.Group("/api/v1")
 	{
 		// Public endpoint to get bot information
@@ -116,6 +140,7 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 		protected.Use(middleware.Auth())
 		{
 			protected.GET("/servers", h.ServerHandler.GetServers)
+			protected.GET("/servers/best", h.ServerHandler.GetBestServer)
 
 			// User routes
 			userRoutes := protected.Group("/users")
@@ -123,7 +148,11 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 				userRoutes.GET("/me", h.UserHandler.Me)
 				userRoutes.POST("/topup", h.UserHandler.TopUp)
 				userRoutes.POST("/initiate-stars-payment", h.UserHandler.InitiateStarsPayment)
+				userRoutes.POST("/initiate-payment", h.UserHandler.InitiatePayment)
+				userRoutes.GET("/payment-providers", h.UserHandler.GetPaymentProviders)
 				userRoutes.GET("/referral-stats", h.UserHandler.GetReferralStats)
+				userRoutes.GET("/referral-rewards", h.UserHandler.GetReferralRewards)
+				userRoutes.POST("/referral", h.UserHandler.ApplyReferralCode)
 			}
 
 			// Subscription routes
@@ -131,15 +160,33 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 			{
 				subscriptionRoutes.GET("/plans", h.SubscriptionHandler.GetPlans)
 				subscriptionRoutes.POST("/purchase", h.SubscriptionHandler.PurchasePlan)
+				subscriptionRoutes.POST("/promo/validate", h.SubscriptionHandler.ValidatePromoCode)
+				subscriptionRoutes.POST("/change-plan/quote", h.SubscriptionHandler.QuotePlanChange)
+				subscriptionRoutes.POST("/change-plan", h.SubscriptionHandler.ChangePlan)
+				subscriptionRoutes.POST("/freeze", h.SubscriptionHandler.FreezeSubscription)
+				subscriptionRoutes.POST("/unfreeze", h.SubscriptionHandler.UnfreezeSubscription)
+				subscriptionRoutes.GET("/gifts", h.SubscriptionHandler.GetMyGifts)
+				subscriptionRoutes.POST("/gifts/redeem", h.SubscriptionHandler.RedeemGift)
 				subscriptionRoutes.GET("/me", h.SubscriptionHandler.GetMySubscription)
 			}
 
+			// Family plan routes
+			familyRoutes := protected.Group("/family")
+			{
+				familyRoutes.GET("", h.FamilyHandler.GetFamily)
+				familyRoutes.POST("/invites", h.FamilyHandler.InviteMember)
+				familyRoutes.DELETE("/members/:id", h.FamilyHandler.RemoveMember)
+				familyRoutes.POST("/join", h.FamilyHandler.JoinFamily)
+				familyRoutes.POST("/leave", h.FamilyHandler.LeaveFamily)
+			}
+
 			// Connection routes
 			connectionRoutes := protected.Group("/connections")
 			{
 				connectionRoutes.GET("", h.ConnectionHandler.GetMyConnections)
 				connectionRoutes.POST("", h.ConnectionHandler.CreateConnection)
 				connectionRoutes.DELETE("/:id", h.ConnectionHandler.DeleteConnection)
+				connectionRoutes.POST("/:id/retry", h.ConnectionHandler.RetryConnection)
 			}
 
 			// Support routes
@@ -164,13 +211,28 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 				adminRoutes.PUT("/servers/:id", h.AdminHandler.UpdateServer)
 				adminRoutes.DELETE("/servers/:id", h.AdminHandler.DeleteServer)
 				adminRoutes.GET("/servers/:id/users", h.AdminHandler.GetServerUsers)
+				adminRoutes.GET("/servers/:id/health", h.AdminHandler.GetServerHealth)
 
 				// Xray panel management
 				adminRoutes.GET("/xray-panels", h.AdminHandler.GetAllXrayPanels)
+				adminRoutes.POST("/xray-panels", h.AdminHandler.CreateXrayPanel)
+				adminRoutes.POST("/xray-panels/test", h.AdminHandler.TestXrayPanelCredentials)
+				adminRoutes.PUT("/xray-panels/:id", h.AdminHandler.UpdateXrayPanel)
+				adminRoutes.DELETE("/xray-panels/:id", h.AdminHandler.DeleteXrayPanel)
+				adminRoutes.POST("/xray-panels/:id/test", h.AdminHandler.TestXrayPanel)
+				adminRoutes.GET("/xray-panels/:id/sync", h.AdminHandler.GetXrayPanelSync)
+				adminRoutes.POST("/xray-panels/:id/sync", h.AdminHandler.SyncXrayPanel)
+				adminRoutes.GET("/reconcile", h.AdminHandler.GetReconcileDiff)
+				adminRoutes.POST("/reconcile", h.AdminHandler.Reconcile)
+				adminRoutes.GET("/queues/dlq/stats", h.AdminHandler.GetDeadLetterStats)
+				adminRoutes.GET("/queues/dlq", h.AdminHandler.GetDeadLetters)
+				adminRoutes.POST("/queues/dlq/replay", h.AdminHandler.ReplayDeadLetters)
+				adminRoutes.DELETE("/queues/dlq", h.AdminHandler.PurgeDeadLetters)
 
 				// User management
 				adminRoutes.GET("/users", h.AdminHandler.GetAllUsers)
 				adminRoutes.PUT("/users/:id", h.AdminHandler.UpdateUser)
+				adminRoutes.POST("/users/:id/subscription/cancel", h.AdminHandler.CancelUserSubscription)
 
 				// Plan management
 				adminRoutes.GET("/plans", h.AdminHandler.GetAllPlans)
@@ -178,6 +240,17 @@ func (h *Handlers) SetupRoutes(r *gin.Engine, cfg *config.Config, db *database.D
 				adminRoutes.PUT("/plans/:id", h.AdminHandler.UpdatePlan)
 				adminRoutes.DELETE("/plans/:id", h.AdminHandler.DeletePlan)
 
+				// Promo code management
+				adminRoutes.GET("/promo-codes", h.AdminHandler.GetAllPromoCodes)
+				adminRoutes.POST("/promo-codes", h.AdminHandler.CreatePromoCode)
+				adminRoutes.PUT("/promo-codes/:id", h.AdminHandler.UpdatePromoCode)
+				adminRoutes.DELETE("/promo-codes/:id", h.AdminHandler.DeletePromoCode)
+				adminRoutes.GET("/promo-codes/:id/stats", h.AdminHandler.GetPromoCodeStats)
+
+				// Payment management
+				adminRoutes.GET("/payments", h.AdminHandler.GetAllPayments)
+				adminRoutes.POST("/payments/:id/refund", h.AdminHandler.RefundPayment)
+
 				// Ticket management
 				adminRoutes.GET("/tickets", h.AdminHandler.GetAllTickets)
 				adminRoutes.POST("/tickets/:id/reply", h.AdminHandler.ReplyToTicket)
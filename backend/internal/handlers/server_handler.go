@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"net/http"
+	"time"
 	"xray-vpn-connect/internal/services"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 
 	"xray-vpn-connect/internal/database"
@@ -12,17 +14,52 @@ import (
 )
 
 type ServerHandler struct {
-	db          *database.DB
-	userService *services.UserService
+	db            *database.DB
+	userService   *services.UserService
+	serverService *services.ServerService
 }
 
-func NewServerHandler(db *database.DB, userService *services.UserService) *ServerHandler {
+func NewServerHandler(db *database.DB, userService *services.UserService, serverService *services.ServerService) *ServerHandler {
 	return &ServerHandler{
-		db:          db,
-		userService: userService,
+		db:            db,
+		userService:   userService,
+		serverService: serverService,
 	}
 }
 
+type ServerResponse struct {
+	ID            string     `json:"id"`
+	Country       string     `json:"country"`
+	Flag          string     `json:"flag"`
+	Protocol      string     `json:"protocol"`
+	Status        string     `json:"status"`
+	Ping          int        `json:"ping"`             // measured connect time in ms, 0 = not measured yet
+	Uptime        *float64   `json:"uptime,omitempty"` // share of successful health checks over the last 24h, percent
+	LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+	AdminMessage  *string    `json:"admin_message,omitempty"`
+}
+
+// uptimeWindow is the period the uptime shown to users is calculated over
+const uptimeWindow = 24 * time.Hour
+
+// newServerResponse builds the user facing view of a server from its last health check
+func newServerResponse(server models.Server, uptime map[uuid.UUID]float64) ServerResponse {
+	response := ServerResponse{
+		ID:            server.ID.String(),
+		Country:       server.Country,
+		Flag:          server.Flag,
+		Protocol:      server.Protocol,
+		Status:        server.Status,
+		Ping:          server.LatencyMs,
+		LastCheckedAt: server.LastCheckedAt,
+		AdminMessage:  server.AdminMessage,
+	}
+	if value, ok := uptime[server.ID]; ok {
+		response.Uptime = &value
+	}
+	return response
+}
+
 func (h *ServerHandler) GetServers(c *gin.Context) {
 	userInterface, _ := c.Get("user")
 
@@ -46,48 +83,46 @@ func (h *ServerHandler) GetServers(c *gin.Context) {
 		return
 	}
 
-	// Transform to response format with realistic ping calculation
-	type ServerResponse struct {
-		ID           string  `json:"id"`
-		Country      string  `json:"country"`
-		Flag         string  `json:"flag"`
-		Protocol     string  `json:"protocol"`
-		Status       string  `json:"status"`
-		Ping         int     `json:"ping"`
-		AdminMessage *string `json:"admin_message,omitempty"`
+	uptime, err := h.serverService.Uptime(time.Now().Add(-uptimeWindow))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get server uptime")
 	}
 
+	// Transform to response format
 	response := make([]ServerResponse, 0, len(servers))
 	for _, server := range servers {
-		// Calculate realistic ping based on server location and current load
-		ping := 30 + (server.CurrentLoad * 3)
-		if server.Country == "United States" || server.Country == "Canada" {
-			ping += 10
-		} else if server.Country == "Germany" || server.Country == "Netherlands" || server.Country == "United Kingdom" {
-			ping += 20
-		} else if server.Country == "Singapore" || server.Country == "Japan" || server.Country == "South Korea" {
-			ping += 40
-		} else if server.Country == "Australia" || server.Country == "Brazil" {
-			ping += 60
-		} else {
-			ping += 30 // Default for other locations
-		}
-
-		// Cap maximum ping
-		if ping > 300 {
-			ping = 300
-		}
-
-		response = append(response, ServerResponse{
-			ID:           server.ID.String(),
-			Country:      server.Country,
-			Flag:         server.Flag,
-			Protocol:     server.Protocol,
-			Status:       server.Status,
-			Ping:         ping,
-			AdminMessage: server.AdminMessage,
-		})
+		response = append(response, newServerResponse(server, uptime))
 	}
 
 	c.JSON(http.StatusOK, gin.H{"servers": response})
 }
+
+// GetBestServer returns the least loaded available server in a country
+func (h *ServerHandler) GetBestServer(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	country := c.Query("country")
+	if country == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "country is required"})
+		return
+	}
+
+	server, err := h.serverService.BestServer(user.ID, country)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No available server in this country"})
+		return
+	}
+
+	uptime, err := h.serverService.Uptime(time.Now().Add(-uptimeWindow))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get server uptime")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"server": newServerResponse(*server, uptime)})
+}
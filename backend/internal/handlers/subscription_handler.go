@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 
+	"xray-vpn-connect/internal/config"
 	"xray-vpn-connect/internal/models"
 	"xray-vpn-connect/internal/services"
 )
@@ -15,6 +18,7 @@ type SubscriptionHandler struct {
 	subscriptionService *services.SubscriptionService
 	planService         *services.PlanService
 	userService         *services.UserService
+	config              *config.Config
 }
 
 func NewSubscriptionHandler(subscriptionService *services.SubscriptionService, planService *services.PlanService, userService *services.UserService) *SubscriptionHandler {
@@ -25,6 +29,10 @@ func NewSubscriptionHandler(subscriptionService *services.SubscriptionService, p
 	}
 }
 
+func (h *SubscriptionHandler) SetConfig(cfg *config.Config) {
+	h.config = cfg
+}
+
 func (h *SubscriptionHandler) GetPlans(c *gin.Context) {
 	plans, err := h.planService.GetActivePlans()
 	if err != nil {
@@ -46,14 +54,37 @@ func (h *SubscriptionHandler) PurchasePlan(c *gin.Context) {
 	}
 
 	var req struct {
-		PlanID uuid.UUID `json:"plan_id" binding:"required"`
+		PlanID    uuid.UUID `json:"plan_id" binding:"required"`
+		PromoCode string    `json:"promo_code"`
+		AsGift    bool      `json:"as_gift"` // issue a gift code instead of activating the plan
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	subscription, err := h.subscriptionService.PurchaseSubscription(user.ID, req.PlanID)
+	if req.AsGift {
+		if req.PromoCode != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Promo codes cannot be applied to gifts"})
+			return
+		}
+
+		gift, err := h.subscriptionService.PurchaseGift(user.ID, req.PlanID)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to purchase gift")
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"gift_code": gift.Code,
+			"gift_link": h.giftLink(gift.Code),
+			"plan":      gift.Plan,
+		})
+		return
+	}
+
+	subscription, err := h.subscriptionService.PurchaseSubscription(user.ID, req.PlanID, req.PromoCode)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to purchase subscription")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -63,6 +94,212 @@ func (h *SubscriptionHandler) PurchasePlan(c *gin.Context) {
 	c.JSON(http.StatusOK, subscription)
 }
 
+// ValidatePromoCode returns the plan price after applying a promo code
+func (h *SubscriptionHandler) ValidatePromoCode(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req struct {
+		PlanID    uuid.UUID `json:"plan_id" binding:"required"`
+		PromoCode string    `json:"promo_code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	quote, err := h.subscriptionService.QuotePlan(user.ID, req.PlanID, req.PromoCode)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
+
+// QuotePlanChange returns the prorated cost of switching to another plan
+func (h *SubscriptionHandler) QuotePlanChange(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req struct {
+		PlanID uuid.UUID `json:"plan_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	quote, err := h.subscriptionService.QuotePlanChange(user.ID, req.PlanID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
+
+// ChangePlan upgrades or downgrades the active subscription
+func (h *SubscriptionHandler) ChangePlan(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req struct {
+		PlanID uuid.UUID `json:"plan_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscription, quote, err := h.subscriptionService.ChangePlan(user.ID, req.PlanID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to change plan")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subscription": subscription,
+		"credit":       quote.Credit,
+		"charge":       quote.Charge,
+	})
+}
+
+// FreezeSubscription pauses the active subscription
+func (h *SubscriptionHandler) FreezeSubscription(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	subscription, err := h.subscriptionService.FreezeSubscription(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to freeze subscription")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// UnfreezeSubscription resumes a frozen subscription
+func (h *SubscriptionHandler) UnfreezeSubscription(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	subscription, err := h.subscriptionService.UnfreezeSubscription(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to unfreeze subscription")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// RedeemGift activates a gift code for the current user
+func (h *SubscriptionHandler) RedeemGift(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscription, err := h.subscriptionService.RedeemGift(user.ID, req.Code)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to redeem gift")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// GetMyGifts returns gift codes bought by the current user
+func (h *SubscriptionHandler) GetMyGifts(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	gifts, err := h.subscriptionService.GetPurchasedGifts(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get gifts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get gifts"})
+		return
+	}
+
+	type GiftResponse struct {
+		Code       string      `json:"code"`
+		Link       string      `json:"link"`
+		Plan       models.Plan `json:"plan"`
+		PricePaid  int64       `json:"price_paid"`
+		IsRedeemed bool        `json:"is_redeemed"`
+		RedeemedAt *time.Time  `json:"redeemed_at,omitempty"`
+		CreatedAt  time.Time   `json:"created_at"`
+	}
+
+	response := make([]GiftResponse, 0, len(gifts))
+	for _, gift := range gifts {
+		response = append(response, GiftResponse{
+			Code:       gift.Code,
+			Link:       h.giftLink(gift.Code),
+			Plan:       gift.Plan,
+			PricePaid:  gift.PricePaid,
+			IsRedeemed: gift.RedeemedBy != nil,
+			RedeemedAt: gift.RedeemedAt,
+			CreatedAt:  gift.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"gifts": response})
+}
+
+// giftLink builds the bot deep link that redeems a gift code
+func (h *SubscriptionHandler) giftLink(code string) string {
+	if h.config == nil || h.config.Telegram.BotUsername == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/%s?start=gift_%s", h.config.Telegram.BotUsername, code)
+}
+
 func (h *SubscriptionHandler) GetMySubscription(c *gin.Context) {
 	userInterface, _ := c.Get("user")
 
@@ -79,6 +316,38 @@ func (h *SubscriptionHandler) GetMySubscription(c *gin.Context) {
 	}
 
 	if subscription == nil {
+		frozen, err := h.subscriptionService.GetFrozenSubscription(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscription"})
+			return
+		}
+		if frozen != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"active":         false,
+				"frozen":         true,
+				"frozen_at":      frozen.FrozenAt,
+				"remaining_days": frozen.Remaining / (24 * 60 * 60),
+				"plan_name":      frozen.Plan.Name,
+			})
+			return
+		}
+
+		// Family members use the owner's subscription
+		shared, err := h.subscriptionService.GetEffectiveSubscription(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscription"})
+			return
+		}
+		if shared != nil && shared.FrozenAt == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"active":     true,
+				"family":     true,
+				"expires_at": shared.ExpiresAt,
+				"plan_name":  shared.Plan.Name,
+			})
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"active": false,
 		})
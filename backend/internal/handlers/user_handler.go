@@ -3,6 +3,7 @@ package handlers
 import (
 	"fmt"
 	"net/http"
+	"time"
 	"xray-vpn-connect/internal/config"
 
 	"github.com/gin-gonic/gin"
@@ -15,17 +16,19 @@ import (
 )
 
 type UserHandler struct {
-	userService    *services.UserService
-	paymentService *services.PaymentService
-	db             *database.DB
-	config         *config.Config
+	userService     *services.UserService
+	paymentService  *services.PaymentService
+	referralService *services.ReferralService
+	db              *database.DB
+	config          *config.Config
 }
 
-func NewUserHandler(userService *services.UserService, paymentService *services.PaymentService, db *database.DB) *UserHandler {
+func NewUserHandler(userService *services.UserService, paymentService *services.PaymentService, referralService *services.ReferralService, db *database.DB) *UserHandler {
 	return &UserHandler{
-		userService:    userService,
-		paymentService: paymentService,
-		db:             db,
+		userService:     userService,
+		paymentService:  paymentService,
+		referralService: referralService,
+		db:              db,
 	}
 }
 
@@ -71,9 +74,69 @@ type TopUpRequest struct {
 	Amount int64 `json:"amount" binding:"required,min=1"`
 }
 
+type InitiatePaymentRequest struct {
+	Amount   int64  `json:"amount" binding:"required,min=1"`
+	Provider string `json:"provider"` // defaults to payments.default_provider
+}
+
 type InitiatePaymentResponse struct {
 	InvoiceLink string `json:"invoice_link"`
 	PaymentID   string `json:"payment_id"`
+	Provider    string `json:"provider,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+}
+
+// GetPaymentProviders returns the payment providers available to the user
+func (h *UserHandler) GetPaymentProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"providers":        h.paymentService.ProviderNames(),
+		"default_provider": h.paymentService.DefaultProvider(),
+	})
+}
+
+// InitiatePayment creates a payment request with the selected provider
+func (h *UserHandler) InitiatePayment(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req InitiatePaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Amount > 2500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be between 1 and 2500 Stars"})
+		return
+	}
+
+	provider := req.Provider
+	if provider == "" {
+		provider = h.paymentService.DefaultProvider()
+	}
+	if _, err := h.paymentService.Provider(provider); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payment, err := h.paymentService.CreatePayment(provider, user.ID, user.TelegramID, req.Amount)
+	if err != nil {
+		log.Error().Err(err).Str("provider", provider).Msg("Failed to create payment")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate payment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, InitiatePaymentResponse{
+		InvoiceLink: payment.InvoiceLink,
+		PaymentID:   payment.ID.String(),
+		Provider:    payment.Provider,
+		Currency:    payment.Currency,
+	})
 }
 
 // InitiateStarsPayment creates a payment request for Telegram Stars
@@ -99,7 +162,7 @@ func (h *UserHandler) InitiateStarsPayment(c *gin.Context) {
 	}
 
 	// Create payment
-	payment, err := h.paymentService.CreatePayment(user.ID, user.TelegramID, req.Amount)
+	payment, err := h.paymentService.CreatePayment(services.ProviderTelegramStars, user.ID, user.TelegramID, req.Amount)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create payment")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate payment"})
@@ -147,6 +210,13 @@ func (h *UserHandler) GetReferralStats(c *gin.Context) {
 		return
 	}
 
+	stats, err := h.referralService.GetStats(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get referral stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get referral stats"})
+		return
+	}
+
 	// Count total referrals
 	var totalReferrals int64
 	h.db.DB.Model(&models.User{}).Where("referred_by = ?", user.ID).Count(&totalReferrals)
@@ -158,19 +228,83 @@ func (h *UserHandler) GetReferralStats(c *gin.Context) {
 		Where("users.referred_by = ? AND subscriptions.is_active = ?", user.ID, true).
 		Count(&activeReferrals)
 
-	// Calculate reward earned (10% of total)
-	rewardEarned := activeReferrals * 50
-
 	// Generate referral link using environment variable
 	botUsername := h.config.Telegram.BotUsername
-	referralLink := fmt.Sprintf("https://t.me/%s?start=%s", botUsername, user.ReferralCode)
+	referralLink := fmt.Sprintf("https://t.me/%s?start=ref_%s", botUsername, user.ReferralCode)
 
 	c.JSON(http.StatusOK, gin.H{
-		"referral_code":    user.ReferralCode,
-		"referral_link":    referralLink,
-		"referral_url":     referralLink,
-		"total_referrals":  totalReferrals,
-		"active_referrals": activeReferrals,
-		"reward_earned":    rewardEarned,
+		"referral_code":      user.ReferralCode,
+		"referral_link":      referralLink,
+		"referral_url":       referralLink,
+		"total_referrals":    totalReferrals,
+		"active_referrals":   activeReferrals,
+		"reward_earned":      stats.RewardEarned,
+		"reward_days_earned": stats.RewardDaysEarned,
+		"reward_type":        h.config.Referral.RewardType,
 	})
 }
+
+// GetReferralRewards returns the rewards credited to the user for referrals
+func (h *UserHandler) GetReferralRewards(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	rewards, err := h.referralService.GetRewards(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get referral rewards")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get referral rewards"})
+		return
+	}
+
+	type RewardResponse struct {
+		ReferredName string    `json:"referred_name"`
+		RewardType   string    `json:"reward_type"`
+		Stars        int64     `json:"stars"`
+		BonusDays    int       `json:"bonus_days"`
+		CreatedAt    time.Time `json:"created_at"`
+	}
+
+	response := make([]RewardResponse, 0, len(rewards))
+	for _, reward := range rewards {
+		response = append(response, RewardResponse{
+			ReferredName: reward.Referred.FirstName,
+			RewardType:   reward.RewardType,
+			Stars:        reward.Stars,
+			BonusDays:    reward.BonusDays,
+			CreatedAt:    reward.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rewards": response})
+}
+
+// ApplyReferralCode links the current user to a referrer
+func (h *UserHandler) ApplyReferralCode(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+
+	user, ok := userInterface.(models.User)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user from session"})
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.userService.UseReferralCode(user.ID, req.Code); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Referral code applied successfully"})
+}
@@ -2,10 +2,12 @@ package handlers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
 	"io"
 	"net/http"
 	"strings"
@@ -84,19 +86,23 @@ type Update struct {
 }
 
 type WebHookHandler struct {
-	db              *database.DB
-	config          *config.Config
-	userService     *services.UserService
-	paymentService  *services.PaymentService
-	telegramService *services.TelegramService
+	db                  *database.DB
+	config              *config.Config
+	userService         *services.UserService
+	paymentService      *services.PaymentService
+	subscriptionService *services.SubscriptionService
+	familyService       *services.FamilyService
+	telegramService     *services.TelegramService
 }
 
-func NewWebhookHandler(db *database.DB, userService *services.UserService, paymentService *services.PaymentService, telegramService *services.TelegramService) *WebHookHandler {
+func NewWebhookHandler(db *database.DB, userService *services.UserService, paymentService *services.PaymentService, subscriptionService *services.SubscriptionService, familyService *services.FamilyService, telegramService *services.TelegramService) *WebHookHandler {
 	return &WebHookHandler{
-		db:              db,
-		userService:     userService,
-		paymentService:  paymentService,
-		telegramService: telegramService,
+		db:                  db,
+		userService:         userService,
+		paymentService:      paymentService,
+		subscriptionService: subscriptionService,
+		familyService:       familyService,
+		telegramService:     telegramService,
 	}
 }
 
@@ -106,9 +112,10 @@ func (h *WebHookHandler) SetConfig(cfg *config.Config) {
 
 func (h *WebHookHandler) HandleWebhook(c *gin.Context) {
 	var update Update
+	var bodyBytes []byte
 
 	if c.Request.Body != nil {
-		bodyBytes, _ := io.ReadAll(c.Request.Body)
+		bodyBytes, _ = io.ReadAll(c.Request.Body)
 
 		log.Info().Str("raw_body", string(bodyBytes)).Msg("Incoming Telegram webhook")
 
@@ -125,7 +132,7 @@ func (h *WebHookHandler) HandleWebhook(c *gin.Context) {
 	case update.Message.Text != "":
 		h.commands(c, update)
 	case update.PreCheckoutQuery.ID != "" || update.Message.SuccessfulPayment.InvoicePayload != "":
-		h.starsPayment(c, update)
+		h.starsPayment(c, update, bodyBytes)
 	default:
 		log.Error().Msg("Invalid update type")
 		c.JSON(http.StatusOK, gin.H{})
@@ -138,6 +145,24 @@ func (h *WebHookHandler) commands(c *gin.Context, update Update) {
 	if update.Message.Text != "" && strings.HasPrefix(update.Message.Text, "/start ") {
 		state := strings.TrimPrefix(update.Message.Text, "/start ")
 
+		// Gift deep link: /start gift_<code>
+		if strings.HasPrefix(state, "gift_") {
+			h.redeemGift(c, update, strings.TrimPrefix(state, "gift_"))
+			return
+		}
+
+		// Family invite deep link: /start family_<code>
+		if strings.HasPrefix(state, "family_") {
+			h.joinFamily(c, update, strings.TrimPrefix(state, "family_"))
+			return
+		}
+
+		// Referral deep link: /start ref_<code>
+		if strings.HasPrefix(state, "ref_") {
+			h.referral(c, update, strings.TrimPrefix(state, "ref_"))
+			return
+		}
+
 		// Validate the state parameter
 		var authSession models.AuthSession
 		if err := h.db.DB.Where("state = ? AND expires_at > ?", state, time.Now()).First(&authSession).Error; err != nil {
@@ -278,8 +303,140 @@ func (h *WebHookHandler) commands(c *gin.Context, update Update) {
 	c.JSON(http.StatusOK, gin.H{})
 }
 
+// referral registers a new user invited with a /start ref_<code> link
+func (h *WebHookHandler) referral(c *gin.Context, update Update, code string) {
+	_, lookupErr := h.userService.GetUserByTelegramID(update.Message.From.ID)
+	isNewUser := errors.Is(lookupErr, gorm.ErrRecordNotFound)
+
+	user, err := h.userService.GetOrCreateUser(update.Message.From.ID, update.Message.From.Username, update.Message.From.FirstName, update.Message.From.LastName, update.Message.From.LanguageCode)
+	if err != nil {
+		log.Error().Err(err).Int64("telegram_id", update.Message.From.ID).Msg("Failed to get or create user")
+		h.telegramService.SendTelegramMessage(h.db, h.config, update.Message.Chat.ID, "❌ Something went wrong. Please try again later.")
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	// Existing users keep their referrer (or lack of one)
+	if isNewUser {
+		if err := h.userService.UseReferralCode(user.ID, code); err != nil {
+			log.Warn().Err(err).Str("code", code).Msg("Failed to apply referral code")
+		}
+	}
+
+	frontendURL := h.config.Telegram.FrontendURL
+	if frontendURL == "" {
+		frontendURL = "https://your-domain.com" // fallback
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"method":  "sendMessage",
+		"chat_id": update.Message.Chat.ID,
+		"text":    "🌟 Welcome to VPN Connect!\n\nYou were invited by a friend. Click the button below to open the application:",
+		"reply_markup": map[string]interface{}{
+			"inline_keyboard": [][]map[string]interface{}{
+				{
+					{
+						"text": "Open VPN App",
+						"web_app": map[string]string{
+							"url": frontendURL,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+// joinFamily accepts a family invite for the sender of a /start family_<code> command
+func (h *WebHookHandler) joinFamily(c *gin.Context, update Update, code string) {
+	user, err := h.userService.GetOrCreateUser(update.Message.From.ID, update.Message.From.Username, update.Message.From.FirstName, update.Message.From.LastName, update.Message.From.LanguageCode)
+	if err != nil {
+		log.Error().Err(err).Int64("telegram_id", update.Message.From.ID).Msg("Failed to get or create user")
+		h.telegramService.SendTelegramMessage(h.db, h.config, update.Message.Chat.ID, "❌ Failed to join the family plan. Please try again later.")
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	if _, err := h.familyService.Join(user.ID, code); err != nil {
+		log.Warn().Err(err).Str("code", code).Msg("Failed to join family")
+		h.telegramService.SendTelegramMessage(h.db, h.config, update.Message.Chat.ID, fmt.Sprintf("❌ Failed to join the family plan: %s", err.Error()))
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	frontendURL := h.config.Telegram.FrontendURL
+	if frontendURL == "" {
+		frontendURL = "https://your-domain.com" // fallback
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"method":  "sendMessage",
+		"chat_id": update.Message.Chat.ID,
+		"text":    "👨‍👩‍👧 You joined the family plan! Open the app to create your connection:",
+		"reply_markup": map[string]interface{}{
+			"inline_keyboard": [][]map[string]interface{}{
+				{
+					{
+						"text": "Open VPN App",
+						"web_app": map[string]string{
+							"url": frontendURL,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+// redeemGift activates a gift code for the sender of a /start gift_<code> command
+func (h *WebHookHandler) redeemGift(c *gin.Context, update Update, code string) {
+	user, err := h.userService.GetOrCreateUser(update.Message.From.ID, update.Message.From.Username, update.Message.From.FirstName, update.Message.From.LastName, update.Message.From.LanguageCode)
+	if err != nil {
+		log.Error().Err(err).Int64("telegram_id", update.Message.From.ID).Msg("Failed to get or create user")
+		h.telegramService.SendTelegramMessage(h.db, h.config, update.Message.Chat.ID, "❌ Failed to redeem gift. Please try again later.")
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	subscription, err := h.subscriptionService.RedeemGift(user.ID, code)
+	if err != nil {
+		log.Warn().Err(err).Str("code", code).Msg("Failed to redeem gift code")
+		h.telegramService.SendTelegramMessage(h.db, h.config, update.Message.Chat.ID, fmt.Sprintf("❌ Failed to redeem gift: %s", err.Error()))
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	frontendURL := h.config.Telegram.FrontendURL
+	if frontendURL == "" {
+		frontendURL = "https://your-domain.com" // fallback
+	}
+
+	text := fmt.Sprintf("🎁 Gift activated: %s!", subscription.Plan.Name)
+	if subscription.ExpiresAt != nil {
+		text += fmt.Sprintf("\n\nYour subscription is active until %s.", subscription.ExpiresAt.Format("02.01.2006"))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"method":  "sendMessage",
+		"chat_id": update.Message.Chat.ID,
+		"text":    text,
+		"reply_markup": map[string]interface{}{
+			"inline_keyboard": [][]map[string]interface{}{
+				{
+					{
+						"text": "Open VPN App",
+						"web_app": map[string]string{
+							"url": frontendURL,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
 // starsPayment handles incoming payment confirmations from Telegram
-func (h *WebHookHandler) starsPayment(c *gin.Context, update Update) {
+func (h *WebHookHandler) starsPayment(c *gin.Context, update Update, body []byte) {
 	// Handle pre-checkout query
 	if update.PreCheckoutQuery.ID != "" {
 		err := h.telegramService.AnswerPreCheckoutQuery(update.PreCheckoutQuery.ID, true)
@@ -293,18 +450,15 @@ func (h *WebHookHandler) starsPayment(c *gin.Context, update Update) {
 
 	// Handle successful payment
 	if update.Message.SuccessfulPayment.InvoicePayload != "" {
-		// Process the payment
-		err := h.paymentService.ProcessPaymentWebhook(
-			update.Message.SuccessfulPayment.InvoicePayload,
-			update.Message.From.ID,
-		)
+		// Verify and process the payment
+		payment, err := h.paymentService.HandleWebhook(services.ProviderTelegramStars, c.Request.Header, body)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to process payment webhook")
 			// We still return 200 OK to Telegram
 		}
 
 		// Send confirmation message to user
-		if update.Message.Chat.ID != 0 {
+		if payment != nil && update.Message.Chat.ID != 0 {
 			h.telegramService.SendTelegramMessage(h.db, h.config, update.Message.Chat.ID,
 				fmt.Sprintf("✅ Payment successful! Your balance has been topped up with %d Stars.", update.Message.SuccessfulPayment.TotalAmount))
 		}
@@ -316,3 +470,29 @@ func (h *WebHookHandler) starsPayment(c *gin.Context, update Update) {
 	// Default response
 	c.JSON(http.StatusOK, gin.H{})
 }
+
+// HandlePaymentWebhook handles webhooks of external payment providers (cryptopay, mock)
+func (h *WebHookHandler) HandlePaymentWebhook(c *gin.Context) {
+	provider := c.Param("provider")
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+		return
+	}
+
+	payment, err := h.paymentService.HandleWebhook(provider, c.Request.Header, body)
+	if err != nil {
+		log.Error().Err(err).Str("provider", provider).Msg("Failed to process payment webhook")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook"})
+		return
+	}
+
+	// Notify user in Telegram
+	if payment != nil {
+		h.telegramService.SendTelegramMessage(h.db, h.config, payment.TelegramID,
+			fmt.Sprintf("✅ Payment successful! Your balance has been topped up with %d Stars.", payment.Amount))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -38,6 +38,9 @@ type Plan struct {
 	DurationMonths int       `gorm:"not null" json:"duration_months"`
 	PriceStars     int64     `gorm:"not null" json:"price_stars"`
 	Discount       *string   `json:"discount,omitempty"`
+	TrafficLimitGB int64     `json:"traffic_limit_gb"` // per connection, 0 = unlimited
+	DeviceLimit    int       `json:"device_limit"`     // simultaneous IPs per connection, 0 = unlimited
+	MaxMembers     int       `json:"max_members"`      // family members besides the owner, 0 = personal plan
 	IsActive       bool      `gorm:"default:true" json:"is_active"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
@@ -54,6 +57,9 @@ type Subscription struct {
 	IsActive  bool       `gorm:"default:false;index" json:"is_active"`
 	StartedAt *time.Time `json:"started_at,omitempty"`
 	ExpiresAt *time.Time `gorm:"index" json:"expires_at,omitempty"`
+	FrozenAt  *time.Time `gorm:"index" json:"frozen_at,omitempty"` // set while paused, IsActive is false
+	Remaining int64      `json:"remaining,omitempty"`              // seconds left when frozen
+	PricePaid int64      `json:"price_paid"`                       // stars paid for the current period, caps the plan change credit
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 
@@ -62,20 +68,57 @@ type Subscription struct {
 	Plan Plan `gorm:"foreignKey:PlanID" json:"plan,omitempty"`
 }
 
+// FamilyMember is a seat on the owner's family plan. Invites start as pending and
+// become active when the invited user joins with the invite code. Members use the
+// owner's subscription for their own connections.
+type FamilyMember struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OwnerID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"owner_id"`
+	UserID     *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"` // set when the invite is accepted
+	Username   string     `json:"username,omitempty"`                       // Telegram username the invite is restricted to
+	InviteCode string     `gorm:"uniqueIndex;not null" json:"invite_code"`
+	Status     string     `gorm:"default:'pending';index" json:"status"` // pending, active, removed
+	JoinedAt   *time.Time `json:"joined_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+
+	// Relations
+	Owner User  `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
+	User  *User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// SubscriptionFreeze is a pause of a subscription, used to cap freezes per period
+type SubscriptionFreeze struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	SubscriptionID uuid.UUID  `gorm:"type:uuid;not null;index" json:"subscription_id"`
+	UserID         uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	Remaining      int64      `gorm:"not null" json:"remaining"` // seconds
+	FrozenAt       time.Time  `gorm:"not null;index" json:"frozen_at"`
+	UnfrozenAt     *time.Time `json:"unfrozen_at,omitempty"`
+}
+
 // Server represents a VPN server location
 type Server struct {
 	ID             uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
 	Name           string         `gorm:"uniqueIndex;not null" json:"name"`
 	Country        string         `gorm:"not null" json:"country"`
 	Flag           string         `gorm:"not null" json:"flag"`
+	Group          string         `gorm:"index" json:"group,omitempty"`             // failover group, the country is used when empty
 	Host           string         `gorm:"not null" json:"host"`                     // Server hostname or IP
+	Port           int            `gorm:"default:443" json:"port"`                  // Inbound port probed by health checks
 	Protocol       string         `gorm:"not null" json:"protocol"`                 // vless, vmess, trojan
-	Status         string         `gorm:"default:'online'" json:"status"`           // online, maintenance, crowded
+	Transport      string         `json:"transport,omitempty"`                      // tcp, ws, grpc... from the inbound stream settings
+	Status         string         `gorm:"default:'online'" json:"status"`           // online, degraded, offline, maintenance, crowded
 	AdminMessage   *string        `gorm:"type:text" json:"admin_message,omitempty"` // Admin message for users
 	XrayPanelID    uuid.UUID      `gorm:"type:uuid;index" json:"xray_panel_id"`     // Reference to XrayPanel
 	InboundID      int            `json:"inbound_id"`
+	InboundMissing bool           `gorm:"default:false" json:"inbound_missing"` // inbound not found on the panel at the last sync
 	MaxConnections int            `gorm:"default:1000" json:"max_connections"`
-	CurrentLoad    int            `gorm:"default:0" json:"current_load"`
+	CurrentLoad    int            `gorm:"default:0" json:"current_load"`  // active connections
+	OnlineUsers    int            `gorm:"default:0" json:"online_users"`  // clients online in the panel at the last refresh
+	LatencyMs      int            `gorm:"default:0" json:"latency_ms"`    // TCP connect time at the last health check, 0 = unknown
+	FailedChecks   int            `gorm:"default:0" json:"failed_checks"` // consecutive unreachable health checks
+	LastCheckedAt  *time.Time     `json:"last_checked_at,omitempty"`
 	IsUserSpecific bool           `gorm:"default:false" json:"is_user_specific"` // Whether this server is for specific users only
 	IsActive       bool           `gorm:"default:true" json:"is_active"`
 	CreatedAt      time.Time      `json:"created_at"`
@@ -88,15 +131,33 @@ type Server struct {
 	Users       []User       `gorm:"many2many:server_users;" json:"users,omitempty"` // Users who can access this server
 }
 
+// ServerHealthCheck is one health probe result, the history is used for uptime
+type ServerHealthCheck struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ServerID  uuid.UUID `gorm:"type:uuid;not null;index:idx_health_server_created" json:"server_id"`
+	Reachable bool      `json:"reachable"`  // TCP (and TLS) handshake succeeded
+	PanelOK   bool      `json:"panel_ok"`   // panel login succeeded
+	LatencyMs int       `json:"latency_ms"` // TCP connect time
+	Status    string    `json:"status"`     // status assigned after the check
+	Error     string    `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt time.Time `gorm:"index:idx_health_server_created" json:"created_at"`
+}
+
 // XrayPanel represents an Xray control panel (3x-ui, v2board, etc.)
 type XrayPanel struct {
-	ID        uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	Name      string         `gorm:"not null" json:"name"`
-	Type      string         `gorm:"not null" json:"type"` // 3x-ui, v2board
-	URL       string         `gorm:"not null" json:"url"`
-	Username  string         `gorm:"not null" json:"username"`
-	Password  string         `gorm:"not null" json:"password"`
-	InboundID int            `json:"inbound_id"`
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name      string    `gorm:"not null" json:"name"`
+	Type      string    `gorm:"not null" json:"type"` // 3x-ui, v2board
+	URL       string    `gorm:"not null" json:"url"`
+	Username  string    `gorm:"not null" json:"username"`
+	Password  string    `gorm:"not null" json:"-"` // plaintext, only set in memory and for panels saved before encryption
+	InboundID int       `json:"inbound_id"`
+
+	// Password encrypted with a data key, the data key is encrypted with the master key PasswordKeyID
+	PasswordCiphertext string `gorm:"type:text" json:"-"`
+	PasswordDataKey    string `gorm:"type:text" json:"-"`
+	PasswordKeyID      string `gorm:"index" json:"-"`
+
 	IsActive  bool           `gorm:"default:true" json:"is_active"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
@@ -113,11 +174,19 @@ type Connection struct {
 	ServerID         uuid.UUID      `gorm:"type:uuid;not null;index" json:"server_id"`
 	XrayInboundID    int            `json:"xray_inbound_id"`                      // ID in Xray panel
 	XrayClientID     int            `json:"xray_client_id"`                       // Client ID in Xray panel
+	XrayClientUUID   string         `json:"-"`                                    // UUID of the panel client, set once provisioned
 	ConnectionKey    string         `gorm:"not null;index" json:"connection_key"` // vless://... or vmess://...
 	SubscriptionLink string         `json:"subscription_link,omitempty"`
 	IsActive         bool           `gorm:"default:true;index" json:"is_active"`
-	TrafficUsed      int64          `gorm:"default:0" json:"traffic_used"` // bytes
-	TrafficLimit     int64          `json:"traffic_limit"`                 // bytes, 0 = unlimited
+	Status           string         `gorm:"default:pending;index" json:"status"` // pending, provisioning, ready, failed, deprovisioning
+	LastError        string         `gorm:"type:text" json:"-"`                  // why provisioning failed, kept out of API responses
+	TrafficUsed      int64          `gorm:"default:0" json:"traffic_used"`       // bytes
+	TrafficLimit     int64          `json:"traffic_limit"`                       // bytes, 0 = unlimited
+	DeviceLimit      int            `json:"device_limit"`                        // limitIp in Xray, 0 = unlimited
+	DeviceViolations int            `gorm:"default:0" json:"device_violations"`  // consecutive checks over the device limit
+	LimitExceededAt  *time.Time     `json:"limit_exceeded_at,omitempty"`
+	SuspendedUntil   *time.Time     `gorm:"index" json:"suspended_until,omitempty"`      // disabled in Xray for sharing the key
+	MigratedFromID   *uuid.UUID     `gorm:"type:uuid" json:"migrated_from_id,omitempty"` // connection replaced by failover
 	ExpiresAt        *time.Time     `gorm:"index" json:"expires_at,omitempty"`
 	CreatedAt        time.Time      `json:"created_at"`
 	UpdatedAt        time.Time      `json:"updated_at"`
@@ -197,17 +266,48 @@ type ServerUser struct {
 
 // ReferralStats tracks referral statistics
 type ReferralStats struct {
-	ID              uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	UserID          uuid.UUID `gorm:"type:uuid;uniqueIndex;not null" json:"user_id"`
-	TotalReferrals  int       `gorm:"default:0" json:"total_referrals"`
-	ActiveReferrals int       `gorm:"default:0" json:"active_referrals"`
-	RewardEarned    int64     `gorm:"default:0" json:"reward_earned"` // stars
-	LastUpdated     time.Time `json:"last_updated"`
+	ID               uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID           uuid.UUID `gorm:"type:uuid;uniqueIndex;not null" json:"user_id"`
+	TotalReferrals   int       `gorm:"default:0" json:"total_referrals"`
+	ActiveReferrals  int       `gorm:"default:0" json:"active_referrals"`
+	RewardEarned     int64     `gorm:"default:0" json:"reward_earned"`      // stars, sum of ReferralReward.Stars
+	RewardDaysEarned int       `gorm:"default:0" json:"reward_days_earned"` // sum of ReferralReward.BonusDays
+	LastUpdated      time.Time `json:"last_updated"`
 
 	// Relations
 	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
 }
 
+// ReferralReward is a ledger entry for a reward credited to a referrer.
+// A referred user can generate only one reward, on their first completed payment.
+type ReferralReward struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ReferrerID uuid.UUID `gorm:"type:uuid;not null;index" json:"referrer_id"`
+	ReferredID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"referred_id"`
+	PaymentID  uuid.UUID `gorm:"type:uuid;not null" json:"payment_id"`
+	RewardType string    `gorm:"not null" json:"reward_type"` // percent, days
+	Stars      int64     `gorm:"default:0" json:"stars"`
+	BonusDays  int       `gorm:"default:0" json:"bonus_days"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// Relations
+	Referred User `gorm:"foreignKey:ReferredID" json:"referred,omitempty"`
+}
+
+// PlanChange records an upgrade or downgrade of an active subscription.
+// Credit is the prorated value of the unused time on the previous plan,
+// Charged is what the user paid on top of it (negative when refunded to balance).
+type PlanChange struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	SubscriptionID uuid.UUID `gorm:"type:uuid;not null;index" json:"subscription_id"`
+	FromPlanID     uuid.UUID `gorm:"type:uuid;not null" json:"from_plan_id"`
+	ToPlanID       uuid.UUID `gorm:"type:uuid;not null" json:"to_plan_id"`
+	Credit         int64     `gorm:"not null" json:"credit"`
+	Charged        int64     `gorm:"not null" json:"charged"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
 // QueueTask represents a task in the queue
 type QueueTask struct {
 	Type         string                 `json:"type"` // create_connection, delete_connection, update_traffic
@@ -219,16 +319,77 @@ type QueueTask struct {
 
 // Payment represents a payment transaction
 type Payment struct {
-	ID          uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	UserID      uuid.UUID      `gorm:"type:uuid;not null;index" json:"user_id"`
-	TelegramID  int64          `gorm:"not null;index" json:"telegram_id"`
-	Amount      int64          `gorm:"not null" json:"amount"`
-	Status      string         `gorm:"default:'pending'" json:"status"` // pending, completed, failed, refunded
-	Payload     string         `gorm:"not null" json:"payload"`
-	InvoiceLink string         `gorm:"type:text" json:"invoice_link,omitempty"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID        uuid.UUID      `gorm:"type:uuid;not null;index" json:"user_id"`
+	TelegramID    int64          `gorm:"not null;index" json:"telegram_id"`
+	Amount        int64          `gorm:"not null" json:"amount"`                         // Amount in stars credited to the balance
+	Provider      string         `gorm:"default:'telegram_stars';index" json:"provider"` // telegram_stars, cryptopay, mock
+	Currency      string         `gorm:"default:'XTR'" json:"currency"`                  // Currency or asset the invoice was issued in
+	InvoiceAmount string         `json:"invoice_amount,omitempty"`                       // Amount in Currency the invoice was issued for, refunded as is
+	Status        string         `gorm:"default:'pending'" json:"status"`                // pending, completed, failed, refunding, refunded
+	Payload       string         `gorm:"not null" json:"payload"`
+	ExternalID    string         `gorm:"index" json:"external_id,omitempty"` // Invoice or charge ID on the provider side
+	InvoiceLink   string         `gorm:"type:text" json:"invoice_link,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// PromoCode represents a discount coupon applied when purchasing a plan
+type PromoCode struct {
+	ID              uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Code            string         `gorm:"uniqueIndex;not null" json:"code"`
+	Description     *string        `gorm:"type:text" json:"description,omitempty"` // e.g. partner channel name
+	DiscountType    string         `gorm:"default:'percent'" json:"discount_type"` // percent, fixed
+	DiscountValue   int64          `gorm:"default:0" json:"discount_value"`        // percent (1-100) or stars
+	BonusDays       int            `gorm:"default:0" json:"bonus_days"`            // extra days added to the subscription
+	MaxRedemptions  int            `gorm:"default:0" json:"max_redemptions"`       // 0 = unlimited
+	PerUserLimit    int            `json:"per_user_limit"`                         // 0 = unlimited
+	RedemptionCount int            `gorm:"default:0" json:"redemption_count"`
+	ValidFrom       *time.Time     `json:"valid_from,omitempty"`
+	ValidUntil      *time.Time     `json:"valid_until,omitempty"`
+	IsActive        bool           `gorm:"default:true" json:"is_active"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+
+	// Relations
+	Plans []Plan `gorm:"many2many:promo_code_plans;" json:"plans,omitempty"` // Allowed plans, empty = all plans
+}
+
+// PromoRedemption records a single use of a promo code
+type PromoRedemption struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	PromoCodeID    uuid.UUID `gorm:"type:uuid;not null;index" json:"promo_code_id"`
+	UserID         uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	PlanID         uuid.UUID `gorm:"type:uuid;not null;index" json:"plan_id"`
+	SubscriptionID uuid.UUID `gorm:"type:uuid;index" json:"subscription_id"`
+	DiscountStars  int64     `gorm:"default:0" json:"discount_stars"`
+	BonusDays      int       `gorm:"default:0" json:"bonus_days"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	// Relations
+	PromoCode PromoCode `gorm:"foreignKey:PromoCodeID" json:"-"`
+	User      User      `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Plan      Plan      `gorm:"foreignKey:PlanID" json:"plan,omitempty"`
+}
+
+// GiftCode represents a prepaid plan bought for another user
+type GiftCode struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Code           string     `gorm:"uniqueIndex;not null" json:"code"`
+	PlanID         uuid.UUID  `gorm:"type:uuid;not null;index" json:"plan_id"`
+	PurchasedBy    uuid.UUID  `gorm:"type:uuid;not null;index" json:"purchased_by"`
+	PricePaid      int64      `gorm:"not null" json:"price_paid"` // stars
+	RedeemedBy     *uuid.UUID `gorm:"type:uuid;index" json:"redeemed_by,omitempty"`
+	RedeemedAt     *time.Time `json:"redeemed_at,omitempty"`
+	SubscriptionID *uuid.UUID `gorm:"type:uuid" json:"subscription_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relations
+	Plan  Plan `gorm:"foreignKey:PlanID" json:"plan,omitempty"`
+	Buyer User `gorm:"foreignKey:PurchasedBy" json:"-"`
 }
 
 // AuthSession represents a browser authentication session
@@ -251,6 +412,32 @@ type BrowserSession struct {
 	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
 }
 
+// ProcessedTask records a queue task that was handled successfully, so a redelivered
+// copy is skipped
+type ProcessedTask struct {
+	TaskID      uuid.UUID `gorm:"type:uuid;primary_key" json:"task_id"`
+	Type        string    `gorm:"not null" json:"type"`
+	Attempt     int       `json:"attempt"` // attempt that succeeded
+	ProcessedAt time.Time `gorm:"index" json:"processed_at"`
+}
+
+// OutboxMessage is a queue task saved in the same transaction as the change that
+// caused it. The worker relay publishes it to RabbitMQ and sets SentAt.
+type OutboxMessage struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"` // also the AMQP message ID
+	TaskType  string     `gorm:"not null" json:"task_type"`
+	Payload   string     `gorm:"type:jsonb;not null" json:"payload"` // serialized queue.Task
+	Attempts  int        `gorm:"default:0" json:"attempts"`          // failed publish attempts
+	LastError string     `gorm:"type:text" json:"last_error,omitempty"`
+	SentAt    *time.Time `gorm:"index" json:"sent_at,omitempty"`
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+}
+
+// TableName keeps the conventional outbox table name
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
 // BeforeCreate hook for User
 func (u *User) BeforeCreate(tx *gorm.DB) error {
 	if u.ID == uuid.Nil {
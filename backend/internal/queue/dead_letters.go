@@ -0,0 +1,197 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+// DeadLetter is a task that ran out of attempts
+type DeadLetter struct {
+	MessageID      string `json:"message_id"`
+	Task           *Task  `json:"task,omitempty"` // nil when the body is not a valid task
+	Body           string `json:"body,omitempty"` // raw body of an invalid task
+	Attempts       int    `json:"attempts"`
+	LastError      string `json:"last_error"`
+	DeadLetteredAt string `json:"dead_lettered_at"`
+}
+
+// DeadLetterStats is the size of a dead letter queue
+type DeadLetterStats struct {
+	Queue    string `json:"queue"`
+	Messages int    `json:"messages"`
+}
+
+// DeadLetters returns up to limit dead lettered tasks of a work queue without removing them
+func (q *Queue) DeadLetters(queueName string, limit int) ([]DeadLetter, int, error) {
+	if !isWorkQueue(queueName) {
+		return nil, 0, fmt.Errorf("unknown queue %s", queueName)
+	}
+
+	// A separate channel so the messages held here are returned to the queue on close
+	channel, err := q.openChannel()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer channel.Close()
+
+	dlq := DeadLetterQueue(queueName)
+	info, err := channel.QueueInspect(dlq)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to inspect %s: %w", dlq, err)
+	}
+	if limit <= 0 || limit > info.Messages {
+		limit = info.Messages
+	}
+
+	letters := make([]DeadLetter, 0, limit)
+	for len(letters) < limit {
+		msg, ok, err := channel.Get(dlq, false)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read %s: %w", dlq, err)
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, newDeadLetter(msg))
+	}
+
+	return letters, info.Messages, nil
+}
+
+// ReplayDeadLetters publishes dead lettered tasks back to their work queue with a
+// fresh retry budget. Empty messageIDs replays the whole dead letter queue.
+func (q *Queue) ReplayDeadLetters(queueName string, messageIDs []string) (int, error) {
+	if !isWorkQueue(queueName) {
+		return 0, fmt.Errorf("unknown queue %s", queueName)
+	}
+
+	channel, err := q.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	dlq := DeadLetterQueue(queueName)
+	info, err := channel.QueueInspect(dlq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect %s: %w", dlq, err)
+	}
+
+	// The dead letter is acked only after the broker confirmed the replayed copy
+	if err := channel.Confirm(false); err != nil {
+		return 0, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	wanted := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+
+	// Messages that are not replayed stay unacked and return to the queue on close
+	replayed := 0
+	for i := 0; i < info.Messages; i++ {
+		msg, ok, err := channel.Get(dlq, false)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read %s: %w", dlq, err)
+		}
+		if !ok {
+			break
+		}
+		if len(wanted) > 0 && !wanted[msg.MessageId] {
+			continue
+		}
+
+		confirmation, err := channel.PublishWithDeferredConfirm(q.exchange, queueName, false, false, amqp.Publishing{
+			ContentType:  msg.ContentType,
+			Body:         msg.Body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    msg.MessageId,
+		})
+		if err != nil {
+			return replayed, fmt.Errorf("failed to replay message %s: %w", msg.MessageId, err)
+		}
+		if !confirmation.Wait() {
+			return replayed, fmt.Errorf("replay of message %s rejected by broker", msg.MessageId)
+		}
+		if err := msg.Ack(false); err != nil {
+			return replayed, fmt.Errorf("failed to ack message %s: %w", msg.MessageId, err)
+		}
+		replayed++
+	}
+
+	log.Info().Str("queue", queueName).Int("replayed", replayed).Msg("Dead lettered tasks replayed")
+	return replayed, nil
+}
+
+// PurgeDeadLetters drops all dead lettered tasks of a work queue
+func (q *Queue) PurgeDeadLetters(queueName string) (int, error) {
+	if !isWorkQueue(queueName) {
+		return 0, fmt.Errorf("unknown queue %s", queueName)
+	}
+
+	channel, err := q.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	purged, err := channel.QueuePurge(DeadLetterQueue(queueName), false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead letter queue: %w", err)
+	}
+
+	log.Warn().Str("queue", queueName).Int("purged", purged).Msg("Dead letter queue purged")
+	return purged, nil
+}
+
+// DeadLetterStats returns the number of dead lettered tasks per work queue
+func (q *Queue) DeadLetterStats() ([]DeadLetterStats, error) {
+	channel, err := q.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	stats := make([]DeadLetterStats, 0, len(Queues))
+	for _, queueName := range Queues {
+		info, err := channel.QueueInspect(DeadLetterQueue(queueName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect dead letter queue for %s: %w", queueName, err)
+		}
+		stats = append(stats, DeadLetterStats{Queue: queueName, Messages: info.Messages})
+	}
+	return stats, nil
+}
+
+func newDeadLetter(msg amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		MessageID: msg.MessageId,
+		Attempts:  retryCount(msg.Headers),
+	}
+	if v, ok := msg.Headers[HeaderLastError].(string); ok {
+		letter.LastError = v
+	}
+	if v, ok := msg.Headers[HeaderDeadLetteredAt].(string); ok {
+		letter.DeadLetteredAt = v
+	}
+
+	var task Task
+	if err := json.Unmarshal(msg.Body, &task); err != nil {
+		letter.Body = string(msg.Body)
+	} else {
+		letter.Task = &task
+	}
+	return letter
+}
+
+func isWorkQueue(queueName string) bool {
+	for _, name := range Queues {
+		if name == queueName {
+			return true
+		}
+	}
+	return false
+}
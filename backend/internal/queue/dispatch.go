@@ -0,0 +1,90 @@
+package queue
+
+import "sync"
+
+// dispatcher hands received tasks to a fixed pool of workers. Every worker has its
+// own pending list, so a worker stuck on a slow task only holds back the tasks of
+// its own keys and the receiving goroutine never blocks.
+type dispatcher[T any] struct {
+	mu      sync.Mutex
+	pending [][]T
+	wake    []chan struct{}
+	stopped bool
+}
+
+// newDispatcher starts workers goroutines calling handle, wg tracks them
+func newDispatcher[T any](workers int, wg *sync.WaitGroup, handle func(T)) *dispatcher[T] {
+	d := &dispatcher[T]{
+		pending: make([][]T, workers),
+		wake:    make([]chan struct{}, workers),
+	}
+	for i := range d.wake {
+		d.wake[i] = make(chan struct{}, 1)
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for {
+				item, ok := d.next(worker)
+				if !ok {
+					return
+				}
+				handle(item)
+			}
+		}(i)
+	}
+	return d
+}
+
+// push queues an item for a worker without waiting for it
+func (d *dispatcher[T]) push(worker int, item T) {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.pending[worker] = append(d.pending[worker], item)
+	d.mu.Unlock()
+
+	select {
+	case d.wake[worker] <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the next item of a worker, false once the dispatcher is stopped
+func (d *dispatcher[T]) next(worker int) (T, bool) {
+	for {
+		d.mu.Lock()
+		if d.stopped {
+			d.mu.Unlock()
+			var zero T
+			return zero, false
+		}
+		if len(d.pending[worker]) > 0 {
+			item := d.pending[worker][0]
+			d.pending[worker] = d.pending[worker][1:]
+			d.mu.Unlock()
+			return item, true
+		}
+		d.mu.Unlock()
+		<-d.wake[worker]
+	}
+}
+
+// stop ends the workers after their current item. Items not started are dropped,
+// the broker redelivers unacked AMQP messages.
+func (d *dispatcher[T]) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	for i := range d.pending {
+		d.pending[i] = nil
+	}
+	d.mu.Unlock()
+
+	for _, wake := range d.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
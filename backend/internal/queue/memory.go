@@ -0,0 +1,451 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// memoryQueueSize is the number of tasks a memory queue holds before publishes fail
+const memoryQueueSize = 1024
+
+// ErrQueueClosed is returned by publishes after the memory queue was shut down
+var ErrQueueClosed = errors.New("queue is closed")
+
+// MemoryQueue passes tasks over channels inside one process. Retries, backoff and
+// dead letters behave like the AMQP queue, but queued tasks are lost on exit.
+type MemoryQueue struct {
+	retry RetryPolicy
+
+	mu          sync.Mutex
+	queues      map[string]chan memoryMessage
+	deadLetters map[string][]memoryMessage
+	closed      bool
+
+	subscriptions map[*memorySubscription]bool
+
+	stop     chan struct{}
+	handlers sync.WaitGroup
+}
+
+// memoryMessage is a task with its delivery state
+type memoryMessage struct {
+	task           Task
+	attempts       int // failed attempts so far
+	lastError      string
+	deadLetteredAt time.Time
+}
+
+func NewMemory(retry RetryPolicy) *MemoryQueue {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+
+	q := &MemoryQueue{
+		retry:         retry,
+		queues:        make(map[string]chan memoryMessage),
+		deadLetters:   make(map[string][]memoryMessage),
+		subscriptions: make(map[*memorySubscription]bool),
+		stop:          make(chan struct{}),
+	}
+	for _, queueName := range Queues {
+		q.queues[queueName] = make(chan memoryMessage, memoryQueueSize)
+	}
+
+	log.Info().Msg("Using in-memory task queue")
+	return q
+}
+
+// PublishTask queues a task, it fails when the queue is full instead of blocking the caller
+func (q *MemoryQueue) PublishTask(task Task) error {
+	if task.ID == uuid.Nil {
+		task.ID = uuid.New()
+	}
+	task.Attempt = 0
+
+	if task.Type == TaskWebSocketNotification {
+		return q.fanOut(task)
+	}
+
+	if err := q.enqueue(routingKey(task), memoryMessage{task: task}); err != nil {
+		return fmt.Errorf("failed to publish task: %w", err)
+	}
+
+	log.Debug().
+		Str("type", task.Type).
+		Str("user_id", task.UserID.String()).
+		Msg("Task published")
+	return nil
+}
+
+// PublishWebSocketNotification publishes a WebSocket event for one user
+func (q *MemoryQueue) PublishWebSocketNotification(userID uuid.UUID, event string, data map[string]interface{}) error {
+	return q.PublishTask(WebSocketEvent(userID, event, data))
+}
+
+// PublishWebSocketBroadcast publishes a WebSocket event for every connected user
+func (q *MemoryQueue) PublishWebSocketBroadcast(event string, data map[string]interface{}) error {
+	return q.PublishTask(WebSocketBroadcast(event, data))
+}
+
+func (q *MemoryQueue) enqueue(queueName string, msg memoryMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	ch, ok := q.queues[queueName]
+	if !ok {
+		return fmt.Errorf("unknown queue %s", queueName)
+	}
+
+	select {
+	case ch <- msg:
+		return nil
+	default:
+		return fmt.Errorf("queue %s is full", queueName)
+	}
+}
+
+// ConsumeTasks starts handling the tasks of a queue one at a time
+func (q *MemoryQueue) ConsumeTasks(queueName string, handler func(Task) error) error {
+	return q.ConsumeTasksWith(queueName, ConsumerOptions{Workers: 1}, handler)
+}
+
+// ConsumeTasksWith starts handling the tasks of a queue with a pool of workers.
+// Prefetch has no meaning in memory and is ignored.
+func (q *MemoryQueue) ConsumeTasksWith(queueName string, options ConsumerOptions, handler func(Task) error) error {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+
+	q.mu.Lock()
+	ch, ok := q.queues[queueName]
+	closed := q.closed
+	q.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown queue %s", queueName)
+	}
+	if closed {
+		return ErrQueueClosed
+	}
+
+	// A task always goes to the worker of its key, a busy worker never holds
+	// back the tasks of the others
+	workers := newDispatcher(options.Workers, &q.handlers, func(msg memoryMessage) {
+		q.handle(queueName, handler, msg)
+	})
+
+	go func() {
+		defer workers.stop()
+
+		next := 0
+		for {
+			select {
+			case <-q.stop:
+				return
+			case msg := <-ch:
+				worker := next % options.Workers
+				next++
+				if options.Key != nil {
+					worker = shard(options.Key(msg.task), options.Workers)
+				}
+				workers.push(worker, msg)
+			}
+		}
+	}()
+
+	log.Info().Str("queue", queueName).Int("workers", options.Workers).Msg("Started consuming tasks")
+	return nil
+}
+
+func (q *MemoryQueue) handle(queueName string, handler func(Task) error, msg memoryMessage) {
+	task := msg.task
+	task.Attempt = msg.attempts + 1
+
+	err := handler(task)
+	if err == nil {
+		return
+	}
+
+	log.Error().
+		Err(err).
+		Str("type", task.Type).
+		Str("task_id", task.ID.String()).
+		Int("attempt", task.Attempt).
+		Msg("Task handler failed")
+
+	msg.attempts = task.Attempt
+	msg.lastError = err.Error()
+	if msg.attempts >= q.retry.MaxAttempts {
+		q.deadLetter(queueName, msg)
+		return
+	}
+
+	time.AfterFunc(q.retry.delay(msg.attempts), func() {
+		if err := q.enqueue(queueName, msg); err != nil && !errors.Is(err, ErrQueueClosed) {
+			log.Error().Err(err).Str("queue", queueName).Msg("Failed to schedule task retry")
+			q.deadLetter(queueName, msg)
+		}
+	})
+}
+
+func (q *MemoryQueue) deadLetter(queueName string, msg memoryMessage) {
+	msg.deadLetteredAt = time.Now().UTC()
+
+	q.mu.Lock()
+	q.deadLetters[queueName] = append(q.deadLetters[queueName], msg)
+	q.mu.Unlock()
+
+	log.Warn().
+		Str("queue", queueName).
+		Str("message_id", msg.task.ID.String()).
+		Str("error", msg.lastError).
+		Msg("Task moved to dead letter queue")
+}
+
+// DeadLetters returns up to limit dead lettered tasks of a work queue without removing them
+func (q *MemoryQueue) DeadLetters(queueName string, limit int) ([]DeadLetter, int, error) {
+	if !isWorkQueue(queueName) {
+		return nil, 0, fmt.Errorf("unknown queue %s", queueName)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := q.deadLetters[queueName]
+	if limit <= 0 || limit > len(messages) {
+		limit = len(messages)
+	}
+
+	letters := make([]DeadLetter, 0, limit)
+	for _, msg := range messages[:limit] {
+		task := msg.task
+		letters = append(letters, DeadLetter{
+			MessageID:      task.ID.String(),
+			Task:           &task,
+			Attempts:       msg.attempts,
+			LastError:      msg.lastError,
+			DeadLetteredAt: msg.deadLetteredAt.Format(time.RFC3339),
+		})
+	}
+	return letters, len(messages), nil
+}
+
+// ReplayDeadLetters queues dead lettered tasks again with a fresh retry budget.
+// Empty messageIDs replays the whole dead letter queue.
+func (q *MemoryQueue) ReplayDeadLetters(queueName string, messageIDs []string) (int, error) {
+	if !isWorkQueue(queueName) {
+		return 0, fmt.Errorf("unknown queue %s", queueName)
+	}
+
+	wanted := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+
+	q.mu.Lock()
+	var replay, keep []memoryMessage
+	for _, msg := range q.deadLetters[queueName] {
+		if len(wanted) > 0 && !wanted[msg.task.ID.String()] {
+			keep = append(keep, msg)
+			continue
+		}
+		replay = append(replay, msg)
+	}
+	q.deadLetters[queueName] = keep
+	q.mu.Unlock()
+
+	for i, msg := range replay {
+		if err := q.enqueue(queueName, memoryMessage{task: msg.task}); err != nil {
+			// Put back what could not be replayed
+			q.mu.Lock()
+			q.deadLetters[queueName] = append(q.deadLetters[queueName], replay[i:]...)
+			q.mu.Unlock()
+			return i, fmt.Errorf("failed to replay message %s: %w", msg.task.ID, err)
+		}
+	}
+
+	log.Info().Str("queue", queueName).Int("replayed", len(replay)).Msg("Dead lettered tasks replayed")
+	return len(replay), nil
+}
+
+// PurgeDeadLetters drops all dead lettered tasks of a work queue
+func (q *MemoryQueue) PurgeDeadLetters(queueName string) (int, error) {
+	if !isWorkQueue(queueName) {
+		return 0, fmt.Errorf("unknown queue %s", queueName)
+	}
+
+	q.mu.Lock()
+	purged := len(q.deadLetters[queueName])
+	delete(q.deadLetters, queueName)
+	q.mu.Unlock()
+
+	log.Warn().Str("queue", queueName).Int("purged", purged).Msg("Dead letter queue purged")
+	return purged, nil
+}
+
+// DeadLetterStats returns the number of dead lettered tasks per work queue
+func (q *MemoryQueue) DeadLetterStats() ([]DeadLetterStats, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := make([]DeadLetterStats, 0, len(Queues))
+	for _, queueName := range Queues {
+		stats = append(stats, DeadLetterStats{Queue: queueName, Messages: len(q.deadLetters[queueName])})
+	}
+	return stats, nil
+}
+
+// Connected is true until the queue is shut down
+func (q *MemoryQueue) Connected() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return !q.closed
+}
+
+// Shutdown stops the consumers and waits until the tasks being handled are finished.
+// Tasks still queued are dropped.
+func (q *MemoryQueue) Shutdown(ctx context.Context) error {
+	if !q.markClosed() {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info().Msg("All in-flight tasks finished")
+	case <-ctx.Done():
+		log.Warn().Msg("Shutdown timeout, unfinished tasks are lost")
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Close() error {
+	q.markClosed()
+	return nil
+}
+
+// markClosed closes the queue once and reports whether this call closed it
+func (q *MemoryQueue) markClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.closed = true
+	close(q.stop)
+	return true
+}
+
+// memorySubscription receives the notifications of its bound users on its own goroutine
+type memorySubscription struct {
+	queue   *MemoryQueue
+	handler func(Task)
+	inbox   chan Task
+	done    chan struct{}
+
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// SubscribeNotifications creates a notification feed, it only receives broadcasts until users are bound
+func (q *MemoryQueue) SubscribeNotifications(handler func(Task)) (Subscription, error) {
+	s := &memorySubscription{
+		queue:   q,
+		handler: handler,
+		inbox:   make(chan Task, memoryQueueSize),
+		done:    make(chan struct{}),
+		keys:    map[string]bool{BroadcastKey: true},
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, ErrQueueClosed
+	}
+	q.subscriptions[s] = true
+	q.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case task := <-s.inbox:
+				s.handler(task)
+			case <-s.done:
+				return
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// fanOut hands a notification to every subscription bound to its key. A full
+// subscription misses the notification instead of blocking the publisher.
+func (q *MemoryQueue) fanOut(task Task) error {
+	key := notificationKey(task)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return fmt.Errorf("failed to publish task: %w", ErrQueueClosed)
+	}
+	for s := range q.subscriptions {
+		if !s.bound(key) {
+			continue
+		}
+		select {
+		case s.inbox <- task:
+		default:
+			log.Warn().Str("key", key).Msg("Notification subscription is full, dropping notification")
+		}
+	}
+	return nil
+}
+
+func (s *memorySubscription) bound(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[key]
+}
+
+func (s *memorySubscription) Bind(userID uuid.UUID) error {
+	s.mu.Lock()
+	s.keys[UserKey(userID)] = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySubscription) Unbind(userID uuid.UUID) error {
+	s.mu.Lock()
+	delete(s.keys, UserKey(userID))
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySubscription) Close() error {
+	q := s.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.subscriptions[s] {
+		delete(q.subscriptions, s)
+		close(s.done)
+	}
+	return nil
+}
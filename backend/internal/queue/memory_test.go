@@ -0,0 +1,277 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTestQueue returns a memory queue that is shut down with the test
+func newTestQueue(t *testing.T, retry RetryPolicy) *MemoryQueue {
+	t.Helper()
+
+	q := NewMemory(retry)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		q.Shutdown(ctx)
+	})
+	return q
+}
+
+// keysOnDifferentWorkers returns two keys that shard to different workers
+func keysOnDifferentWorkers(t *testing.T, workers int) (string, string) {
+	t.Helper()
+
+	first := "key-0"
+	for i := 1; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if shard(key, workers) != shard(first, workers) {
+			return first, key
+		}
+	}
+	t.Fatal("no keys on different workers")
+	return "", ""
+}
+
+// taskWithKey is a task whose data carries the sharding key
+func taskWithKey(key string) Task {
+	return Task{Type: TaskUpdateConnection, UserID: uuid.New(), Data: map[string]interface{}{"key": key}}
+}
+
+func keyOf(task Task) string {
+	key, _ := task.Data["key"].(string)
+	return key
+}
+
+func TestMemoryQueueSlowKeyDoesNotBlockOthers(t *testing.T) {
+	q := newTestQueue(t, RetryPolicy{MaxAttempts: 1})
+	slow, fast := keysOnDifferentWorkers(t, 2)
+
+	release := make(chan struct{})
+	defer close(release)
+	done := make(chan string, 10)
+
+	if err := q.ConsumeTasksWith("tasks", ConsumerOptions{Workers: 2, Key: keyOf}, func(task Task) error {
+		if keyOf(task) == slow {
+			<-release
+		}
+		done <- keyOf(task)
+		return nil
+	}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	// The slow worker is busy with one task and has more waiting
+	for i := 0; i < 3; i++ {
+		if err := q.PublishTask(taskWithKey(slow)); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	if err := q.PublishTask(taskWithKey(fast)); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	select {
+	case key := <-done:
+		if key != fast {
+			t.Fatalf("expected the %s task to finish, got %s", fast, key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("task on another key was blocked by the slow handler")
+	}
+}
+
+// waitFor polls until done reports true or fails the test after a few seconds
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMemoryQueueRetriesFailedTask(t *testing.T) {
+	q := newTestQueue(t, RetryPolicy{MaxAttempts: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 10 * time.Millisecond})
+
+	var mu sync.Mutex
+	var attempts []int
+	if err := q.ConsumeTasks("tasks", func(task Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, task.Attempt)
+		if task.Attempt < 3 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	if err := q.PublishTask(taskWithKey("retry")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "the third attempt", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(attempts) == 3
+	})
+
+	mu.Lock()
+	got := fmt.Sprint(attempts)
+	mu.Unlock()
+	if got != "[1 2 3]" {
+		t.Fatalf("expected attempts [1 2 3], got %s", got)
+	}
+
+	_, total, err := q.DeadLetters("tasks", 0)
+	if err != nil {
+		t.Fatalf("dead letters: %v", err)
+	}
+	if total != 0 {
+		t.Fatalf("a task that succeeded on retry was dead lettered, %d dead letters", total)
+	}
+}
+
+func TestMemoryQueueDeadLettersAndReplays(t *testing.T) {
+	q := newTestQueue(t, RetryPolicy{MaxAttempts: 2, RetryBaseDelay: time.Millisecond})
+
+	var mu sync.Mutex
+	failing := true
+	var replayedAttempt int
+	if err := q.ConsumeTasks("tasks", func(task Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return errors.New("panel unavailable")
+		}
+		replayedAttempt = task.Attempt
+		return nil
+	}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	task := taskWithKey("dead")
+	task.ID = uuid.New()
+	if err := q.PublishTask(task); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	var letters []DeadLetter
+	waitFor(t, "the task to be dead lettered", func() bool {
+		var err error
+		letters, _, err = q.DeadLetters("tasks", 10)
+		return err == nil && len(letters) == 1
+	})
+
+	letter := letters[0]
+	if letter.MessageID != task.ID.String() {
+		t.Fatalf("expected dead letter %s, got %s", task.ID, letter.MessageID)
+	}
+	if letter.Attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", letter.Attempts)
+	}
+	if letter.LastError != "panel unavailable" {
+		t.Fatalf("expected the handler error, got %q", letter.LastError)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	replayed, err := q.ReplayDeadLetters("tasks", []string{letter.MessageID})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if replayed != 1 {
+		t.Fatalf("expected 1 replayed task, got %d", replayed)
+	}
+
+	// A replayed task starts over with a fresh retry budget
+	waitFor(t, "the replayed task", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return replayedAttempt != 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if replayedAttempt != 1 {
+		t.Fatalf("expected the replay to be attempt 1, got %d", replayedAttempt)
+	}
+	if _, total, _ := q.DeadLetters("tasks", 0); total != 0 {
+		t.Fatalf("expected an empty dead letter queue after replay, got %d", total)
+	}
+}
+
+func TestMemoryQueueSerializesTasksPerKey(t *testing.T) {
+	q := newTestQueue(t, RetryPolicy{MaxAttempts: 1})
+	keys := []string{"panel-1/1", "panel-1/2", "panel-2/1"}
+	const perKey = 20
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	seen := make(map[string][]int)
+	overlapped := false
+	handled := 0
+
+	if err := q.ConsumeTasksWith("tasks", ConsumerOptions{Workers: 4, Key: keyOf}, func(task Task) error {
+		key := keyOf(task)
+
+		mu.Lock()
+		running[key]++
+		if running[key] > 1 {
+			overlapped = true
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running[key]--
+		seen[key] = append(seen[key], task.Data["seq"].(int))
+		handled++
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	for i := 0; i < perKey; i++ {
+		for _, key := range keys {
+			task := taskWithKey(key)
+			task.Data["seq"] = i
+			if err := q.PublishTask(task); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+		}
+	}
+
+	waitFor(t, "all tasks", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled == perKey*len(keys)
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if overlapped {
+		t.Fatal("two tasks of one key ran at the same time")
+	}
+	for _, key := range keys {
+		for i, seq := range seen[key] {
+			if seq != i {
+				t.Fatalf("tasks of %s handled out of order: %v", key, seen[key])
+			}
+		}
+	}
+}
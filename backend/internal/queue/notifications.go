@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+// notificationExchange is the topic exchange WebSocket notifications are published
+// to with user.<id> and broadcast routing keys
+func (q *Queue) notificationExchange() string {
+	return q.exchange + ".notifications"
+}
+
+// amqpSubscription is an exclusive, server named queue bound to the notification
+// exchange. The queue is deleted with its channel, after a reconnect a new one is
+// declared with the same bindings.
+type amqpSubscription struct {
+	queue   *Queue
+	handler func(Task)
+
+	mu        sync.Mutex
+	channel   *amqp.Channel
+	queueName string
+	keys      map[string]bool // bound routing keys
+	closed    bool
+}
+
+// SubscribeNotifications creates the notification queue of this instance. It only
+// receives broadcasts until users are bound.
+func (q *Queue) SubscribeNotifications(handler func(Task)) (Subscription, error) {
+	s := &amqpSubscription{
+		queue:   q,
+		handler: handler,
+		keys:    map[string]bool{BroadcastKey: true},
+	}
+
+	q.mu.Lock()
+	q.subscriptions = append(q.subscriptions, s)
+	conn := q.conn
+	q.mu.Unlock()
+
+	// While disconnected the queue is declared with the next connection
+	if conn == nil || conn.IsClosed() {
+		log.Warn().Msg("RabbitMQ is not connected, notification subscription starts after reconnect")
+		return s, nil
+	}
+	if err := s.open(conn); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// open declares the queue on a new channel, binds the keys and starts consuming.
+// Notifications are acked on receipt, they only matter to users online right now.
+func (s *amqpSubscription) open(conn *amqp.Connection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open notification channel: %w", err)
+	}
+
+	queue, err := channel.QueueDeclare(
+		"",    // server named
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		return fmt.Errorf("failed to declare notification queue: %w", err)
+	}
+
+	for key := range s.keys {
+		if err := channel.QueueBind(queue.Name, key, s.queue.notificationExchange(), false, nil); err != nil {
+			channel.Close()
+			return fmt.Errorf("failed to bind notification queue: %w", err)
+		}
+	}
+
+	msgs, err := channel.Consume(
+		queue.Name,
+		"",    // consumer
+		true,  // auto-ack
+		true,  // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		return fmt.Errorf("failed to consume notification queue: %w", err)
+	}
+
+	s.channel = channel
+	s.queueName = queue.Name
+
+	go func() {
+		for msg := range msgs {
+			var task Task
+			if err := json.Unmarshal(msg.Body, &task); err != nil {
+				log.Error().Err(err).Msg("Failed to unmarshal notification")
+				continue
+			}
+			s.handler(task)
+		}
+
+		// A channel exception leaves the connection open, close it so the
+		// reconnect declares the queue again
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if !closed && !conn.IsClosed() {
+			log.Error().Msg("Notification channel closed, reconnecting")
+			conn.Close()
+		}
+	}()
+
+	log.Info().Str("queue", queue.Name).Int("bindings", len(s.keys)).Msg("Subscribed to notifications")
+	return nil
+}
+
+// Bind routes the notifications of a user to this subscription
+func (s *amqpSubscription) Bind(userID uuid.UUID) error {
+	key := UserKey(userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key] = true
+	if s.channel == nil || s.channel.IsClosed() {
+		// Bound when the queue is declared after the reconnect
+		return nil
+	}
+	if err := s.channel.QueueBind(s.queueName, key, s.queue.notificationExchange(), false, nil); err != nil {
+		return fmt.Errorf("failed to bind %s: %w", key, err)
+	}
+	return nil
+}
+
+// Unbind stops routing the notifications of a user to this subscription
+func (s *amqpSubscription) Unbind(userID uuid.UUID) error {
+	key := UserKey(userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+	if s.channel == nil || s.channel.IsClosed() {
+		return nil
+	}
+	if err := s.channel.QueueUnbind(s.queueName, key, s.queue.notificationExchange(), nil); err != nil {
+		return fmt.Errorf("failed to unbind %s: %w", key, err)
+	}
+	return nil
+}
+
+// Close deletes the notification queue
+func (s *amqpSubscription) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	channel := s.channel
+	s.mu.Unlock()
+
+	q := s.queue
+	q.mu.Lock()
+	for i, subscription := range q.subscriptions {
+		if subscription == s {
+			q.subscriptions = append(q.subscriptions[:i], q.subscriptions[i+1:]...)
+			break
+		}
+	}
+	q.mu.Unlock()
+
+	if channel != nil && !channel.IsClosed() {
+		return channel.Close()
+	}
+	return nil
+}
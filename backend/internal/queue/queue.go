@@ -0,0 +1,174 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TaskQueue publishes and consumes tasks. Queue talks to RabbitMQ, MemoryQueue
+// passes tasks between goroutines of one process.
+type TaskQueue interface {
+	PublishTask(task Task) error
+	PublishWebSocketNotification(userID uuid.UUID, event string, data map[string]interface{}) error
+	PublishWebSocketBroadcast(event string, data map[string]interface{}) error
+	ConsumeTasks(queueName string, handler func(Task) error) error
+	ConsumeTasksWith(queueName string, options ConsumerOptions, handler func(Task) error) error
+
+	// SubscribeNotifications receives the WebSocket notifications of the users bound
+	// to the subscription, and all broadcasts
+	SubscribeNotifications(handler func(Task)) (Subscription, error)
+
+	DeadLetters(queueName string, limit int) ([]DeadLetter, int, error)
+	ReplayDeadLetters(queueName string, messageIDs []string) (int, error)
+	PurgeDeadLetters(queueName string) (int, error)
+	DeadLetterStats() ([]DeadLetterStats, error)
+
+	// Connected reports whether tasks can be published and received
+	Connected() bool
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+var (
+	_ TaskQueue = (*Queue)(nil)
+	_ TaskQueue = (*MemoryQueue)(nil)
+)
+
+// Queue drivers
+const (
+	DriverAMQP   = "amqp"
+	DriverMemory = "memory"
+)
+
+// Open creates the queue of the given driver. The memory driver ignores url and
+// exchange and only works when publishers and consumers share the process.
+func Open(driver, url, exchange string, retry RetryPolicy) (TaskQueue, error) {
+	switch driver {
+	case DriverAMQP, "":
+		return New(url, exchange, retry)
+	case DriverMemory:
+		return NewMemory(retry), nil
+	default:
+		return nil, fmt.Errorf("unknown queue driver %q", driver)
+	}
+}
+
+type Task struct {
+	ID           uuid.UUID              `json:"id"`                // set on publish, redeliveries keep it
+	Attempt      int                    `json:"attempt,omitempty"` // set on receipt, 1 for the first delivery
+	Type         string                 `json:"type"`
+	UserID       uuid.UUID              `json:"user_id"`
+	ServerID     uuid.UUID              `json:"server_id,omitempty"`
+	ConnectionID uuid.UUID              `json:"connection_id,omitempty"`
+	Data         map[string]interface{} `json:"data,omitempty"`
+	Event        string                 `json:"event,omitempty"`     // WebSocket event type of notification tasks
+	Broadcast    bool                   `json:"broadcast,omitempty"` // notification for every connected user instead of UserID
+}
+
+const (
+	TaskCreateConnection      = "create_connection"
+	TaskDeleteConnection      = "delete_connection"
+	TaskUpdateTraffic         = "update_traffic"
+	TaskRefreshConnection     = "refresh_connection"
+	TaskUpdateConnection      = "update_connection"
+	TaskWebSocketNotification = "websocket_notification"
+)
+
+// WebSocketEvent is a notification task for the WebSocket sessions of one user
+func WebSocketEvent(userID uuid.UUID, event string, data map[string]interface{}) Task {
+	return Task{
+		Type:   TaskWebSocketNotification,
+		UserID: userID,
+		Event:  event,
+		Data:   data,
+	}
+}
+
+// WebSocketBroadcast is a notification task for every connected user
+func WebSocketBroadcast(event string, data map[string]interface{}) Task {
+	return Task{
+		Type:      TaskWebSocketNotification,
+		Event:     event,
+		Broadcast: true,
+		Data:      data,
+	}
+}
+
+// RetryPolicy controls redelivery of failed tasks. A failed task waits in a delay
+// queue for RetryBaseDelay * 2^(attempt-1), capped at RetryMaxDelay, and goes to
+// the <queue>.dlq dead letter queue after MaxAttempts attempts.
+type RetryPolicy struct {
+	MaxAttempts    int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+}
+
+// delay is the backoff before the given retry attempt
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.RetryBaseDelay
+	for i := 1; i < attempt && delay < p.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if p.RetryMaxDelay > 0 && delay > p.RetryMaxDelay {
+		delay = p.RetryMaxDelay
+	}
+	return delay
+}
+
+// ConsumerOptions controls how many tasks of a queue are handled at once
+type ConsumerOptions struct {
+	Prefetch int // unacked deliveries the broker sends ahead, 0 is unlimited
+	Workers  int // handler goroutines, at least 1
+	// Key assigns a task to a worker. Tasks with the same key are handled one
+	// at a time in delivery order. Nil spreads tasks over workers round robin.
+	Key func(Task) string
+}
+
+// Queues are the work queues bound to the exchange by their name
+var Queues = []string{"tasks", "traffic_updates"}
+
+// DeadLetterQueue returns the name of the dead letter queue of a work queue
+func DeadLetterQueue(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// routingKey is the work queue of a task, notifications are routed by notificationKey
+func routingKey(task Task) string {
+	return "tasks"
+}
+
+// Subscription is the notification feed of one WebSocket instance. Every instance
+// has its own and binds the users connected to it, so an event reaches the user on
+// whichever instance they are connected to.
+type Subscription interface {
+	Bind(userID uuid.UUID) error
+	Unbind(userID uuid.UUID) error
+	Close() error
+}
+
+// BroadcastKey is the routing key of notifications for all users, every subscription has it
+const BroadcastKey = "broadcast"
+
+// UserKey is the routing key of notifications for one user
+func UserKey(userID uuid.UUID) string {
+	return "user." + userID.String()
+}
+
+// notificationKey is the routing key of a WebSocket notification task
+func notificationKey(task Task) string {
+	if task.Broadcast {
+		return BroadcastKey
+	}
+	return UserKey(task.UserID)
+}
+
+// shard maps a key to one of n workers
+func shard(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
@@ -1,51 +1,140 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
 )
 
 type Queue struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	url      string
 	exchange string
+	retry    RetryPolicy
+
+	mu        sync.RWMutex
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	consumers []consumer
+	closed    bool
+	handlers  sync.WaitGroup // running handler goroutines, waited for by Shutdown
+
+	subscriptions []*amqpSubscription // notification queues, declared again after a reconnect
 }
 
-type Task struct {
-	Type        string                 `json:"type"`
-	UserID      uuid.UUID              `json:"user_id"`
-	ServerID    uuid.UUID              `json:"server_id,omitempty"`
-	ConnectionID uuid.UUID             `json:"connection_id,omitempty"`
-	Data        map[string]interface{} `json:"data,omitempty"`
+// consumer is re-registered on every new channel after a reconnect
+type consumer struct {
+	queueName string
+	tag       string
+	handler   func(Task) error
+	options   ConsumerOptions
 }
 
+// Backoff between reconnect attempts after the broker connection is lost
 const (
-	TaskCreateConnection = "create_connection"
-	TaskDeleteConnection = "delete_connection"
-	TaskUpdateTraffic    = "update_traffic"
-	TaskRefreshConnection = "refresh_connection"
-	TaskWebSocketNotification = "websocket_notification"
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
 )
 
-func New(url, exchange string) (*Queue, error) {
-	conn, err := amqp.Dial(url)
+// confirmTimeout bounds the wait for the broker to confirm a publish
+const confirmTimeout = 5 * time.Second
+
+// ErrNotConnected is returned by publishes while the broker connection is down
+var ErrNotConnected = errors.New("not connected to RabbitMQ")
+
+// Message headers used for retries and dead lettering
+const (
+	HeaderRetryCount     = "x-retry-count"
+	HeaderLastError      = "x-last-error"
+	HeaderOriginalQueue  = "x-original-queue"
+	HeaderDeadLetteredAt = "x-dead-lettered-at"
+)
+
+func New(url, exchange string, retry RetryPolicy) (*Queue, error) {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+
+	q := &Queue{
+		url:      url,
+		exchange: exchange,
+		retry:    retry,
+	}
+	if err := q.connect(); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("exchange", exchange).Msg("RabbitMQ connection established")
+	return q, nil
+}
+
+// connect opens a connection and channel, declares the topology, registers the
+// consumers and watches the connection to reconnect when it is lost
+func (q *Queue) connect() error {
+	conn, err := amqp.Dial(q.url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
 	channel, err := conn.Channel()
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to open channel: %w", err)
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	// Publisher confirms, a publish succeeds only after the broker has taken the message
+	if err := channel.Confirm(false); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	if err := q.declareTopology(channel); err != nil {
+		conn.Close()
+		return err
 	}
 
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		conn.Close()
+		return ErrNotConnected
+	}
+	q.conn = conn
+	q.channel = channel
+	consumers := append([]consumer(nil), q.consumers...)
+	subscriptions := append([]*amqpSubscription(nil), q.subscriptions...)
+	q.mu.Unlock()
+
+	for _, c := range consumers {
+		if err := q.consume(channel, c); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	for _, subscription := range subscriptions {
+		if err := subscription.open(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	// Watched only once set up, a failed setup is retried by the caller and
+	// must not start a second reconnect loop
+	go q.watch(conn, channel)
+	return nil
+}
+
+// declareTopology declares the exchanges, the work queues and their dead letter queues
+func (q *Queue) declareTopology(channel *amqp.Channel) error {
 	// Declare exchange
-	err = channel.ExchangeDeclare(
-		exchange,
+	err := channel.ExchangeDeclare(
+		q.exchange,
 		"topic",
 		true,  // durable
 		false, // auto-deleted
@@ -54,14 +143,16 @@ func New(url, exchange string) (*Queue, error) {
 		nil,
 	)
 	if err != nil {
-		channel.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to declare exchange: %w", err)
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+
+	// WebSocket notifications, every WebSocket instance binds its own queue
+	if err := channel.ExchangeDeclare(q.notificationExchange(), "topic", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare notification exchange: %w", err)
 	}
 
 	// Declare queues
-	queues := []string{"tasks", "traffic_updates", "websocket_notifications"}
-	for _, queueName := range queues {
+	for _, queueName := range Queues {
 		_, err = channel.QueueDeclare(
 			queueName,
 			true,  // durable
@@ -71,9 +162,7 @@ func New(url, exchange string) (*Queue, error) {
 			nil,
 		)
 		if err != nil {
-			channel.Close()
-			conn.Close()
-			return nil, fmt.Errorf("failed to declare queue %s: %w", queueName, err)
+			return fmt.Errorf("failed to declare queue %s: %w", queueName, err)
 		}
 
 		// Bind queue to exchange
@@ -81,49 +170,134 @@ func New(url, exchange string) (*Queue, error) {
 		err = channel.QueueBind(
 			queueName,
 			routingKey,
-			exchange,
+			q.exchange,
 			false,
 			nil,
 		)
 		if err != nil {
-			channel.Close()
-			conn.Close()
-			return nil, fmt.Errorf("failed to bind queue %s: %w", queueName, err)
+			return fmt.Errorf("failed to bind queue %s: %w", queueName, err)
+		}
+
+		// Tasks that failed MaxAttempts times, published through the default exchange
+		if _, err := channel.QueueDeclare(DeadLetterQueue(queueName), true, false, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare dead letter queue for %s: %w", queueName, err)
 		}
 	}
 
-	log.Info().Str("exchange", exchange).Msg("RabbitMQ connection established")
+	return nil
+}
 
-	return &Queue{
-		conn:    conn,
-		channel: channel,
-		exchange: exchange,
-	}, nil
+// watch waits until the connection or the channel is closed and reconnects unless
+// the queue was closed
+func (q *Queue) watch(conn *amqp.Connection, channel *amqp.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-channelClosed:
+		// A channel exception leaves the connection open, start over with both
+		conn.Close()
+	}
+
+	if q.isClosed() {
+		return
+	}
+
+	event := log.Error()
+	if reason != nil {
+		event = event.Str("reason", reason.Reason).Int("code", reason.Code)
+	}
+	event.Msg("RabbitMQ connection lost, reconnecting")
+
+	q.reconnect()
+}
+
+// reconnect retries connect with exponential backoff until it succeeds or the queue is closed
+func (q *Queue) reconnect() {
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+		if q.isClosed() {
+			return
+		}
+
+		if err := q.connect(); err != nil {
+			log.Warn().Err(err).Int("attempt", attempt).Msg("Failed to reconnect to RabbitMQ")
+			delay = min(delay*2, reconnectMaxDelay)
+			continue
+		}
+
+		log.Info().Int("attempts", attempt).Msg("RabbitMQ connection restored")
+		return
+	}
+}
+
+// Connected reports whether the broker connection and channel are open
+func (q *Queue) Connected() bool {
+	_, err := q.currentChannel()
+	return err == nil
 }
 
+func (q *Queue) currentChannel() (*amqp.Channel, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.channel == nil || q.channel.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return q.channel, nil
+}
+
+// openChannel opens a short lived channel for admin operations
+func (q *Queue) openChannel() (*amqp.Channel, error) {
+	q.mu.RLock()
+	conn := q.conn
+	q.mu.RUnlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+	return channel, nil
+}
+
+func (q *Queue) isClosed() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.closed
+}
+
+// PublishTask publishes a task and waits for the broker confirm. A task without an
+// ID gets one, it is also the AMQP message ID. WebSocket notifications go to the
+// notification exchange and are dropped when no instance has the user connected.
 func (q *Queue) PublishTask(task Task) error {
+	if task.ID == uuid.Nil {
+		task.ID = uuid.New()
+	}
+	task.Attempt = 0
+
 	body, err := json.Marshal(task)
 	if err != nil {
 		return fmt.Errorf("failed to marshal task: %w", err)
 	}
 
-	// Determine routing key based on task type
-	routingKey := "tasks"
+	msg := amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         body,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    task.ID.String(),
+	}
 	if task.Type == TaskWebSocketNotification {
-		routingKey = "websocket_notifications"
+		msg.DeliveryMode = amqp.Transient
+		err = q.publish(q.notificationExchange(), notificationKey(task), msg)
+	} else {
+		err = q.publish(q.exchange, routingKey(task), msg)
 	}
-
-	err = q.channel.Publish(
-		q.exchange,
-		routingKey,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         body,
-			DeliveryMode: amqp.Persistent,
-		},
-	)
 	if err != nil {
 		return fmt.Errorf("failed to publish task: %w", err)
 	}
@@ -136,10 +310,75 @@ func (q *Queue) PublishTask(task Task) error {
 	return nil
 }
 
+// publish sends a message and waits until the broker confirms it. Fails fast while
+// reconnecting, callers decide whether to retry.
+func (q *Queue) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	channel, err := q.currentChannel()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, false, false, msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no publish confirm: %w", err)
+	}
+	if !acked {
+		return fmt.Errorf("publish rejected by broker")
+	}
+	return nil
+}
+
+// ConsumeTasks starts handling the tasks of a queue one at a time. The consumer
+// survives reconnects.
 func (q *Queue) ConsumeTasks(queueName string, handler func(Task) error) error {
-	msgs, err := q.channel.Consume(
-		queueName,
-		"",    // consumer
+	return q.ConsumeTasksWith(queueName, ConsumerOptions{Prefetch: 1, Workers: 1}, handler)
+}
+
+// ConsumeTasksWith starts handling the tasks of a queue with a pool of workers
+func (q *Queue) ConsumeTasksWith(queueName string, options ConsumerOptions, handler func(Task) error) error {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	c := consumer{
+		queueName: queueName,
+		tag:       fmt.Sprintf("%s-%s", queueName, uuid.New().String()),
+		handler:   handler,
+		options:   options,
+	}
+
+	q.mu.Lock()
+	q.consumers = append(q.consumers, c)
+	channel := q.channel
+	q.mu.Unlock()
+
+	// While disconnected the consumer starts with the next connection
+	if channel == nil || channel.IsClosed() {
+		log.Warn().Str("queue", queueName).Msg("RabbitMQ is not connected, consumer starts after reconnect")
+		return nil
+	}
+	return q.consume(channel, c)
+}
+
+func (q *Queue) consume(channel *amqp.Channel, c consumer) error {
+	if err := q.declareRetryQueues(channel, c.queueName); err != nil {
+		return err
+	}
+
+	// Per consumer prefetch, applies to the Consume call below
+	if err := channel.Qos(c.options.Prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch: %w", err)
+	}
+
+	msgs, err := channel.Consume(
+		c.queueName,
+		c.tag, // consumer
 		false, // auto-ack
 		false, // exclusive
 		false, // no-local
@@ -150,63 +389,234 @@ func (q *Queue) ConsumeTasks(queueName string, handler func(Task) error) error {
 		return fmt.Errorf("failed to register consumer: %w", err)
 	}
 
+	// A task always goes to the worker of its key, a busy worker never holds
+	// back the deliveries of the others
+	workers := newDispatcher(c.options.Workers, &q.handlers, func(d delivery) {
+		q.handle(c, d)
+	})
+
 	go func() {
+		next := 0
 		for msg := range msgs {
 			var task Task
 			if err := json.Unmarshal(msg.Body, &task); err != nil {
 				log.Error().Err(err).Msg("Failed to unmarshal task")
-				msg.Nack(false, false)
+				q.deadLetter(c.queueName, msg, err)
 				continue
 			}
+			if task.ID == uuid.Nil {
+				task.ID, _ = uuid.Parse(msg.MessageId)
+			}
+			task.Attempt = retryCount(msg.Headers) + 1
 
-			if err := handler(task); err != nil {
-				log.Error().
-					Err(err).
-					Str("type", task.Type).
-					Msg("Task handler failed")
-				msg.Nack(false, true) // Requeue on failure
-			} else {
-				msg.Ack(false)
+			worker := next % c.options.Workers
+			next++
+			if c.options.Key != nil {
+				worker = shard(c.options.Key(task), c.options.Workers)
 			}
+			workers.push(worker, delivery{msg: msg, task: task})
 		}
+		workers.stop()
+		// The deliveries channel closes when the consumer is cancelled or with the
+		// AMQP channel, reconnect restarts the consumer
+		log.Warn().Str("queue", c.queueName).Msg("Stopped consuming tasks")
 	}()
 
-	log.Info().Str("queue", queueName).Msg("Started consuming tasks")
+	log.Info().Str("queue", c.queueName).Int("workers", c.options.Workers).Msg("Started consuming tasks")
 	return nil
 }
 
-func (q *Queue) Close() error {
-	if q.channel != nil {
-		if err := q.channel.Close(); err != nil {
-			return err
+// delivery is a received message with its decoded task
+type delivery struct {
+	msg  amqp.Delivery
+	task Task
+}
+
+func (q *Queue) handle(c consumer, d delivery) {
+	if err := c.handler(d.task); err != nil {
+		log.Error().
+			Err(err).
+			Str("type", d.task.Type).
+			Str("task_id", d.task.ID.String()).
+			Int("attempt", d.task.Attempt).
+			Msg("Task handler failed")
+		q.retryLater(c.queueName, d.msg, err)
+		return
+	}
+	d.msg.Ack(false)
+}
+
+// Shutdown stops the consumers, waits until the tasks being handled are finished
+// and closes the connection. Prefetched tasks that were not started are returned
+// to the queue when the channel closes.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	channel := q.channel
+	consumers := append([]consumer(nil), q.consumers...)
+	q.mu.Unlock()
+
+	if channel != nil && !channel.IsClosed() {
+		for _, c := range consumers {
+			if err := channel.Cancel(c.tag, false); err != nil {
+				log.Warn().Err(err).Str("queue", c.queueName).Msg("Failed to cancel consumer")
+			}
 		}
 	}
-	if q.conn != nil {
-		return q.conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		q.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info().Msg("All in-flight tasks finished")
+	case <-ctx.Done():
+		log.Warn().Msg("Shutdown timeout, unfinished tasks are redelivered")
+	}
+
+	return q.Close()
+}
+
+// retryQueue is the delay queue for a backoff. The name contains the delay so a
+// changed policy declares new queues instead of conflicting with the old arguments.
+func retryQueue(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, delay.Milliseconds())
+}
+
+// declareRetryQueues declares one delay queue per backoff step. Messages expire
+// from it back to the work queue through the exchange.
+func (q *Queue) declareRetryQueues(channel *amqp.Channel, queueName string) error {
+	for attempt := 1; attempt < q.retry.MaxAttempts; attempt++ {
+		delay := q.retry.delay(attempt)
+		if delay <= 0 {
+			continue
+		}
+		_, err := channel.QueueDeclare(
+			retryQueue(queueName, delay),
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    q.exchange,
+				"x-dead-letter-routing-key": queueName,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare retry queue for %s: %w", queueName, err)
+		}
 	}
 	return nil
 }
 
-// PublishWebSocketNotification publishes a WebSocket notification task
-func (q *Queue) PublishWebSocketNotification(userID uuid.UUID, messageType string, data map[string]interface{}) error {
-	task := Task{
-		Type:   TaskWebSocketNotification,
-		UserID: userID,
-		Data:   data,
+// retryLater moves a failed message to the delay queue of its next attempt, or to
+// the dead letter queue when it ran out of attempts
+func (q *Queue) retryLater(queueName string, msg amqp.Delivery, cause error) {
+	attempt := retryCount(msg.Headers) + 1
+	if attempt >= q.retry.MaxAttempts {
+		q.deadLetter(queueName, msg, cause)
+		return
+	}
+
+	headers := copyHeaders(msg.Headers)
+	headers[HeaderRetryCount] = int32(attempt)
+	headers[HeaderLastError] = cause.Error()
+
+	target := queueName
+	delay := q.retry.delay(attempt)
+	if delay > 0 {
+		target = retryQueue(queueName, delay)
+	}
+
+	if err := q.republish("", target, msg, headers); err != nil {
+		log.Error().Err(err).Str("queue", queueName).Msg("Failed to schedule task retry")
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
+
+// deadLetter moves a message to the dead letter queue of queueName
+func (q *Queue) deadLetter(queueName string, msg amqp.Delivery, cause error) {
+	headers := copyHeaders(msg.Headers)
+	headers[HeaderRetryCount] = int32(retryCount(msg.Headers) + 1)
+	headers[HeaderLastError] = cause.Error()
+	headers[HeaderOriginalQueue] = queueName
+	headers[HeaderDeadLetteredAt] = time.Now().UTC().Format(time.RFC3339)
+
+	if err := q.republish("", DeadLetterQueue(queueName), msg, headers); err != nil {
+		log.Error().Err(err).Str("queue", queueName).Msg("Failed to dead letter task")
+		msg.Nack(false, true)
+		return
 	}
+	msg.Ack(false)
 
-	return q.PublishTask(task)
+	log.Warn().
+		Str("queue", queueName).
+		Str("message_id", msg.MessageId).
+		Str("error", cause.Error()).
+		Msg("Task moved to dead letter queue")
 }
 
-// PublishWebSocketBroadcast publishes a WebSocket broadcast notification to all users
-func (q *Queue) PublishWebSocketBroadcast(messageType string, data map[string]interface{}) error {
-	// Use zero UUID for broadcast messages
-	task := Task{
-		Type:   TaskWebSocketNotification,
-		UserID: uuid.Nil,
-		Data:   data,
+func (q *Queue) republish(exchange, routingKey string, msg amqp.Delivery, headers amqp.Table) error {
+	return q.publish(exchange, routingKey, amqp.Publishing{
+		ContentType:  msg.ContentType,
+		Body:         msg.Body,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.MessageId,
+		Headers:      headers,
+	})
+}
+
+// retryCount reads the number of failed attempts from the message headers
+func retryCount(headers amqp.Table) int {
+	switch v := headers[HeaderRetryCount].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
 	}
+}
 
-	return q.PublishTask(task)
+func copyHeaders(headers amqp.Table) amqp.Table {
+	result := amqp.Table{}
+	for key, value := range headers {
+		result[key] = value
+	}
+	return result
 }
 
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	channel, conn := q.channel, q.conn
+	q.mu.Unlock()
+
+	if channel != nil && !channel.IsClosed() {
+		if err := channel.Close(); err != nil {
+			return err
+		}
+	}
+	if conn != nil && !conn.IsClosed() {
+		return conn.Close()
+	}
+	return nil
+}
+
+// PublishWebSocketNotification publishes a WebSocket event for one user
+func (q *Queue) PublishWebSocketNotification(userID uuid.UUID, event string, data map[string]interface{}) error {
+	return q.PublishTask(WebSocketEvent(userID, event, data))
+}
+
+// PublishWebSocketBroadcast publishes a WebSocket event for every connected user
+func (q *Queue) PublishWebSocketBroadcast(event string, data map[string]interface{}) error {
+	return q.PublishTask(WebSocketBroadcast(event, data))
+}
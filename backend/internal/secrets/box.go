@@ -0,0 +1,173 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the size of master and data keys, AES-256
+const KeySize = 32
+
+// Sealed is an encrypted secret. The secret is encrypted with a random data key and the
+// data key is encrypted with the master key identified by KeyID.
+type Sealed struct {
+	Ciphertext string
+	DataKey    string
+	KeyID      string
+}
+
+// Box seals secrets with the primary master key and opens secrets sealed with the
+// primary or any previous key, so keys can be rotated without downtime
+type Box struct {
+	primaryID string
+	keys      map[string][]byte
+}
+
+// NewBox creates a box from base64 encoded master keys, empty previous keys are ignored
+func NewBox(primary string, previous ...string) (*Box, error) {
+	if strings.TrimSpace(primary) == "" {
+		return nil, errors.New("master key is not configured")
+	}
+
+	b := &Box{keys: make(map[string][]byte)}
+	id, err := b.addKey(primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	b.primaryID = id
+
+	for _, key := range previous {
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+		if _, err := b.addKey(key); err != nil {
+			return nil, fmt.Errorf("invalid previous master key: %w", err)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *Box) addKey(encoded string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("key is not base64: %w", err)
+	}
+	if len(key) != KeySize {
+		return "", fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	id := KeyID(key)
+	b.keys[id] = key
+	return id, nil
+}
+
+// KeyID is a short fingerprint of a master key, stored next to sealed secrets
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// PrimaryKeyID returns the ID of the key new secrets are sealed with
+func (b *Box) PrimaryKeyID() string {
+	return b.primaryID
+}
+
+// GenerateKey returns a new random base64 encoded master key
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Seal encrypts plaintext with a new data key wrapped by the primary key
+func (b *Box) Seal(plaintext string) (Sealed, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Sealed{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	ciphertext, err := encrypt(dataKey, []byte(plaintext))
+	if err != nil {
+		return Sealed{}, err
+	}
+	wrapped, err := encrypt(b.keys[b.primaryID], dataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+
+	return Sealed{
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		DataKey:    base64.StdEncoding.EncodeToString(wrapped),
+		KeyID:      b.primaryID,
+	}, nil
+}
+
+// Open decrypts a sealed secret
+func (b *Box) Open(sealed Sealed) (string, error) {
+	masterKey, ok := b.keys[sealed.KeyID]
+	if !ok {
+		return "", fmt.Errorf("master key %s is not configured", sealed.KeyID)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(sealed.DataKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid data key encoding: %w", err)
+	}
+	dataKey, err := decrypt(masterKey, wrapped)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("invalid ciphertext encoding: %w", err)
+	}
+	plaintext, err := decrypt(dataKey, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// encrypt seals data with AES-GCM, the nonce is prepended to the result
+func encrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func decrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -2,9 +2,10 @@ package services
 
 import (
 	"fmt"
-	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"xray-vpn-connect/internal/database"
 	"xray-vpn-connect/internal/models"
@@ -12,13 +13,29 @@ import (
 	"xray-vpn-connect/internal/services/xray"
 )
 
+// GB is the number of bytes in a plan traffic gigabyte
+const GB int64 = 1024 * 1024 * 1024
+
+// Provisioning states of a connection in the Xray panel, set by the worker
+const (
+	ConnectionStatusPending        = "pending"
+	ConnectionStatusProvisioning   = "provisioning"
+	ConnectionStatusReady          = "ready"
+	ConnectionStatusFailed         = "failed"
+	ConnectionStatusDeprovisioning = "deprovisioning"
+)
+
+// ConnectionFailedMessage is shown to users instead of the provisioning error,
+// which can contain panel addresses and responses
+const ConnectionFailedMessage = "Setup failed, please retry"
+
 type ConnectionService struct {
 	db          *database.DB
-	queue       *queue.Queue
+	queue       queue.TaskQueue
 	xrayClients map[uuid.UUID]*xray.Client
 }
 
-func NewConnectionService(db *database.DB, q *queue.Queue) *ConnectionService {
+func NewConnectionService(db *database.DB, q queue.TaskQueue) *ConnectionService {
 	return &ConnectionService{
 		db:          db,
 		queue:       q,
@@ -27,6 +44,11 @@ func NewConnectionService(db *database.DB, q *queue.Queue) *ConnectionService {
 }
 
 func (s *ConnectionService) CreateConnection(userID, serverID uuid.UUID) (*models.Connection, error) {
+	return s.createConnection(userID, serverID, nil)
+}
+
+// createConnection creates the connection, migratedFrom is the connection it replaces on failover
+func (s *ConnectionService) createConnection(userID, serverID uuid.UUID, migratedFrom *uuid.UUID) (*models.Connection, error) {
 	// Get server with user validation
 	var server models.Server
 	if err := s.db.Preload("XrayPanel").First(&server, "id = ? AND is_active = ?", serverID, true).Error; err != nil {
@@ -55,26 +77,46 @@ func (s *ConnectionService) CreateConnection(userID, serverID uuid.UUID) (*model
 
 	// Create connection record
 	connection := models.Connection{
-		UserID:      userID,
-		ServerID:    serverID,
-		IsActive:    true,
-		TrafficUsed: 0,
+		UserID:         userID,
+		ServerID:       serverID,
+		IsActive:       true,
+		Status:         ConnectionStatusPending,
+		TrafficUsed:    0,
+		MigratedFromID: migratedFrom,
 	}
 
-	// Set expiry based on subscription
-	var subscription models.Subscription
-	if err := s.db.Where("user_id = ? AND is_active = ? AND expires_at > ?", userID, true, time.Now()).
-		Order("expires_at DESC").First(&subscription).Error; err == nil && subscription.ExpiresAt != nil {
+	// Set expiry and limits based on subscription, family members use the owner's
+	if subscription, err := EffectiveSubscription(s.db.DB, userID); err == nil && subscription != nil && subscription.FrozenAt == nil {
 		connection.ExpiresAt = subscription.ExpiresAt
+		connection.TrafficLimit = subscription.Plan.TrafficLimitGB * GB
+		connection.DeviceLimit = subscription.Plan.DeviceLimit
 	}
 
-	if err := s.db.Create(&connection).Error; err != nil {
-		return nil, fmt.Errorf("failed to create connection: %w", err)
-	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the server row so concurrent requests can't overfill it
+		var locked models.Server
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, "id = ?", serverID).Error; err != nil {
+			return fmt.Errorf("server not found: %w", err)
+		}
+
+		var load int64
+		if err := tx.Model(&models.Connection{}).Where("server_id = ? AND is_active = ?", serverID, true).Count(&load).Error; err != nil {
+			return fmt.Errorf("failed to count server connections: %w", err)
+		}
+		if locked.MaxConnections > 0 && load >= int64(locked.MaxConnections) {
+			return fmt.Errorf("server is full, please choose another server")
+		}
+
+		if err := tx.Create(&connection).Error; err != nil {
+			return fmt.Errorf("failed to create connection: %w", err)
+		}
+
+		if err := tx.Model(&locked).Update("current_load", load+1).Error; err != nil {
+			return err
+		}
 
-	// Publish task to queue for async creation in Xray panel
-	if s.queue != nil {
-		if err := s.queue.PublishTask(queue.Task{
+		// The worker creates the client in the Xray panel
+		return EnqueueTask(tx, queue.Task{
 			Type:         queue.TaskCreateConnection,
 			UserID:       userID,
 			ServerID:     serverID,
@@ -83,10 +125,10 @@ func (s *ConnectionService) CreateConnection(userID, serverID uuid.UUID) (*model
 				"server_name": server.Name,
 				"protocol":    server.Protocol,
 			},
-		}); err != nil {
-			// Log error but don't fail connection creation
-			// Connection will be created in Xray when worker processes the task
-		}
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &connection, nil
@@ -120,20 +162,66 @@ func (s *ConnectionService) DeleteConnection(connectionID uuid.UUID) error {
 		return err
 	}
 
-	// Publish delete task
-	if s.queue != nil {
-		if err := s.queue.PublishTask(queue.Task{
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(connection).Update("status", ConnectionStatusDeprovisioning).Error; err != nil {
+			return err
+		}
+
+		// Soft delete connection
+		if err := tx.Delete(connection).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.Server{}).
+			Where("id = ?", connection.ServerID).
+			Update("current_load", gorm.Expr("GREATEST(current_load - 1, 0)")).Error; err != nil {
+			return err
+		}
+
+		// The worker removes the client from the Xray panel
+		return EnqueueTask(tx, queue.Task{
 			Type:         queue.TaskDeleteConnection,
 			ConnectionID: connectionID,
 			UserID:       connection.UserID,
 			ServerID:     connection.ServerID,
-		}); err != nil {
-			// Log error
+		})
+	})
+}
+
+// RetryConnection queues provisioning of a user's connection that failed again
+func (s *ConnectionService) RetryConnection(userID, connectionID uuid.UUID) (*models.Connection, error) {
+	var connection models.Connection
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&connection, "id = ? AND user_id = ?", connectionID, userID).Error; err != nil {
+			return fmt.Errorf("connection not found: %w", err)
 		}
+		if connection.Status != ConnectionStatusFailed {
+			return fmt.Errorf("connection is %s, only failed connections can be retried", connection.Status)
+		}
+
+		connection.Status = ConnectionStatusPending
+		connection.LastError = ""
+		if err := tx.Model(&connection).Updates(map[string]interface{}{
+			"status":     connection.Status,
+			"last_error": connection.LastError,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to reset connection status: %w", err)
+		}
+
+		return EnqueueTask(tx, queue.Task{
+			Type:         queue.TaskCreateConnection,
+			UserID:       userID,
+			ServerID:     connection.ServerID,
+			ConnectionID: connection.ID,
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Soft delete connection
-	return s.db.Delete(connection).Error
+	return &connection, nil
 }
 
 func (s *ConnectionService) UpdateConnectionKey(connectionID uuid.UUID, key, subscriptionLink string) error {
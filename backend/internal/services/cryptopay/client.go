@@ -0,0 +1,167 @@
+package cryptopay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Client for Crypto Pay API (@CryptoBot)
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+type Invoice struct {
+	InvoiceID         int64  `json:"invoice_id"`
+	Hash              string `json:"hash"`
+	Status            string `json:"status"` // active, paid, expired
+	Asset             string `json:"asset"`
+	Amount            string `json:"amount"`
+	Description       string `json:"description,omitempty"`
+	Payload           string `json:"payload,omitempty"`
+	BotInvoiceURL     string `json:"bot_invoice_url"`
+	MiniAppInvoiceURL string `json:"mini_app_invoice_url,omitempty"`
+	WebAppInvoiceURL  string `json:"web_app_invoice_url,omitempty"`
+}
+
+type Transfer struct {
+	TransferID int64  `json:"transfer_id"`
+	UserID     int64  `json:"user_id"`
+	Asset      string `json:"asset"`
+	Amount     string `json:"amount"`
+	Status     string `json:"status"`
+}
+
+// WebhookUpdate is the body Crypto Pay posts to the webhook URL
+type WebhookUpdate struct {
+	UpdateID    int64   `json:"update_id"`
+	UpdateType  string  `json:"update_type"` // invoice_paid
+	RequestDate string  `json:"request_date"`
+	Payload     Invoice `json:"payload"`
+}
+
+type apiError struct {
+	Code int    `json:"code"`
+	Name string `json:"name"`
+}
+
+type apiResponse struct {
+	Ok     bool            `json:"ok"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *apiError       `json:"error,omitempty"`
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		token:   token,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (c *Client) call(method string, params interface{}, result interface{}) error {
+	jsonData, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", c.baseURL, method), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Crypto-Pay-API-Token", c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var response apiResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("failed to decode response: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	if !response.Ok {
+		if response.Error != nil {
+			return fmt.Errorf("api returned error %d: %s", response.Error.Code, response.Error.Name)
+		}
+		return fmt.Errorf("api returned error: status %d", resp.StatusCode)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(response.Result, result); err != nil {
+			return fmt.Errorf("failed to decode result: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CreateInvoice creates a new invoice, payload is returned back in the webhook
+func (c *Client) CreateInvoice(asset, amount, description, payload string, expiresIn time.Duration) (*Invoice, error) {
+	params := map[string]interface{}{
+		"asset":       asset,
+		"amount":      amount,
+		"description": description,
+		"payload":     payload,
+	}
+	if expiresIn > 0 {
+		params["expires_in"] = int(expiresIn.Seconds())
+	}
+
+	var invoice Invoice
+	if err := c.call("createInvoice", params, &invoice); err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
+
+// Transfer sends coins from the app balance to a Telegram user.
+// spendID makes the call idempotent, repeated calls with the same ID are rejected by the API.
+func (c *Client) Transfer(telegramUserID int64, asset, amount, spendID, comment string) (*Transfer, error) {
+	params := map[string]interface{}{
+		"user_id":  telegramUserID,
+		"asset":    asset,
+		"amount":   amount,
+		"spend_id": spendID,
+		"comment":  comment,
+	}
+
+	var transfer Transfer
+	if err := c.call("transfer", params, &transfer); err != nil {
+		return nil, err
+	}
+
+	return &transfer, nil
+}
+
+// VerifySignature checks the crypto-pay-api-signature header.
+// The signature is HMAC-SHA256 of the raw body keyed with SHA256 of the API token.
+func VerifySignature(token string, body []byte, signature string) bool {
+	secret := sha256.Sum256([]byte(token))
+
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/services/cryptopay"
+)
+
+// CryptoPayProvider accepts crypto payments through Crypto Pay (@CryptoBot)
+type CryptoPayProvider struct {
+	client   *cryptopay.Client
+	token    string
+	asset    string
+	starRate float64
+}
+
+func NewCryptoPayProvider(cfg *config.Config) *CryptoPayProvider {
+	return &CryptoPayProvider{
+		client:   cryptopay.NewClient(cfg.Payments.CryptoPay.APIURL, cfg.Payments.CryptoPay.APIToken),
+		token:    cfg.Payments.CryptoPay.APIToken,
+		asset:    cfg.Payments.CryptoPay.Asset,
+		starRate: cfg.Payments.CryptoPay.StarRate,
+	}
+}
+
+func (p *CryptoPayProvider) Name() string {
+	return ProviderCryptoPay
+}
+
+// amount converts stars to the invoice asset
+func (p *CryptoPayProvider) amount(stars int64) string {
+	return strconv.FormatFloat(float64(stars)*p.starRate, 'f', 2, 64)
+}
+
+func (p *CryptoPayProvider) CreateInvoice(payment *models.Payment) (*Invoice, error) {
+	amount := p.amount(payment.Amount)
+	invoice, err := p.client.CreateInvoice(
+		p.asset,
+		amount,
+		fmt.Sprintf("Top-up your VPN service balance with %d stars", payment.Amount),
+		payment.Payload,
+		time.Hour,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create crypto invoice: %w", err)
+	}
+
+	link := invoice.MiniAppInvoiceURL
+	if link == "" {
+		link = invoice.BotInvoiceURL
+	}
+
+	return &Invoice{
+		Link:       link,
+		Currency:   p.asset,
+		Amount:     amount,
+		ExternalID: strconv.FormatInt(invoice.InvoiceID, 10),
+	}, nil
+}
+
+func (p *CryptoPayProvider) VerifyWebhook(header http.Header, body []byte) (*PaymentEvent, error) {
+	if !cryptopay.VerifySignature(p.token, body, header.Get("Crypto-Pay-Api-Signature")) {
+		return nil, fmt.Errorf("invalid webhook signature")
+	}
+
+	var update cryptopay.WebhookUpdate
+	if err := json.Unmarshal(body, &update); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook: %w", err)
+	}
+
+	return &PaymentEvent{
+		Payload:    update.Payload.Payload,
+		ExternalID: strconv.FormatInt(update.Payload.InvoiceID, 10),
+		Paid:       update.UpdateType == "invoice_paid" && update.Payload.Status == "paid",
+	}, nil
+}
+
+// Refund transfers the invoiced amount back to the user's @CryptoBot wallet. The
+// amount is not recomputed, the star rate may have changed since the payment.
+func (p *CryptoPayProvider) Refund(payment *models.Payment) error {
+	if payment.InvoiceAmount == "" {
+		return fmt.Errorf("payment has no invoice amount")
+	}
+	_, err := p.client.Transfer(
+		payment.TelegramID,
+		payment.Currency,
+		payment.InvoiceAmount,
+		payment.ID.String(),
+		"VPN service payment refund",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to transfer refund: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+// DeviceLimitService enforces plan device limits by watching the IPs each
+// Xray client is used from. Connections that stay over the limit for several
+// checks in a row are disabled in the panel for a while.
+type DeviceLimitService struct {
+	db                  *database.DB
+	config              *config.Config
+	panelService        *XrayPanelService
+	notificationService *NotificationService
+}
+
+func NewDeviceLimitService(db *database.DB, config *config.Config, panelService *XrayPanelService, notificationService *NotificationService) *DeviceLimitService {
+	return &DeviceLimitService{
+		db:                  db,
+		config:              config,
+		panelService:        panelService,
+		notificationService: notificationService,
+	}
+}
+
+// CheckDeviceLimits resumes connections whose suspension ended and checks
+// all limited connections against their device limit
+func (s *DeviceLimitService) CheckDeviceLimits() {
+	s.resumeSuspended()
+
+	var connections []models.Connection
+	if err := s.db.Preload("Server").
+		Where("is_active = ? AND device_limit > 0 AND connection_key <> '' AND suspended_until IS NULL", true).
+		Find(&connections).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load connections for device limit check")
+		return
+	}
+
+	for i := range connections {
+		if err := s.checkConnection(&connections[i]); err != nil {
+			log.Warn().Err(err).Str("connection_id", connections[i].ID.String()).Msg("Device limit check failed")
+		}
+	}
+}
+
+func (s *DeviceLimitService) checkConnection(connection *models.Connection) error {
+	client, _, err := s.panelService.ClientForServer(&connection.Server)
+	if err != nil {
+		return err
+	}
+
+	email := XrayClientEmail(connection)
+	ips, err := client.GetClientIPs(email)
+	if err != nil {
+		return fmt.Errorf("failed to get client IPs: %w", err)
+	}
+
+	// Start a fresh window for the next check
+	if err := client.ClearClientIPs(email); err != nil {
+		log.Warn().Err(err).Str("email", email).Msg("Failed to clear client IPs")
+	}
+
+	if len(ips) <= connection.DeviceLimit {
+		if connection.DeviceViolations > 0 {
+			return s.db.Model(connection).Updates(map[string]interface{}{
+				"device_violations": 0,
+				"limit_exceeded_at": nil,
+			}).Error
+		}
+		return nil
+	}
+
+	now := time.Now()
+	violations := connection.DeviceViolations + 1
+
+	log.Warn().
+		Str("connection_id", connection.ID.String()).
+		Int("ips", len(ips)).
+		Int("device_limit", connection.DeviceLimit).
+		Int("violations", violations).
+		Msg("Device limit exceeded")
+
+	if limit := s.config.Worker.DeviceViolationLimit; limit > 0 && violations >= limit {
+		// The update task disables the client, keyed like every other write to the inbound
+		until := now.Add(s.config.Worker.DeviceSuspendDuration)
+		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(connection).Updates(map[string]interface{}{
+				"device_violations": 0,
+				"limit_exceeded_at": now,
+				"suspended_until":   until,
+			}).Error; err != nil {
+				return fmt.Errorf("failed to suspend connection: %w", err)
+			}
+			return EnqueueTask(tx, queue.Task{
+				Type:         queue.TaskUpdateConnection,
+				UserID:       connection.UserID,
+				ServerID:     connection.ServerID,
+				ConnectionID: connection.ID,
+			})
+		}); err != nil {
+			return err
+		}
+
+		s.notificationService.Notify(connection.UserID, EventDeviceLimitSuspended,
+			fmt.Sprintf("⛔ Your connection to %s was used from %d devices while your plan allows %d. It is paused until %s.",
+				connection.Server.Name, len(ips), connection.DeviceLimit, until.Format("2006-01-02 15:04 MST")),
+			map[string]interface{}{
+				"connection_id":   connection.ID.String(),
+				"suspended_until": until,
+			})
+		return nil
+	}
+
+	if err := s.db.Model(connection).Updates(map[string]interface{}{
+		"device_violations": violations,
+		"limit_exceeded_at": now,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to mark connection: %w", err)
+	}
+
+	// Warn once, on the first violation in a row
+	if violations == 1 {
+		s.notificationService.Notify(connection.UserID, EventDeviceLimitExceeded,
+			fmt.Sprintf("⚠️ Your connection to %s is used from %d devices, your plan allows %d. Keep sharing it and it will be paused.",
+				connection.Server.Name, len(ips), connection.DeviceLimit),
+			map[string]interface{}{
+				"connection_id": connection.ID.String(),
+				"devices":       len(ips),
+				"device_limit":  connection.DeviceLimit,
+			})
+	}
+
+	return nil
+}
+
+// resumeSuspended lifts suspensions that have ended. The client is updated by a
+// queued task, which only enables it while the user has a usable subscription.
+func (s *DeviceLimitService) resumeSuspended() {
+	var connections []models.Connection
+	if err := s.db.Preload("Server").
+		Where("suspended_until IS NOT NULL AND suspended_until <= ?", time.Now()).
+		Find(&connections).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load suspended connections")
+		return
+	}
+
+	for i := range connections {
+		connection := &connections[i]
+
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(connection).Update("suspended_until", nil).Error; err != nil {
+				return fmt.Errorf("failed to clear suspension: %w", err)
+			}
+			return EnqueueTask(tx, queue.Task{
+				Type:         queue.TaskUpdateConnection,
+				UserID:       connection.UserID,
+				ServerID:     connection.ServerID,
+				ConnectionID: connection.ID,
+			})
+		})
+		if err != nil {
+			log.Error().Err(err).Str("connection_id", connection.ID.String()).Msg("Failed to resume connection")
+			continue
+		}
+
+		s.notificationService.Notify(connection.UserID, EventDeviceLimitResumed,
+			fmt.Sprintf("✅ Your connection to %s is active again.", connection.Server.Name),
+			map[string]interface{}{"connection_id": connection.ID.String()})
+	}
+}
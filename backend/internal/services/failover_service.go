@@ -0,0 +1,199 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+)
+
+// FailoverService moves users off servers that keep failing health checks
+type FailoverService struct {
+	db                  *database.DB
+	config              *config.Config
+	serverService       *ServerService
+	connectionService   *ConnectionService
+	notificationService *NotificationService
+}
+
+func NewFailoverService(db *database.DB, config *config.Config, serverService *ServerService, connectionService *ConnectionService, notificationService *NotificationService) *FailoverService {
+	return &FailoverService{
+		db:                  db,
+		config:              config,
+		serverService:       serverService,
+		connectionService:   connectionService,
+		notificationService: notificationService,
+	}
+}
+
+// MigrateFailedServers gives every user on a server with at least FailoverAfter
+// consecutive failed probes a connection on a healthy server of the same group,
+// or the same country when the server has no group. Users that can't be moved
+// yet are retried on the next run.
+func (s *FailoverService) MigrateFailedServers() {
+	if !s.config.Servers.FailoverEnabled {
+		return
+	}
+
+	var servers []models.Server
+	if err := s.db.Where("is_active = ? AND status <> ? AND failed_checks >= ?",
+		true, ServerStatusMaintenance, s.config.Servers.FailoverAfter).
+		Find(&servers).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load failed servers")
+		return
+	}
+
+	for i := range servers {
+		s.migrateServer(&servers[i])
+	}
+}
+
+func (s *FailoverService) migrateServer(server *models.Server) {
+	var connections []models.Connection
+	if err := s.db.Where("server_id = ? AND is_active = ?", server.ID, true).Find(&connections).Error; err != nil {
+		log.Error().Err(err).Str("server", server.Name).Msg("Failed to load connections for failover")
+		return
+	}
+	if len(connections) == 0 {
+		return
+	}
+
+	migrated := 0
+	for i := range connections {
+		connection := &connections[i]
+
+		// Users without a usable subscription keep their disabled connection
+		subscription, err := EffectiveSubscription(s.db.DB, connection.UserID)
+		if err != nil {
+			log.Warn().Err(err).Str("connection_id", connection.ID.String()).Msg("Failed to get subscription for failover")
+			continue
+		}
+		if subscription == nil || subscription.FrozenAt != nil {
+			continue
+		}
+
+		// The job runs under a lock, so no other worker creates a replacement meanwhile
+		var replacement models.Connection
+		err = s.db.Preload("Server").Where("migrated_from_id = ?", connection.ID).First(&replacement).Error
+		if err == nil {
+			if err := s.awaitReplacement(&replacement); err != nil {
+				log.Warn().Err(err).Str("connection_id", connection.ID.String()).Msg("Failover replacement is not usable")
+			}
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Warn().Err(err).Str("connection_id", connection.ID.String()).Msg("Failed to check failover replacement")
+			continue
+		}
+
+		if err := s.migrateConnection(server, connection); err != nil {
+			log.Warn().Err(err).
+				Str("server", server.Name).
+				Str("connection_id", connection.ID.String()).
+				Msg("Failed to migrate connection")
+			continue
+		}
+		migrated++
+	}
+
+	log.Info().Str("server", server.Name).Int("migrated", migrated).Int("total", len(connections)).Msg("Server failover finished")
+}
+
+// migrateConnection creates a replacement connection on the first healthy candidate
+// with free capacity. The old connection is removed by CompleteMigration once the
+// replacement is provisioned.
+func (s *FailoverService) migrateConnection(server *models.Server, connection *models.Connection) error {
+	candidates, err := s.serverService.FailoverCandidates(connection.UserID, server)
+	if err != nil {
+		return err
+	}
+
+	for i := range candidates {
+		target := &candidates[i]
+
+		replacement, err := s.connectionService.createConnection(connection.UserID, target.ID, &connection.ID)
+		if err != nil {
+			// Usually the server filled up since the candidates were loaded
+			log.Debug().Err(err).Str("server", target.Name).Msg("Failover candidate rejected connection")
+			continue
+		}
+
+		// The user already had a connection on the target, it becomes the replacement
+		if replacement.MigratedFromID == nil {
+			if err := s.db.Model(&models.Connection{}).
+				Where("id = ? AND migrated_from_id IS NULL", replacement.ID).
+				Update("migrated_from_id", connection.ID).Error; err != nil {
+				return fmt.Errorf("failed to record migration source: %w", err)
+			}
+			// Reloaded, it may have been provisioned before the source was recorded
+			if err := s.db.Preload("Server").First(replacement, "id = ?", replacement.ID).Error; err != nil {
+				return fmt.Errorf("failed to reload replacement: %w", err)
+			}
+			return s.awaitReplacement(replacement)
+		}
+		if *replacement.MigratedFromID != connection.ID {
+			return fmt.Errorf("connection on %s already replaces connection %s", target.Name, *replacement.MigratedFromID)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("no healthy server with free capacity for %s", server.Name)
+}
+
+// awaitReplacement finishes the migration of a provisioned replacement. One still being
+// provisioned is finished by the worker, a failed one waits for the user to retry it.
+func (s *FailoverService) awaitReplacement(replacement *models.Connection) error {
+	switch replacement.Status {
+	case ConnectionStatusReady:
+		return s.CompleteMigration(replacement)
+	case ConnectionStatusFailed:
+		return fmt.Errorf("replacement connection %s failed to provision, it finishes the migration once retried", replacement.ID)
+	default:
+		return nil
+	}
+}
+
+// CompleteMigration removes the connection a provisioned failover replacement was
+// created for and tells the user to switch to the new key. Replacement.Server must
+// be loaded. Calling it again after the old connection is gone is a no-op.
+func (s *FailoverService) CompleteMigration(replacement *models.Connection) error {
+	if replacement.MigratedFromID == nil {
+		return nil
+	}
+
+	var old models.Connection
+	err := s.db.Preload("Server").First(&old, "id = ?", *replacement.MigratedFromID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get migrated connection: %w", err)
+	}
+
+	if err := s.connectionService.DeleteConnection(old.ID); err != nil {
+		return fmt.Errorf("failed to remove old connection: %w", err)
+	}
+
+	s.notificationService.Notify(old.UserID, EventServerFailover,
+		fmt.Sprintf("⚠️ Server %s %s is unavailable. We moved your connection to %s %s, please update your subscription or use the new key.",
+			old.Server.Flag, old.Server.Name, replacement.Server.Flag, replacement.Server.Name),
+		map[string]interface{}{
+			"old_server_id":     old.ServerID.String(),
+			"new_server_id":     replacement.ServerID.String(),
+			"old_connection_id": old.ID.String(),
+			"connection_id":     replacement.ID.String(),
+		})
+
+	log.Info().
+		Str("old_connection_id", old.ID.String()).
+		Str("connection_id", replacement.ID.String()).
+		Msg("Failover migration completed")
+
+	return nil
+}
@@ -0,0 +1,319 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+const (
+	FamilyMemberPending = "pending"
+	FamilyMemberActive  = "active"
+	FamilyMemberRemoved = "removed"
+)
+
+// FamilyService manages members of family plans
+type FamilyService struct {
+	db                  *database.DB
+	config              *config.Config
+	queue               queue.TaskQueue
+	subscriptionService *SubscriptionService
+	notificationService *NotificationService
+}
+
+func NewFamilyService(db *database.DB, config *config.Config, q queue.TaskQueue, subscriptionService *SubscriptionService, notificationService *NotificationService) *FamilyService {
+	return &FamilyService{
+		db:                  db,
+		config:              config,
+		queue:               q,
+		subscriptionService: subscriptionService,
+		notificationService: notificationService,
+	}
+}
+
+// InviteLink builds the bot deep link that accepts a family invite
+func (s *FamilyService) InviteLink(code string) string {
+	if s.config.Telegram.BotUsername == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/%s?start=family_%s", s.config.Telegram.BotUsername, code)
+}
+
+// normalizeUsername strips the @ and makes Telegram usernames comparable
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), "@"))
+}
+
+// familyPlan returns the owner's active subscription if its plan has family seats
+func (s *FamilyService) familyPlan(tx *gorm.DB, ownerID uuid.UUID) (*models.Subscription, error) {
+	subscription, err := s.subscriptionService.activeSubscription(tx, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	if subscription == nil || subscription.Plan.MaxMembers == 0 {
+		return nil, fmt.Errorf("no active family plan")
+	}
+	return subscription, nil
+}
+
+// GetMembers returns pending invites and active members of the owner's family
+func (s *FamilyService) GetMembers(ownerID uuid.UUID) ([]models.FamilyMember, error) {
+	var members []models.FamilyMember
+	if err := s.db.Preload("User").
+		Where("owner_id = ? AND status IN ?", ownerID, []string{FamilyMemberPending, FamilyMemberActive}).
+		Order("created_at ASC").
+		Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// GetMembership returns the user's active membership in someone else's family or nil
+func (s *FamilyService) GetMembership(userID uuid.UUID) (*models.FamilyMember, error) {
+	var member models.FamilyMember
+	err := s.db.Preload("Owner").Where("user_id = ? AND status = ?", userID, FamilyMemberActive).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Invite reserves a family seat. With a username only that Telegram user can
+// accept the invite, otherwise anyone with the link can.
+func (s *FamilyService) Invite(ownerID uuid.UUID, username string) (*models.FamilyMember, error) {
+	username = normalizeUsername(username)
+	var member *models.FamilyMember
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var owner models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&owner, "id = ?", ownerID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		subscription, err := s.familyPlan(tx, ownerID)
+		if err != nil {
+			return err
+		}
+
+		if username != "" && owner.Username != nil && normalizeUsername(*owner.Username) == username {
+			return fmt.Errorf("you cannot invite yourself")
+		}
+
+		var members []models.FamilyMember
+		if err := tx.Where("owner_id = ? AND status IN ?", ownerID, []string{FamilyMemberPending, FamilyMemberActive}).
+			Find(&members).Error; err != nil {
+			return fmt.Errorf("failed to load family members: %w", err)
+		}
+		if len(members) >= subscription.Plan.MaxMembers {
+			return fmt.Errorf("all %d family seats are taken", subscription.Plan.MaxMembers)
+		}
+		for _, existing := range members {
+			if username != "" && existing.Username == username {
+				return fmt.Errorf("@%s is already invited", username)
+			}
+		}
+
+		code, err := generateCode()
+		if err != nil {
+			return err
+		}
+
+		member = &models.FamilyMember{
+			OwnerID:    ownerID,
+			Username:   username,
+			InviteCode: code,
+			Status:     FamilyMemberPending,
+		}
+		if err := tx.Omit("Owner", "User").Create(member).Error; err != nil {
+			return fmt.Errorf("failed to create invite: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Invited users who already use the bot get the link right away
+	if username != "" {
+		var invited models.User
+		if err := s.db.Where("LOWER(username) = ?", username).First(&invited).Error; err == nil {
+			s.notificationService.Notify(invited.ID, EventFamilyInvite,
+				fmt.Sprintf("👨‍👩‍👧 You have been invited to a family VPN plan. Join: %s", s.InviteLink(member.InviteCode)),
+				map[string]interface{}{"invite_code": member.InviteCode})
+		}
+	}
+
+	return member, nil
+}
+
+// Join accepts a family invite
+func (s *FamilyService) Join(userID uuid.UUID, code string) (*models.FamilyMember, error) {
+	var member models.FamilyMember
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("invite_code = ? AND status = ?", strings.ToUpper(strings.TrimSpace(code)), FamilyMemberPending).
+			First(&member).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invalid invite code")
+			}
+			return fmt.Errorf("failed to find invite: %w", err)
+		}
+
+		if member.OwnerID == userID {
+			return fmt.Errorf("you cannot join your own family")
+		}
+
+		var user models.User
+		if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+		if member.Username != "" && (user.Username == nil || normalizeUsername(*user.Username) != member.Username) {
+			return fmt.Errorf("this invite is for @%s", member.Username)
+		}
+
+		var memberships int64
+		if err := tx.Model(&models.FamilyMember{}).
+			Where("user_id = ? AND status = ?", userID, FamilyMemberActive).
+			Count(&memberships).Error; err != nil {
+			return fmt.Errorf("failed to check memberships: %w", err)
+		}
+		if memberships > 0 {
+			return fmt.Errorf("you are already a member of a family")
+		}
+
+		own, err := ownSubscription(tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if own != nil {
+			return fmt.Errorf("you already have your own subscription")
+		}
+
+		if _, err := s.familyPlan(tx, member.OwnerID); err != nil {
+			return fmt.Errorf("the family plan is no longer active")
+		}
+
+		now := time.Now()
+		member.UserID = &userID
+		member.Status = FamilyMemberActive
+		member.JoinedAt = &now
+		if err := tx.Omit("Owner", "User").Save(&member).Error; err != nil {
+			return fmt.Errorf("failed to join family: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.notificationService.Notify(member.OwnerID, EventFamilyMemberJoined,
+		"👨‍👩‍👧 A new member joined your family plan.",
+		map[string]interface{}{"member_id": member.ID.String()})
+
+	return &member, nil
+}
+
+// RemoveMember revokes an invite or removes a member from the owner's family
+func (s *FamilyService) RemoveMember(ownerID, memberID uuid.UUID) error {
+	var member models.FamilyMember
+	if err := s.db.Where("id = ? AND owner_id = ? AND status IN ?", memberID, ownerID, []string{FamilyMemberPending, FamilyMemberActive}).
+		First(&member).Error; err != nil {
+		return fmt.Errorf("family member not found: %w", err)
+	}
+
+	if err := s.remove(&member); err != nil {
+		return err
+	}
+
+	if member.UserID != nil {
+		s.notificationService.Notify(*member.UserID, EventFamilyMemberRemoved,
+			"You have been removed from the family VPN plan, your connections were deleted.", nil)
+	}
+
+	return nil
+}
+
+// Leave removes the user from the family they are a member of
+func (s *FamilyService) Leave(userID uuid.UUID) error {
+	member, err := s.GetMembership(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get membership: %w", err)
+	}
+	if member == nil {
+		return fmt.Errorf("you are not a member of a family")
+	}
+
+	if err := s.remove(member); err != nil {
+		return err
+	}
+
+	s.notificationService.Notify(member.OwnerID, EventFamilyMemberLeft,
+		"A member left your family plan.",
+		map[string]interface{}{"member_id": member.ID.String()})
+
+	return nil
+}
+
+// remove marks the member removed and queues deletion of their connections from the panel
+func (s *FamilyService) remove(member *models.FamilyMember) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(member).Update("status", FamilyMemberRemoved).Error; err != nil {
+			return fmt.Errorf("failed to remove family member: %w", err)
+		}
+
+		if member.UserID == nil {
+			return nil
+		}
+
+		var connections []models.Connection
+		if err := tx.Where("user_id = ? AND is_active = ?", *member.UserID, true).Find(&connections).Error; err != nil {
+			return fmt.Errorf("failed to load member connections: %w", err)
+		}
+
+		for i := range connections {
+			connection := &connections[i]
+			if err := tx.Model(connection).Updates(map[string]interface{}{
+				"is_active": false,
+				"status":    ConnectionStatusDeprovisioning,
+			}).Error; err != nil {
+				return fmt.Errorf("failed to deactivate member connection: %w", err)
+			}
+			if err := tx.Delete(connection).Error; err != nil {
+				return fmt.Errorf("failed to delete member connection: %w", err)
+			}
+
+			if err := EnqueueTask(tx, queue.Task{
+				Type:         queue.TaskDeleteConnection,
+				UserID:       connection.UserID,
+				ServerID:     connection.ServerID,
+				ConnectionID: connection.ID,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("member_id", member.ID.String()).Str("owner_id", member.OwnerID.String()).Msg("Family member removed")
+	return nil
+}
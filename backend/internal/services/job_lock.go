@@ -0,0 +1,39 @@
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"gorm.io/gorm"
+
+	"xray-vpn-connect/internal/database"
+)
+
+// RunExclusive runs job unless another process holds the lock of the same name, so
+// periodic jobs run once per interval however many worker replicas there are. The
+// lock is a Postgres advisory lock held by a transaction until the job returns.
+// It reports whether the job ran.
+func RunExclusive(db *database.DB, name string, job func()) (bool, error) {
+	ran := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", jobLockID(name)).Scan(&locked).Error; err != nil {
+			return fmt.Errorf("failed to take %s lock: %w", name, err)
+		}
+		if !locked {
+			return nil
+		}
+
+		job()
+		ran = true
+		return nil
+	})
+	return ran, err
+}
+
+// jobLockID maps a job name to an advisory lock key
+func jobLockID(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("job:" + name))
+	return int64(h.Sum64())
+}
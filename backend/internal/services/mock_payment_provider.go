@@ -0,0 +1,69 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/models"
+)
+
+// MockPaymentProvider completes payments without any external service.
+// To pay an invoice POST {"payload": "...", "status": "paid"} to /webhook/payments/mock,
+// signed with X-Mock-Signature (hex HMAC-SHA256 of the body) if a secret is configured.
+type MockPaymentProvider struct {
+	secret string
+}
+
+func NewMockPaymentProvider(cfg *config.Config) *MockPaymentProvider {
+	return &MockPaymentProvider{secret: cfg.Payments.Mock.Secret}
+}
+
+func (p *MockPaymentProvider) Name() string {
+	return ProviderMock
+}
+
+func (p *MockPaymentProvider) CreateInvoice(payment *models.Payment) (*Invoice, error) {
+	return &Invoice{
+		Link:       fmt.Sprintf("mock://invoice/%s", payment.Payload),
+		Currency:   "XTR",
+		Amount:     strconv.FormatInt(payment.Amount, 10),
+		ExternalID: payment.ID.String(),
+	}, nil
+}
+
+func (p *MockPaymentProvider) VerifyWebhook(header http.Header, body []byte) (*PaymentEvent, error) {
+	if p.secret != "" {
+		mac := hmac.New(sha256.New, []byte(p.secret))
+		mac.Write(body)
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(header.Get("X-Mock-Signature"))) {
+			return nil, fmt.Errorf("invalid webhook signature")
+		}
+	}
+
+	var event struct {
+		Payload string `json:"payload"`
+		Status  string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook: %w", err)
+	}
+
+	return &PaymentEvent{
+		Payload: event.Payload,
+		Paid:    event.Status == "paid",
+	}, nil
+}
+
+func (p *MockPaymentProvider) Refund(payment *models.Payment) error {
+	log.Info().Str("payment_id", payment.ID.String()).Msg("Mock payment refunded")
+	return nil
+}
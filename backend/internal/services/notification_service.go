@@ -0,0 +1,59 @@
+package services
+
+import (
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+// NotificationService delivers user notifications to open WebSocket sessions and Telegram
+type NotificationService struct {
+	db              *database.DB
+	config          *config.Config
+	queue           queue.TaskQueue
+	telegramService *TelegramService
+}
+
+func NewNotificationService(db *database.DB, config *config.Config, q queue.TaskQueue, telegramService *TelegramService) *NotificationService {
+	return &NotificationService{
+		db:              db,
+		config:          config,
+		queue:           q,
+		telegramService: telegramService,
+	}
+}
+
+// Notify publishes the event to the user's WebSocket sessions and, when text is set,
+// sends it as a Telegram message
+func (s *NotificationService) Notify(userID uuid.UUID, event, text string, data map[string]interface{}) {
+	if s.queue != nil {
+		payload := map[string]interface{}{
+			"event": event,
+		}
+		if text != "" {
+			payload["message"] = text
+		}
+		for key, value := range data {
+			payload[key] = value
+		}
+
+		if err := s.queue.PublishTask(queue.WebSocketEvent(userID, event, payload)); err != nil {
+			log.Error().Err(err).Str("user_id", userID.String()).Str("event", event).Msg("Failed to publish WebSocket notification")
+		}
+	}
+
+	if text == "" || s.telegramService == nil {
+		return
+	}
+
+	var user models.User
+	if err := s.db.Select("telegram_id").First(&user, "id = ?", userID).Error; err != nil {
+		log.Error().Err(err).Str("user_id", userID.String()).Msg("Failed to load user for notification")
+		return
+	}
+	s.telegramService.SendTelegramMessage(s.db, s.config, user.TelegramID, text)
+}
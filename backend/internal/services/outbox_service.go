@@ -0,0 +1,142 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+// EnqueueTask saves a task to the outbox. Call it with the transaction of the change
+// the task belongs to, so the task exists only if the change was committed.
+func EnqueueTask(tx *gorm.DB, task queue.Task) error {
+	if task.ID == uuid.Nil {
+		task.ID = uuid.New()
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task: %w", err)
+	}
+
+	if err := tx.Create(&models.OutboxMessage{
+		ID:       task.ID,
+		TaskType: task.Type,
+		Payload:  string(payload),
+	}).Error; err != nil {
+		return fmt.Errorf("failed to save task to outbox: %w", err)
+	}
+	return nil
+}
+
+// OutboxService relays outbox rows to RabbitMQ
+type OutboxService struct {
+	db     *database.DB
+	config *config.Config
+	queue  queue.TaskQueue
+}
+
+func NewOutboxService(db *database.DB, cfg *config.Config, q queue.TaskQueue) *OutboxService {
+	return &OutboxService{
+		db:     db,
+		config: cfg,
+		queue:  q,
+	}
+}
+
+// Relay publishes unsent outbox rows in creation order with publisher confirms and
+// marks them sent. Rows are locked with SKIP LOCKED so several workers can relay at once.
+// A failed publish stops the batch, the rest is retried on the next run.
+func (s *OutboxService) Relay() {
+	batchSize := s.config.Worker.OutboxBatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	sent := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var messages []models.OutboxMessage
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent_at IS NULL").
+			Order("created_at").
+			Limit(batchSize).
+			Find(&messages).Error; err != nil {
+			return fmt.Errorf("failed to load outbox: %w", err)
+		}
+
+		for i := range messages {
+			message := &messages[i]
+
+			var task queue.Task
+			if err := json.Unmarshal([]byte(message.Payload), &task); err != nil {
+				log.Error().Err(err).Str("outbox_id", message.ID.String()).Msg("Invalid outbox payload")
+				if err := s.markFailed(tx, message, err, true); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if task.ID == uuid.Nil {
+				task.ID = message.ID
+			}
+			if err := s.queue.PublishTask(task); err != nil {
+				log.Warn().Err(err).Str("outbox_id", message.ID.String()).Str("type", task.Type).Msg("Failed to relay outbox task")
+				return s.markFailed(tx, message, err, false)
+			}
+
+			now := time.Now()
+			if err := tx.Model(message).Update("sent_at", now).Error; err != nil {
+				return fmt.Errorf("failed to mark outbox task sent: %w", err)
+			}
+			sent++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to relay outbox")
+	}
+	if sent > 0 {
+		log.Debug().Int("sent", sent).Msg("Outbox tasks relayed")
+	}
+
+	s.prune()
+}
+
+// markFailed records a failed publish. A payload that can never be published is
+// also marked sent so it doesn't block the relay.
+func (s *OutboxService) markFailed(tx *gorm.DB, message *models.OutboxMessage, cause error, permanent bool) error {
+	updates := map[string]interface{}{
+		"attempts":   gorm.Expr("attempts + 1"),
+		"last_error": cause.Error(),
+	}
+	if permanent {
+		updates["sent_at"] = time.Now()
+	}
+
+	if err := tx.Model(message).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to record outbox failure: %w", err)
+	}
+	return nil
+}
+
+// prune deletes sent rows older than the retention
+func (s *OutboxService) prune() {
+	retention := s.config.Worker.OutboxRetention
+	if retention <= 0 {
+		return
+	}
+
+	if err := s.db.Where("sent_at IS NOT NULL AND sent_at < ?", time.Now().Add(-retention)).
+		Delete(&models.OutboxMessage{}).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to prune outbox")
+	}
+}
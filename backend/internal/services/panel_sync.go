@@ -0,0 +1,245 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/services/xray"
+)
+
+const (
+	InboundSyncCreate    = "create"
+	InboundSyncUpdate    = "update"
+	InboundSyncUnchanged = "unchanged"
+)
+
+// InboundSync compares a panel inbound with the servers that use it
+type InboundSync struct {
+	InboundID int          `json:"inbound_id"`
+	Remark    string       `json:"remark"`
+	Protocol  string       `json:"protocol"`
+	Port      int          `json:"port"`
+	Transport string       `json:"transport"`
+	Enable    bool         `json:"enable"`
+	Action    string       `json:"action"` // create, update, unchanged
+	Servers   []ServerDiff `json:"servers,omitempty"`
+}
+
+// ServerDiff lists the fields of a server that differ from its inbound
+type ServerDiff struct {
+	ServerID   uuid.UUID `json:"server_id"`
+	ServerName string    `json:"server_name"`
+	Changes    []string  `json:"changes,omitempty"`
+}
+
+// PanelSync is the result of comparing a panel's inbounds with its servers
+type PanelSync struct {
+	PanelID     uuid.UUID       `json:"panel_id"`
+	DefaultHost string          `json:"default_host"` // host of the panel URL, used for new servers
+	Inbounds    []InboundSync   `json:"inbounds"`
+	Missing     []models.Server `json:"missing"` // servers whose inbound no longer exists
+	Created     []models.Server `json:"created,omitempty"`
+}
+
+// ServerImport creates a server for a panel inbound. Name defaults to the inbound
+// remark and Host to the panel host.
+type ServerImport struct {
+	InboundID int    `json:"inbound_id" binding:"required"`
+	Name      string `json:"name"`
+	Country   string `json:"country" binding:"required"`
+	Flag      string `json:"flag" binding:"required"`
+	Host      string `json:"host"`
+}
+
+// SyncPlan lists the panel inbounds and how they map to servers without changing anything
+func (s *XrayPanelService) SyncPlan(panelID uuid.UUID) (*PanelSync, error) {
+	sync, _, err := s.syncPlan(panelID)
+	return sync, err
+}
+
+// ApplySync updates protocol, port and transport of existing servers from their inbounds,
+// flags servers whose inbound is gone and creates servers for the imported inbounds
+func (s *XrayPanelService) ApplySync(panelID uuid.UUID, imports []ServerImport) (*PanelSync, error) {
+	sync, inbounds, err := s.syncPlan(panelID)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*InboundSync, len(sync.Inbounds))
+	for i := range sync.Inbounds {
+		byID[sync.Inbounds[i].InboundID] = &sync.Inbounds[i]
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, inbound := range sync.Inbounds {
+			for _, diff := range inbound.Servers {
+				if len(diff.Changes) == 0 {
+					continue
+				}
+				if err := tx.Model(&models.Server{}).Where("id = ?", diff.ServerID).Updates(map[string]interface{}{
+					"protocol":        inbound.Protocol,
+					"port":            inbound.Port,
+					"transport":       inbound.Transport,
+					"inbound_missing": false,
+				}).Error; err != nil {
+					return fmt.Errorf("failed to update server %s: %w", diff.ServerName, err)
+				}
+			}
+		}
+
+		for _, server := range sync.Missing {
+			if err := tx.Model(&models.Server{}).Where("id = ?", server.ID).Update("inbound_missing", true).Error; err != nil {
+				return fmt.Errorf("failed to flag server %s: %w", server.Name, err)
+			}
+		}
+
+		for _, imp := range imports {
+			inbound, ok := byID[imp.InboundID]
+			if !ok {
+				return fmt.Errorf("inbound %d not found on the panel", imp.InboundID)
+			}
+			if inbound.Action != InboundSyncCreate {
+				return fmt.Errorf("inbound %d already has a server", imp.InboundID)
+			}
+
+			server := models.Server{
+				Name:           imp.Name,
+				Country:        imp.Country,
+				Flag:           imp.Flag,
+				Host:           imp.Host,
+				Port:           inbound.Port,
+				Protocol:       inbound.Protocol,
+				Transport:      inbound.Transport,
+				Status:         ServerStatusOnline,
+				XrayPanelID:    panelID,
+				InboundID:      inbound.InboundID,
+				MaxConnections: 1000,
+				IsActive:       true,
+			}
+			if server.Name == "" {
+				server.Name = inbounds[imp.InboundID].Remark
+			}
+			if server.Name == "" {
+				server.Name = fmt.Sprintf("%s-%d", sync.DefaultHost, imp.InboundID)
+			}
+			if server.Host == "" {
+				server.Host = sync.DefaultHost
+			}
+
+			if err := tx.Create(&server).Error; err != nil {
+				return fmt.Errorf("failed to create server for inbound %d: %w", imp.InboundID, err)
+			}
+			sync.Created = append(sync.Created, server)
+			inbound.Action = InboundSyncUnchanged
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("panel_id", panelID.String()).
+		Int("created", len(sync.Created)).
+		Int("missing", len(sync.Missing)).
+		Msg("Servers synced from panel")
+
+	return sync, nil
+}
+
+func (s *XrayPanelService) syncPlan(panelID uuid.UUID) (*PanelSync, map[int]xray.XrayInbound, error) {
+	var panel models.XrayPanel
+	if err := s.db.First(&panel, "id = ?", panelID).Error; err != nil {
+		return nil, nil, fmt.Errorf("panel not found: %w", err)
+	}
+
+	client, err := s.NewClient(&panel)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := client.ListInbounds()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var servers []models.Server
+	if err := s.db.Where("xray_panel_id = ?", panelID).Order("name").Find(&servers).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to load panel servers: %w", err)
+	}
+
+	sync := &PanelSync{
+		PanelID:  panelID,
+		Inbounds: make([]InboundSync, 0, len(list)),
+		Missing:  []models.Server{},
+	}
+	if u, err := url.Parse(panel.URL); err == nil {
+		sync.DefaultHost = u.Hostname()
+	}
+
+	inbounds := make(map[int]xray.XrayInbound, len(list))
+	for _, inbound := range list {
+		inbounds[inbound.ID] = inbound
+	}
+
+	// Servers without an inbound use the panel default, as in ClientForServer
+	serversByInbound := make(map[int][]models.Server)
+	for _, server := range servers {
+		inboundID := server.InboundID
+		if inboundID == 0 {
+			inboundID = panel.InboundID
+		}
+		if inboundID == 0 {
+			inboundID = 1
+		}
+		if _, ok := inbounds[inboundID]; !ok {
+			sync.Missing = append(sync.Missing, server)
+			continue
+		}
+		serversByInbound[inboundID] = append(serversByInbound[inboundID], server)
+	}
+
+	for _, inbound := range list {
+		item := InboundSync{
+			InboundID: inbound.ID,
+			Remark:    inbound.Remark,
+			Protocol:  inbound.Protocol,
+			Port:      inbound.Port,
+			Transport: inbound.Network(),
+			Enable:    inbound.Enable,
+			Action:    InboundSyncCreate,
+		}
+
+		if matched := serversByInbound[inbound.ID]; len(matched) > 0 {
+			item.Action = InboundSyncUnchanged
+			for _, server := range matched {
+				diff := ServerDiff{ServerID: server.ID, ServerName: server.Name}
+				if server.Protocol != item.Protocol {
+					diff.Changes = append(diff.Changes, fmt.Sprintf("protocol: %s -> %s", server.Protocol, item.Protocol))
+				}
+				if server.Port != item.Port {
+					diff.Changes = append(diff.Changes, fmt.Sprintf("port: %d -> %d", server.Port, item.Port))
+				}
+				if server.Transport != item.Transport {
+					diff.Changes = append(diff.Changes, fmt.Sprintf("transport: %s -> %s", server.Transport, item.Transport))
+				}
+				if server.InboundMissing {
+					diff.Changes = append(diff.Changes, "inbound is back")
+				}
+				if len(diff.Changes) > 0 {
+					item.Action = InboundSyncUpdate
+				}
+				item.Servers = append(item.Servers, diff)
+			}
+		}
+
+		sync.Inbounds = append(sync.Inbounds, item)
+	}
+
+	return sync, inbounds, nil
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"net/http"
+
+	"xray-vpn-connect/internal/models"
+)
+
+const (
+	ProviderTelegramStars = "telegram_stars"
+	ProviderCryptoPay     = "cryptopay"
+	ProviderMock          = "mock"
+)
+
+// PaymentProvider is a payment backend able to top up user balance
+type PaymentProvider interface {
+	// Name returns the identifier stored in Payment.Provider
+	Name() string
+	// CreateInvoice issues an invoice for a pending payment
+	CreateInvoice(payment *models.Payment) (*Invoice, error)
+	// VerifyWebhook checks the webhook signature and extracts the payment event
+	VerifyWebhook(header http.Header, body []byte) (*PaymentEvent, error)
+	// Refund returns a completed payment to the user
+	Refund(payment *models.Payment) error
+}
+
+// Invoice is returned by a provider for a newly created payment
+type Invoice struct {
+	Link       string
+	Currency   string
+	Amount     string // amount in Currency the user pays
+	ExternalID string
+}
+
+// PaymentEvent is a verified payment notification from a provider
+type PaymentEvent struct {
+	Payload    string
+	ExternalID string
+	Paid       bool
+}
@@ -3,38 +3,82 @@ package services
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"xray-vpn-connect/internal/config"
 	"xray-vpn-connect/internal/database"
 	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
 )
 
 type PaymentService struct {
 	db              *database.DB
 	config          *config.Config
-	telegramService *TelegramService
+	referralService *ReferralService
+	providers       map[string]PaymentProvider
 }
 
-func NewPaymentService(db *database.DB, config *config.Config, telegramService *TelegramService) *PaymentService {
-	return &PaymentService{
+func NewPaymentService(db *database.DB, config *config.Config, referralService *ReferralService, providers ...PaymentProvider) *PaymentService {
+	s := &PaymentService{
 		db:              db,
 		config:          config,
-		telegramService: telegramService,
+		referralService: referralService,
+		providers:       make(map[string]PaymentProvider),
+	}
+	for _, provider := range providers {
+		s.providers[provider.Name()] = provider
+	}
+	return s
+}
+
+// Provider returns a registered payment provider by name
+func (s *PaymentService) Provider(name string) (PaymentProvider, error) {
+	provider, ok := s.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("payment provider %q is not available", name)
 	}
+	return provider, nil
 }
 
-// CreatePayment creates a new payment record and returns an invoice link
-func (s *PaymentService) CreatePayment(userID uuid.UUID, telegramID int64, amount int64) (*models.Payment, error) {
+// ProviderNames returns names of all registered providers
+func (s *PaymentService) ProviderNames() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultProvider returns the provider name used when the client doesn't choose one
+func (s *PaymentService) DefaultProvider() string {
+	if s.config.Payments.DefaultProvider != "" {
+		return s.config.Payments.DefaultProvider
+	}
+	return ProviderTelegramStars
+}
+
+// CreatePayment creates a new payment record and returns it with an invoice link
+func (s *PaymentService) CreatePayment(providerName string, userID uuid.UUID, telegramID int64, amount int64) (*models.Payment, error) {
+	provider, err := s.Provider(providerName)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create payment record
 	payment := &models.Payment{
 		UserID:     userID,
 		TelegramID: telegramID,
 		Amount:     amount,
+		Provider:   provider.Name(),
 		Status:     "pending",
-		Payload:    fmt.Sprintf("stars_payment_%s", uuid.New().String()),
+		Payload:    fmt.Sprintf("%s_payment_%s", provider.Name(), uuid.New().String()),
 	}
 
 	// Save payment to database
@@ -42,17 +86,20 @@ func (s *PaymentService) CreatePayment(userID uuid.UUID, telegramID int64, amoun
 		return nil, fmt.Errorf("failed to create payment record: %w", err)
 	}
 
-	// Create invoice link
-	invoiceLink, err := s.telegramService.CreateInvoiceLink(telegramID, amount, payment.Payload)
+	// Create invoice
+	invoice, err := provider.CreateInvoice(payment)
 	if err != nil {
 		// Update payment status to failed
 		payment.Status = "failed"
 		s.db.Save(payment)
-		return nil, fmt.Errorf("failed to create invoice link: %w", err)
+		return nil, fmt.Errorf("failed to create invoice: %w", err)
 	}
 
-	// Update payment with invoice link
-	payment.InvoiceLink = invoiceLink
+	// Update payment with invoice details
+	payment.InvoiceLink = invoice.Link
+	payment.Currency = invoice.Currency
+	payment.InvoiceAmount = invoice.Amount
+	payment.ExternalID = invoice.ExternalID
 	if err := s.db.Save(payment).Error; err != nil {
 		log.Warn().Err(err).Msg("Failed to update payment with invoice link")
 	}
@@ -60,32 +107,181 @@ func (s *PaymentService) CreatePayment(userID uuid.UUID, telegramID int64, amoun
 	return payment, nil
 }
 
-// ProcessPaymentWebhook processes incoming payment webhooks from Telegram
-func (s *PaymentService) ProcessPaymentWebhook(payload string, telegramID int64) error {
-	// Find payment by payload
+// HandleWebhook verifies a provider webhook and completes the referenced payment
+func (s *PaymentService) HandleWebhook(providerName string, header http.Header, body []byte) (*models.Payment, error) {
+	provider, err := s.Provider(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := provider.VerifyWebhook(header, body)
+	if err != nil {
+		return nil, fmt.Errorf("webhook verification failed: %w", err)
+	}
+
+	if !event.Paid {
+		log.Debug().Str("provider", providerName).Str("payload", event.Payload).Msg("Ignoring non-payment webhook event")
+		return nil, nil
+	}
+
+	return s.CompletePayment(providerName, event.Payload, event.ExternalID)
+}
+
+// CompletePayment marks a pending payment as completed and credits the user balance.
+// Repeated calls for the same payment are no-ops and return nil payment.
+func (s *PaymentService) CompletePayment(providerName, payload, externalID string) (*models.Payment, error) {
 	var payment models.Payment
-	if err := s.db.Where("payload = ? AND telegram_id = ?", payload, telegramID).First(&payment).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return fmt.Errorf("payment not found for payload: %s", payload)
+	processed := false
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Find payment by payload
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("payload = ? AND provider = ?", payload, providerName).
+			First(&payment).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("payment not found for payload: %s", payload)
+			}
+			return fmt.Errorf("failed to find payment: %w", err)
+		}
+
+		if payment.Status != "pending" {
+			log.Warn().Str("payment_id", payment.ID.String()).Str("status", payment.Status).Msg("Payment already processed")
+			processed = true
+			return nil
 		}
-		return fmt.Errorf("failed to find payment: %w", err)
+
+		// Update payment status to completed
+		payment.Status = "completed"
+		if externalID != "" {
+			payment.ExternalID = externalID
+		}
+		if err := tx.Save(&payment).Error; err != nil {
+			return fmt.Errorf("failed to update payment status: %w", err)
+		}
+
+		// Update user balance
+		if err := tx.Model(&models.User{}).
+			Where("id = ?", payment.UserID).
+			Update("balance", gorm.Expr("balance + ?", payment.Amount)).Error; err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+
+		// Tell the user's open sessions, the event is only sent if the payment commits
+		var user models.User
+		if err := tx.Select("balance").First(&user, "id = ?", payment.UserID).Error; err != nil {
+			return fmt.Errorf("failed to get user balance: %w", err)
+		}
+		if err := EnqueueTask(tx, queue.WebSocketEvent(payment.UserID, EventPaymentCompleted, map[string]interface{}{
+			"payment_id":  payment.ID.String(),
+			"provider":    providerName,
+			"amount":      payment.Amount,
+			"new_balance": user.Balance,
+		})); err != nil {
+			return err
+		}
+
+		// Reward the referrer, a failed reward must not block the payment
+		if s.referralService != nil {
+			tx.SavePoint("referral_reward")
+			if err := s.referralService.RewardFirstPayment(tx, &payment); err != nil {
+				log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to reward referrer")
+				tx.RollbackTo("referral_reward")
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if processed {
+		return nil, nil
 	}
 
-	// Update payment status to completed
-	payment.Status = "completed"
-	if err := s.db.Save(&payment).Error; err != nil {
-		return fmt.Errorf("failed to update payment status: %w", err)
+	log.Info().Str("user_id", payment.UserID.String()).Str("provider", providerName).Int64("amount", payment.Amount).Msg("Payment processed successfully")
+	return &payment, nil
+}
+
+// RefundPayment refunds a completed payment through its provider and deducts the balance.
+// The payment is marked refunding and the stars are deducted before the provider is
+// called, so concurrent refunds of one payment fail and the stars can't be spent meanwhile.
+func (s *PaymentService) RefundPayment(paymentID uuid.UUID) (*models.Payment, error) {
+	var payment models.Payment
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, "id = ?", paymentID).Error; err != nil {
+			return fmt.Errorf("payment not found: %w", err)
+		}
+
+		if payment.Status != "completed" {
+			return fmt.Errorf("only completed payments can be refunded")
+		}
+
+		if _, err := s.Provider(payment.Provider); err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", payment.UserID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		if user.Balance < payment.Amount {
+			return fmt.Errorf("insufficient balance to refund: stars were already spent")
+		}
+
+		payment.Status = "refunding"
+		if err := tx.Save(&payment).Error; err != nil {
+			return fmt.Errorf("failed to update payment status: %w", err)
+		}
+
+		if err := tx.Model(&models.User{}).
+			Where("id = ?", payment.UserID).
+			Update("balance", gorm.Expr("balance - ?", payment.Amount)).Error; err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	provider, _ := s.Provider(payment.Provider)
+	if err := provider.Refund(&payment); err != nil {
+		// Give the stars back, the payment can be refunded again
+		if restoreErr := s.finishRefund(&payment, "completed", payment.Amount); restoreErr != nil {
+			log.Error().Err(restoreErr).Str("payment_id", payment.ID.String()).Msg("Failed to restore payment after refund failure")
+		}
+		return nil, fmt.Errorf("provider refund failed: %w", err)
 	}
 
-	// Update user balance
-	if err := s.db.Model(&models.User{}).
-		Where("id = ?", payment.UserID).
-		Update("balance", gorm.Expr("balance + ?", payment.Amount)).Error; err != nil {
-		return fmt.Errorf("failed to update user balance: %w", err)
+	if err := s.finishRefund(&payment, "refunded", 0); err != nil {
+		return nil, err
 	}
 
-	log.Info().Str("user_id", payment.UserID.String()).Int64("amount", payment.Amount).Msg("Payment processed successfully")
-	return nil
+	log.Info().Str("payment_id", payment.ID.String()).Str("provider", payment.Provider).Msg("Payment refunded")
+	return &payment, nil
+}
+
+// finishRefund moves a refunding payment to status and credits the balance back
+func (s *PaymentService) finishRefund(payment *models.Payment, status string, credit int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(payment).Where("status = ?", "refunding").Update("status", status)
+		if result.Error != nil {
+			return fmt.Errorf("failed to update payment status: %w", result.Error)
+		}
+		if result.RowsAffected == 0 || credit == 0 {
+			return nil
+		}
+
+		if err := tx.Model(&models.User{}).
+			Where("id = ?", payment.UserID).
+			Update("balance", gorm.Expr("balance + ?", credit)).Error; err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+		return nil
+	})
 }
 
 // GetPaymentByPayload retrieves a payment by its payload
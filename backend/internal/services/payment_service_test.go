@@ -0,0 +1,184 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+const testMockSecret = "test-secret"
+
+func testMockConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Payments.Mock.Enabled = true
+	cfg.Payments.Mock.Secret = testMockSecret
+	return cfg
+}
+
+// mockWebhook builds a signed mock provider webhook for a payment payload
+func mockWebhook(t *testing.T, secret, payload, status string) (http.Header, []byte) {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]string{"payload": payload, "status": status})
+	if err != nil {
+		t.Fatalf("marshal webhook: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	header := http.Header{}
+	header.Set("X-Mock-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return header, body
+}
+
+// newTestDB connects to the Postgres database in TEST_DATABASE_URL and migrates it.
+// Tests that need a database are skipped without one.
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	gormDB, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	db := &database.DB{DB: gormDB}
+	if err := db.AutoMigrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestUser creates a user with a zero balance, removed with the test
+func newTestUser(t *testing.T, db *database.DB) *models.User {
+	t.Helper()
+
+	user := &models.User{
+		TelegramID:   time.Now().UnixNano(),
+		FirstName:    "test",
+		ReferralCode: uuid.New().String(),
+	}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Subscription{})
+		db.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Payment{})
+		db.Unscoped().Delete(user)
+	})
+	return user
+}
+
+func balanceOf(t *testing.T, db *database.DB, userID uuid.UUID) int64 {
+	t.Helper()
+
+	var user models.User
+	if err := db.Select("balance").First(&user, "id = ?", userID).Error; err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	return user.Balance
+}
+
+func TestMockProviderVerifyWebhook(t *testing.T) {
+	provider := NewMockPaymentProvider(testMockConfig())
+
+	header, body := mockWebhook(t, testMockSecret, "mock_payment_1", "paid")
+	event, err := provider.VerifyWebhook(header, body)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if !event.Paid || event.Payload != "mock_payment_1" {
+		t.Fatalf("expected a paid event for mock_payment_1, got %+v", event)
+	}
+
+	header, body = mockWebhook(t, "wrong-secret", "mock_payment_1", "paid")
+	if _, err := provider.VerifyWebhook(header, body); err == nil {
+		t.Fatal("expected a forged signature to be rejected")
+	}
+
+	header, body = mockWebhook(t, testMockSecret, "mock_payment_1", "cancelled")
+	event, err = provider.VerifyWebhook(header, body)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if event.Paid {
+		t.Fatal("expected a cancelled event not to be paid")
+	}
+}
+
+func TestMockPaymentActivatesSubscriptionOnce(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testMockConfig()
+	user := newTestUser(t, db)
+
+	plan := &models.Plan{Name: "test", DurationMonths: 1, PriceStars: 100, IsActive: true}
+	if err := db.Create(plan).Error; err != nil {
+		t.Fatalf("create plan: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(plan) })
+
+	payments := NewPaymentService(db, cfg, nil, NewMockPaymentProvider(cfg))
+	subscriptions := NewSubscriptionService(db, cfg, queue.NewMemory(queue.RetryPolicy{}), NewPromoCodeService(db))
+
+	payment, err := payments.CreatePayment(ProviderMock, user.ID, user.TelegramID, plan.PriceStars)
+	if err != nil {
+		t.Fatalf("create payment: %v", err)
+	}
+	if payment.InvoiceLink == "" {
+		t.Fatal("expected an invoice link")
+	}
+
+	header, body := mockWebhook(t, testMockSecret, payment.Payload, "paid")
+	completed, err := payments.HandleWebhook(ProviderMock, header, body)
+	if err != nil {
+		t.Fatalf("webhook: %v", err)
+	}
+	if completed == nil || completed.Status != "completed" {
+		t.Fatalf("expected the payment to complete, got %+v", completed)
+	}
+	if balance := balanceOf(t, db, user.ID); balance != plan.PriceStars {
+		t.Fatalf("expected balance %d, got %d", plan.PriceStars, balance)
+	}
+
+	// A redelivered webhook must not credit the payment again
+	duplicate, err := payments.HandleWebhook(ProviderMock, header, body)
+	if err != nil {
+		t.Fatalf("duplicate webhook: %v", err)
+	}
+	if duplicate != nil {
+		t.Fatalf("expected the duplicate webhook to be ignored, got %+v", duplicate)
+	}
+	if balance := balanceOf(t, db, user.ID); balance != plan.PriceStars {
+		t.Fatalf("duplicate webhook changed the balance to %d", balance)
+	}
+
+	subscription, err := subscriptions.PurchaseSubscription(user.ID, plan.ID, "")
+	if err != nil {
+		t.Fatalf("purchase: %v", err)
+	}
+	if !subscription.IsActive || subscription.ExpiresAt == nil || !subscription.ExpiresAt.After(time.Now()) {
+		t.Fatalf("expected an active subscription, got %+v", subscription)
+	}
+	if balance := balanceOf(t, db, user.ID); balance != 0 {
+		t.Fatalf("expected the purchase to spend the payment, balance %d", balance)
+	}
+}
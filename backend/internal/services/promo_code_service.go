@@ -0,0 +1,282 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+)
+
+const (
+	PromoDiscountPercent = "percent"
+	PromoDiscountFixed   = "fixed"
+)
+
+type PromoCodeService struct {
+	db *database.DB
+}
+
+func NewPromoCodeService(db *database.DB) *PromoCodeService {
+	return &PromoCodeService{db: db}
+}
+
+// PromoQuote is the result of applying a promo code to a plan
+type PromoQuote struct {
+	PromoCode *models.PromoCode `json:"-"`
+	Code      string            `json:"code"`
+	BasePrice int64             `json:"base_price"`
+	Discount  int64             `json:"discount"`
+	Price     int64             `json:"price"`
+	BonusDays int               `json:"bonus_days"`
+}
+
+// PromoCodeStats is a redemption summary for a promo code
+type PromoCodeStats struct {
+	PromoCode         models.PromoCode         `json:"promo_code"`
+	Redemptions       int64                    `json:"redemptions"`
+	UniqueUsers       int64                    `json:"unique_users"`
+	TotalDiscount     int64                    `json:"total_discount"`
+	TotalBonusDays    int64                    `json:"total_bonus_days"`
+	ByPlan            []PromoPlanStats         `json:"by_plan"`
+	RecentRedemptions []models.PromoRedemption `json:"recent_redemptions"`
+}
+
+type PromoPlanStats struct {
+	PlanID        uuid.UUID `json:"plan_id"`
+	PlanName      string    `json:"plan_name"`
+	Redemptions   int64     `json:"redemptions"`
+	TotalDiscount int64     `json:"total_discount"`
+}
+
+// NormalizePromoCode makes codes case-insensitive
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ValidatePromoCode checks admin input before saving
+func ValidatePromoCode(promo *models.PromoCode) error {
+	if promo.Code == "" {
+		return fmt.Errorf("code is required")
+	}
+
+	switch promo.DiscountType {
+	case PromoDiscountPercent:
+		if promo.DiscountValue < 0 || promo.DiscountValue > 100 {
+			return fmt.Errorf("percent discount must be between 0 and 100")
+		}
+	case PromoDiscountFixed:
+		if promo.DiscountValue < 0 {
+			return fmt.Errorf("fixed discount cannot be negative")
+		}
+	default:
+		return fmt.Errorf("discount type must be %q or %q", PromoDiscountPercent, PromoDiscountFixed)
+	}
+
+	if promo.DiscountValue == 0 && promo.BonusDays <= 0 {
+		return fmt.Errorf("promo code must give a discount or bonus days")
+	}
+
+	if promo.ValidFrom != nil && promo.ValidUntil != nil && promo.ValidUntil.Before(*promo.ValidFrom) {
+		return fmt.Errorf("valid_until must be after valid_from")
+	}
+
+	return nil
+}
+
+// Quote validates a promo code for the user and plan and calculates the final price.
+// The promo code row is locked when tx is a transaction.
+func (s *PromoCodeService) Quote(tx *gorm.DB, code string, userID uuid.UUID, plan *models.Plan) (*PromoQuote, error) {
+	var promo models.PromoCode
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("code = ? AND is_active = ?", NormalizePromoCode(code), true).
+		First(&promo).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("invalid promo code")
+		}
+		return nil, fmt.Errorf("failed to find promo code: %w", err)
+	}
+
+	now := time.Now()
+	if promo.ValidFrom != nil && now.Before(*promo.ValidFrom) {
+		return nil, fmt.Errorf("promo code is not active yet")
+	}
+	if promo.ValidUntil != nil && now.After(*promo.ValidUntil) {
+		return nil, fmt.Errorf("promo code has expired")
+	}
+
+	if promo.MaxRedemptions > 0 && promo.RedemptionCount >= promo.MaxRedemptions {
+		return nil, fmt.Errorf("promo code redemption limit reached")
+	}
+
+	if promo.PerUserLimit > 0 {
+		var used int64
+		if err := tx.Model(&models.PromoRedemption{}).
+			Where("promo_code_id = ? AND user_id = ?", promo.ID, userID).
+			Count(&used).Error; err != nil {
+			return nil, fmt.Errorf("failed to count redemptions: %w", err)
+		}
+		if used >= int64(promo.PerUserLimit) {
+			return nil, fmt.Errorf("you have already used this promo code")
+		}
+	}
+
+	// Check plan allow-list, empty list means any plan
+	var planIDs []uuid.UUID
+	if err := tx.Table("promo_code_plans").
+		Where("promo_code_id = ?", promo.ID).
+		Pluck("plan_id", &planIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load promo code plans: %w", err)
+	}
+	if len(planIDs) > 0 {
+		allowed := false
+		for _, id := range planIDs {
+			if id == plan.ID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("promo code is not valid for this plan")
+		}
+	}
+
+	var discount int64
+	switch promo.DiscountType {
+	case PromoDiscountPercent:
+		discount = plan.PriceStars * promo.DiscountValue / 100
+	case PromoDiscountFixed:
+		discount = promo.DiscountValue
+	}
+	if discount > plan.PriceStars {
+		discount = plan.PriceStars
+	}
+
+	return &PromoQuote{
+		PromoCode: &promo,
+		Code:      promo.Code,
+		BasePrice: plan.PriceStars,
+		Discount:  discount,
+		Price:     plan.PriceStars - discount,
+		BonusDays: promo.BonusDays,
+	}, nil
+}
+
+// Redeem records the promo code use, must run in the purchase transaction
+func (s *PromoCodeService) Redeem(tx *gorm.DB, quote *PromoQuote, userID, planID, subscriptionID uuid.UUID) error {
+	redemption := models.PromoRedemption{
+		PromoCodeID:    quote.PromoCode.ID,
+		UserID:         userID,
+		PlanID:         planID,
+		SubscriptionID: subscriptionID,
+		DiscountStars:  quote.Discount,
+		BonusDays:      quote.BonusDays,
+	}
+	if err := tx.Create(&redemption).Error; err != nil {
+		return fmt.Errorf("failed to record promo redemption: %w", err)
+	}
+
+	if err := tx.Model(&models.PromoCode{}).
+		Where("id = ?", quote.PromoCode.ID).
+		Update("redemption_count", gorm.Expr("redemption_count + 1")).Error; err != nil {
+		return fmt.Errorf("failed to update promo redemption count: %w", err)
+	}
+
+	return nil
+}
+
+// ListPromoCodes returns all promo codes with their allowed plans
+func (s *PromoCodeService) ListPromoCodes() ([]models.PromoCode, error) {
+	var promos []models.PromoCode
+	if err := s.db.Preload("Plans").Order("created_at DESC").Find(&promos).Error; err != nil {
+		return nil, err
+	}
+	return promos, nil
+}
+
+// GetPromoCode returns a promo code by ID
+func (s *PromoCodeService) GetPromoCode(promoID uuid.UUID) (*models.PromoCode, error) {
+	var promo models.PromoCode
+	if err := s.db.Preload("Plans").First(&promo, "id = ?", promoID).Error; err != nil {
+		return nil, err
+	}
+	return &promo, nil
+}
+
+// SavePromoCode creates or updates a promo code and replaces its plan allow-list
+func (s *PromoCodeService) SavePromoCode(promo *models.PromoCode, planIDs []uuid.UUID) error {
+	promo.Code = NormalizePromoCode(promo.Code)
+	if err := ValidatePromoCode(promo); err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var plans []models.Plan
+		if len(planIDs) > 0 {
+			if err := tx.Where("id IN ?", planIDs).Find(&plans).Error; err != nil {
+				return fmt.Errorf("failed to load plans: %w", err)
+			}
+			if len(plans) != len(planIDs) {
+				return fmt.Errorf("some plans do not exist")
+			}
+		}
+
+		if err := tx.Omit("Plans").Save(promo).Error; err != nil {
+			return fmt.Errorf("failed to save promo code: %w", err)
+		}
+
+		if err := tx.Model(promo).Association("Plans").Replace(plans); err != nil {
+			return fmt.Errorf("failed to save promo code plans: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// DeletePromoCode soft deletes a promo code
+func (s *PromoCodeService) DeletePromoCode(promoID uuid.UUID) error {
+	return s.db.Delete(&models.PromoCode{}, "id = ?", promoID).Error
+}
+
+// GetPromoCodeStats returns redemption statistics for a promo code
+func (s *PromoCodeService) GetPromoCodeStats(promoID uuid.UUID) (*PromoCodeStats, error) {
+	promo, err := s.GetPromoCode(promoID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &PromoCodeStats{PromoCode: *promo}
+
+	row := s.db.Model(&models.PromoRedemption{}).
+		Where("promo_code_id = ?", promoID).
+		Select("COUNT(*), COUNT(DISTINCT user_id), COALESCE(SUM(discount_stars), 0), COALESCE(SUM(bonus_days), 0)").
+		Row()
+	if err := row.Scan(&stats.Redemptions, &stats.UniqueUsers, &stats.TotalDiscount, &stats.TotalBonusDays); err != nil {
+		return nil, fmt.Errorf("failed to aggregate redemptions: %w", err)
+	}
+
+	if err := s.db.Table("promo_redemptions").
+		Joins("JOIN plans ON promo_redemptions.plan_id = plans.id").
+		Where("promo_redemptions.promo_code_id = ?", promoID).
+		Group("plans.id, plans.name").
+		Select("plans.id AS plan_id, plans.name AS plan_name, COUNT(*) AS redemptions, COALESCE(SUM(promo_redemptions.discount_stars), 0) AS total_discount").
+		Scan(&stats.ByPlan).Error; err != nil {
+		return nil, fmt.Errorf("failed to aggregate redemptions by plan: %w", err)
+	}
+
+	if err := s.db.Preload("User").Preload("Plan").
+		Where("promo_code_id = ?", promoID).
+		Order("created_at DESC").
+		Limit(50).
+		Find(&stats.RecentRedemptions).Error; err != nil {
+		return nil, fmt.Errorf("failed to load redemptions: %w", err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,339 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+	"xray-vpn-connect/internal/services/xray"
+)
+
+const (
+	ReconcileCreate  = "create"
+	ReconcileDelete  = "delete"
+	ReconcileDisable = "disable"
+	ReconcileEnable  = "enable"
+)
+
+// ErrReconcileRunning is returned when another process is fixing the panels
+var ErrReconcileRunning = errors.New("reconciliation is already running")
+
+// ReconcileService brings panel clients in line with the connections in the database.
+// Clients are matched by the user_<user_id>_<connection_id> email, clients with other
+// emails were added by hand and are never touched. Fixes are queued as connection
+// tasks, so they never race the worker writing the same inbound.
+type ReconcileService struct {
+	db           *database.DB
+	panelService *XrayPanelService
+}
+
+func NewReconcileService(db *database.DB, panelService *XrayPanelService) *ReconcileService {
+	return &ReconcileService{
+		db:           db,
+		panelService: panelService,
+	}
+}
+
+// ReconcileAction is one difference between a panel inbound and the database
+type ReconcileAction struct {
+	Action       string     `json:"action"` // create, delete, disable, enable
+	ServerID     uuid.UUID  `json:"server_id"`
+	ServerName   string     `json:"server_name"`
+	InboundID    int        `json:"inbound_id"`
+	Email        string     `json:"email"`
+	ConnectionID *uuid.UUID `json:"connection_id,omitempty"`
+	Reason       string     `json:"reason"`
+	Applied      bool       `json:"applied"` // the fix was queued
+	Error        string     `json:"error,omitempty"`
+}
+
+// ReconcileReport is the result of a reconciliation run
+type ReconcileReport struct {
+	DryRun    bool              `json:"dry_run"`
+	Actions   []ReconcileAction `json:"actions"`
+	Unmanaged int               `json:"unmanaged"` // clients not following the email convention
+	Errors    []string          `json:"errors,omitempty"`
+	StartedAt time.Time         `json:"started_at"`
+}
+
+// reconcileInbound is a panel inbound and the servers that use it
+type reconcileInbound struct {
+	client    *xray.Client
+	inboundID int
+	servers   []models.Server
+}
+
+// Reconcile compares every inbound used by an active server with the database.
+// With dryRun the differences are only reported. Fixing runs are serialized across
+// API and worker processes, a run started while another one fixes the panels fails.
+func (s *ReconcileService) Reconcile(dryRun bool) (*ReconcileReport, error) {
+	if dryRun {
+		return s.reconcile(dryRun)
+	}
+
+	var report *ReconcileReport
+	var err error
+	ran, lockErr := RunExclusive(s.db, "reconcile", func() {
+		report, err = s.reconcile(dryRun)
+	})
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	if !ran {
+		return nil, ErrReconcileRunning
+	}
+	return report, err
+}
+
+func (s *ReconcileService) reconcile(dryRun bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{
+		DryRun:    dryRun,
+		Actions:   []ReconcileAction{},
+		StartedAt: time.Now(),
+	}
+
+	var servers []models.Server
+	if err := s.db.Where("is_active = ?", true).Find(&servers).Error; err != nil {
+		return nil, fmt.Errorf("failed to load servers: %w", err)
+	}
+
+	// Several servers can share an inbound, each inbound is compared once
+	inbounds := make(map[string]*reconcileInbound)
+	order := make([]string, 0, len(servers))
+	for i := range servers {
+		client, inboundID, err := s.panelService.ClientForServer(&servers[i])
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", servers[i].Name, err))
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", servers[i].XrayPanelID, inboundID)
+		if _, ok := inbounds[key]; !ok {
+			inbounds[key] = &reconcileInbound{client: client, inboundID: inboundID}
+			order = append(order, key)
+		}
+		inbounds[key].servers = append(inbounds[key].servers, servers[i])
+	}
+
+	subscriptions := make(map[uuid.UUID]bool)
+	for _, key := range order {
+		if err := s.reconcileInbound(inbounds[key], subscriptions, report); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", inbounds[key].servers[0].Name, err))
+		}
+	}
+
+	log.Info().
+		Bool("dry_run", dryRun).
+		Int("actions", len(report.Actions)).
+		Int("errors", len(report.Errors)).
+		Msg("Panel reconciliation finished")
+
+	return report, nil
+}
+
+func (s *ReconcileService) reconcileInbound(inbound *reconcileInbound, subscriptions map[uuid.UUID]bool, report *ReconcileReport) error {
+	xrayInbound, err := inbound.client.GetInbound(inbound.inboundID)
+	if err != nil {
+		return fmt.Errorf("failed to get inbound %d: %w", inbound.inboundID, err)
+	}
+
+	serverIDs := make([]uuid.UUID, 0, len(inbound.servers))
+	serversByID := make(map[uuid.UUID]*models.Server, len(inbound.servers))
+	for i := range inbound.servers {
+		serverIDs = append(serverIDs, inbound.servers[i].ID)
+		serversByID[inbound.servers[i].ID] = &inbound.servers[i]
+	}
+
+	// Deleted connections are loaded too so their clients can be told apart from unknown ones
+	var connections []models.Connection
+	if err := s.db.Unscoped().Where("server_id IN ?", serverIDs).Find(&connections).Error; err != nil {
+		return fmt.Errorf("failed to load connections: %w", err)
+	}
+	connectionsByID := make(map[uuid.UUID]*models.Connection, len(connections))
+	for i := range connections {
+		connectionsByID[connections[i].ID] = &connections[i]
+	}
+
+	// Servers can share an inbound with inactive servers or servers of other inbound
+	// settings, so clients are looked up by connection ID regardless of their server.
+	// Only clients whose connection is missing or deleted are removed.
+	var otherIDs []uuid.UUID
+	for _, client := range xrayInbound.Clients {
+		if _, connectionID, ok := parseClientEmail(client.Email); ok && connectionsByID[connectionID] == nil {
+			otherIDs = append(otherIDs, connectionID)
+		}
+	}
+	if len(otherIDs) > 0 {
+		var others []models.Connection
+		if err := s.db.Unscoped().Where("id IN ?", otherIDs).Find(&others).Error; err != nil {
+			return fmt.Errorf("failed to load connections: %w", err)
+		}
+		for i := range others {
+			connectionsByID[others[i].ID] = &others[i]
+		}
+	}
+
+	defaultServer := &inbound.servers[0]
+	seen := make(map[uuid.UUID]bool)
+
+	for _, client := range xrayInbound.Clients {
+		_, connectionID, ok := parseClientEmail(client.Email)
+		if !ok {
+			report.Unmanaged++
+			continue
+		}
+		seen[connectionID] = true
+
+		action := ReconcileAction{
+			ServerID:   defaultServer.ID,
+			ServerName: defaultServer.Name,
+			InboundID:  inbound.inboundID,
+			Email:      client.Email,
+		}
+		id := connectionID
+		action.ConnectionID = &id
+
+		connection, ok := connectionsByID[connectionID]
+		switch {
+		case !ok:
+			action.Action = ReconcileDelete
+			action.Reason = "no connection in database"
+		case connection.DeletedAt.Valid:
+			action.Action = ReconcileDelete
+			action.Reason = "connection was deleted"
+		default:
+			// The client of a connection on another inbound is fixed with that inbound
+			server, ok := serversByID[connection.ServerID]
+			if !ok {
+				continue
+			}
+			action.ServerID = server.ID
+			action.ServerName = server.Name
+			reason := s.disableReason(connection, subscriptions)
+			switch {
+			case client.Enable && reason != "":
+				action.Action = ReconcileDisable
+				action.Reason = reason
+			case !client.Enable && reason == "" && connection.ConnectionKey != "":
+				// Disabled by hand or by a lost suspension while the connection is usable
+				action.Action = ReconcileEnable
+				action.Reason = "client disabled in panel"
+			default:
+				continue
+			}
+		}
+
+		s.apply(&action, connectionsByID[connectionID], report.DryRun)
+		report.Actions = append(report.Actions, action)
+	}
+
+	for i := range connections {
+		connection := &connections[i]
+		if seen[connection.ID] || connection.DeletedAt.Valid || !connection.IsActive {
+			continue
+		}
+		if connection.ConnectionKey == "" {
+			// The create task hasn't run yet
+			continue
+		}
+
+		server := serversByID[connection.ServerID]
+		id := connection.ID
+		action := ReconcileAction{
+			Action:       ReconcileCreate,
+			ServerID:     server.ID,
+			ServerName:   server.Name,
+			InboundID:    inbound.inboundID,
+			Email:        XrayClientEmail(connection),
+			ConnectionID: &id,
+			Reason:       "client missing in panel",
+		}
+
+		// The update task re-creates the client, disabled if the connection shouldn't be usable
+		s.apply(&action, connection, report.DryRun)
+		report.Actions = append(report.Actions, action)
+	}
+
+	return nil
+}
+
+// disableReason returns why the client of an existing connection must be disabled, or ""
+func (s *ReconcileService) disableReason(connection *models.Connection, subscriptions map[uuid.UUID]bool) string {
+	if !connection.IsActive {
+		return "connection is inactive"
+	}
+	if connection.SuspendedUntil != nil {
+		return "connection is suspended"
+	}
+
+	usable, ok := subscriptions[connection.UserID]
+	if !ok {
+		subscription, err := EffectiveSubscription(s.db.DB, connection.UserID)
+		if err != nil {
+			log.Warn().Err(err).Str("user_id", connection.UserID.String()).Msg("Failed to get subscription for reconciliation")
+			return ""
+		}
+		usable = subscription != nil && subscription.FrozenAt == nil
+		subscriptions[connection.UserID] = usable
+	}
+	if !usable {
+		return "no usable subscription"
+	}
+	return ""
+}
+
+// apply queues the fix unless dryRun is set. Clients without a live connection are
+// deleted by email, the others are brought in line with their connection by an
+// update task, which adds a missing client and enables or disables it.
+func (s *ReconcileService) apply(action *ReconcileAction, connection *models.Connection, dryRun bool) {
+	if dryRun {
+		return
+	}
+
+	task := queue.Task{
+		Type:     queue.TaskUpdateConnection,
+		ServerID: action.ServerID,
+	}
+	if action.ConnectionID != nil {
+		task.ConnectionID = *action.ConnectionID
+	}
+	if connection != nil {
+		task.UserID = connection.UserID
+	} else if userID, _, ok := parseClientEmail(action.Email); ok {
+		task.UserID = userID
+	}
+	if action.Action == ReconcileDelete {
+		task.Type = queue.TaskDeleteConnection
+		task.Data = map[string]interface{}{"email": action.Email}
+	}
+
+	if err := EnqueueTask(s.db.DB, task); err != nil {
+		action.Error = err.Error()
+		log.Error().Err(err).Str("action", action.Action).Str("email", action.Email).Msg("Failed to queue panel client fix")
+		return
+	}
+	action.Applied = true
+}
+
+// parseClientEmail splits a user_<user_id>_<connection_id> email
+func parseClientEmail(email string) (uuid.UUID, uuid.UUID, bool) {
+	parts := strings.Split(email, "_")
+	if len(parts) != 3 || parts[0] != "user" {
+		return uuid.Nil, uuid.Nil, false
+	}
+	userID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return uuid.Nil, uuid.Nil, false
+	}
+	connectionID, err := uuid.Parse(parts[2])
+	if err != nil {
+		return uuid.Nil, uuid.Nil, false
+	}
+	return userID, connectionID, true
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+)
+
+const (
+	ReferralRewardPercent = "percent"
+	ReferralRewardDays    = "days"
+)
+
+type ReferralService struct {
+	db                  *database.DB
+	config              *config.Config
+	subscriptionService *SubscriptionService
+}
+
+func NewReferralService(db *database.DB, config *config.Config, subscriptionService *SubscriptionService) *ReferralService {
+	return &ReferralService{
+		db:                  db,
+		config:              config,
+		subscriptionService: subscriptionService,
+	}
+}
+
+// RewardFirstPayment credits the referrer when a referred user completes their first payment.
+// Must be called inside the payment transaction, after the payment is marked completed.
+func (s *ReferralService) RewardFirstPayment(tx *gorm.DB, payment *models.Payment) error {
+	var referred models.User
+	if err := tx.First(&referred, "id = ?", payment.UserID).Error; err != nil {
+		return fmt.Errorf("user not found: %w", err)
+	}
+
+	if referred.ReferredBy == nil {
+		return nil
+	}
+
+	// Only the first completed payment is rewarded
+	var previous int64
+	if err := tx.Model(&models.Payment{}).
+		Where("user_id = ? AND status IN ? AND id <> ?", payment.UserID, []string{"completed", "refunding", "refunded"}, payment.ID).
+		Count(&previous).Error; err != nil {
+		return fmt.Errorf("failed to count payments: %w", err)
+	}
+	if previous > 0 {
+		return nil
+	}
+
+	var existing models.ReferralReward
+	err := tx.Where("referred_id = ?", payment.UserID).First(&existing).Error
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to check referral reward: %w", err)
+	}
+
+	reward := models.ReferralReward{
+		ReferrerID: *referred.ReferredBy,
+		ReferredID: referred.ID,
+		PaymentID:  payment.ID,
+		RewardType: s.config.Referral.RewardType,
+	}
+
+	switch reward.RewardType {
+	case ReferralRewardDays:
+		reward.BonusDays = s.config.Referral.RewardDays
+		if reward.BonusDays > 0 {
+			if _, err := s.subscriptionService.AddBonusDays(tx, reward.ReferrerID, reward.BonusDays); err != nil {
+				return fmt.Errorf("failed to add bonus days: %w", err)
+			}
+		}
+	default:
+		reward.RewardType = ReferralRewardPercent
+		reward.Stars = payment.Amount * s.config.Referral.RewardPercent / 100
+		if reward.Stars > 0 {
+			if err := tx.Model(&models.User{}).
+				Where("id = ?", reward.ReferrerID).
+				Update("balance", gorm.Expr("balance + ?", reward.Stars)).Error; err != nil {
+				return fmt.Errorf("failed to credit referrer balance: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Create(&reward).Error; err != nil {
+		return fmt.Errorf("failed to record referral reward: %w", err)
+	}
+
+	// Referrers created before stats were introduced have no row yet
+	if err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"reward_earned":      gorm.Expr("referral_stats.reward_earned + ?", reward.Stars),
+			"reward_days_earned": gorm.Expr("referral_stats.reward_days_earned + ?", reward.BonusDays),
+			"last_updated":       gorm.Expr("NOW()"),
+		}),
+	}).Create(&models.ReferralStats{
+		UserID:           reward.ReferrerID,
+		RewardEarned:     reward.Stars,
+		RewardDaysEarned: reward.BonusDays,
+		LastUpdated:      time.Now(),
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update referral stats: %w", err)
+	}
+
+	log.Info().
+		Str("referrer_id", reward.ReferrerID.String()).
+		Str("referred_id", reward.ReferredID.String()).
+		Str("reward_type", reward.RewardType).
+		Int64("stars", reward.Stars).
+		Int("bonus_days", reward.BonusDays).
+		Msg("Referral reward credited")
+
+	return nil
+}
+
+// GetStats returns persisted referral statistics for the user
+func (s *ReferralService) GetStats(userID uuid.UUID) (*models.ReferralStats, error) {
+	var stats models.ReferralStats
+	err := s.db.Where("user_id = ?", userID).First(&stats).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Users created before stats were introduced
+		stats = models.ReferralStats{UserID: userID}
+		if err := s.db.Create(&stats).Error; err != nil {
+			return nil, fmt.Errorf("failed to create referral stats: %w", err)
+		}
+		return &stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// GetRewards returns the referral reward ledger of the user
+func (s *ReferralService) GetRewards(userID uuid.UUID) ([]models.ReferralReward, error) {
+	var rewards []models.ReferralReward
+	if err := s.db.Preload("Referred").
+		Where("referrer_id = ?", userID).
+		Order("created_at DESC").
+		Find(&rewards).Error; err != nil {
+		return nil, err
+	}
+	return rewards, nil
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/models"
+)
+
+const defaultServerPort = 443
+
+// ProbeServers checks TCP/TLS reachability of every active server and the login of
+// every panel, stores the results in the health history and updates server status
+func (s *ServerService) ProbeServers() {
+	var servers []models.Server
+	if err := s.db.Where("is_active = ?", true).Find(&servers).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load servers for health check")
+		return
+	}
+
+	panelErrors := s.probePanels(servers)
+
+	checks := make([]models.ServerHealthCheck, len(servers))
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			checks[i] = s.probeServer(&servers[i], panelErrors)
+		}(i)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	for i := range servers {
+		server := &servers[i]
+		check := &checks[i]
+
+		failed := 0
+		if !check.Reachable {
+			failed = server.FailedChecks + 1
+		}
+		check.Status = s.healthStatus(server, check, failed)
+
+		updates := map[string]interface{}{
+			"failed_checks":   failed,
+			"last_checked_at": now,
+			"status":          check.Status,
+		}
+		if check.Reachable {
+			updates["latency_ms"] = check.LatencyMs
+		}
+		if err := s.db.Model(server).Updates(updates).Error; err != nil {
+			log.Error().Err(err).Str("server", server.Name).Msg("Failed to update server health")
+			continue
+		}
+
+		if err := s.db.Create(check).Error; err != nil {
+			log.Error().Err(err).Str("server", server.Name).Msg("Failed to record health check")
+		}
+
+		if check.Status != server.Status {
+			log.Info().
+				Str("server", server.Name).
+				Str("from", server.Status).
+				Str("status", check.Status).
+				Str("error", check.Error).
+				Msg("Server status changed")
+		}
+	}
+
+	if s.config.Servers.HealthRetention > 0 {
+		if err := s.db.Where("created_at < ?", now.Add(-s.config.Servers.HealthRetention)).
+			Delete(&models.ServerHealthCheck{}).Error; err != nil {
+			log.Error().Err(err).Msg("Failed to prune health check history")
+		}
+	}
+}
+
+// probePanels logs in to each panel used by the servers once, nil means the login succeeded
+func (s *ServerService) probePanels(servers []models.Server) map[uuid.UUID]error {
+	ids := make([]uuid.UUID, 0, len(servers))
+	for _, server := range servers {
+		if server.XrayPanelID != uuid.Nil {
+			ids = append(ids, server.XrayPanelID)
+		}
+	}
+
+	result := make(map[uuid.UUID]error)
+	if len(ids) == 0 {
+		return result
+	}
+
+	var panels []models.XrayPanel
+	if err := s.db.Where("id IN ?", ids).Find(&panels).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load panels for health check")
+		return result
+	}
+
+	for _, panel := range panels {
+		if !panel.IsActive {
+			result[panel.ID] = fmt.Errorf("panel is disabled")
+			continue
+		}
+		client, err := s.panelService.NewClient(&panel)
+		if err != nil {
+			result[panel.ID] = err
+			continue
+		}
+		if _, err := client.Login(); err != nil {
+			result[panel.ID] = err
+			continue
+		}
+		result[panel.ID] = nil
+	}
+	return result
+}
+
+// probeServer measures the connect time to the server inbound
+func (s *ServerService) probeServer(server *models.Server, panelErrors map[uuid.UUID]error) models.ServerHealthCheck {
+	check := models.ServerHealthCheck{ServerID: server.ID}
+
+	port := server.Port
+	if port == 0 {
+		port = defaultServerPort
+	}
+
+	latency, err := s.probeAddress(server.Host, port)
+	check.LatencyMs = int(latency.Milliseconds())
+	check.Reachable = err == nil
+	if err != nil {
+		check.Error = err.Error()
+	}
+
+	panelErr, ok := panelErrors[server.XrayPanelID]
+	if !ok {
+		panelErr = fmt.Errorf("panel not found")
+	}
+	check.PanelOK = panelErr == nil
+	if panelErr != nil && check.Error == "" {
+		check.Error = fmt.Sprintf("panel: %v", panelErr)
+	}
+
+	return check
+}
+
+// probeAddress opens a TCP connection and optionally completes a TLS handshake.
+// The returned latency is the TCP connect time.
+func (s *ServerService) probeAddress(host string, port int) (time.Duration, error) {
+	timeout := s.config.Servers.ProbeTimeout
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return 0, fmt.Errorf("tcp connect failed: %w", err)
+	}
+	latency := time.Since(start)
+	defer conn.Close()
+
+	if !s.config.Servers.ProbeTLS {
+		return latency, nil
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return latency, fmt.Errorf("failed to set deadline: %w", err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true, // Reality and self-signed inbounds
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return latency, fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	return latency, nil
+}
+
+// healthStatus derives the server status from a probe. Maintenance is set by
+// admins and is kept as is.
+func (s *ServerService) healthStatus(server *models.Server, check *models.ServerHealthCheck, failed int) string {
+	if server.Status == ServerStatusMaintenance {
+		return server.Status
+	}
+
+	if !check.Reachable {
+		if failed >= s.config.Servers.OfflineAfter {
+			return ServerStatusOffline
+		}
+		return ServerStatusDegraded
+	}
+
+	degradedLatency := s.config.Servers.DegradedLatency
+	if !check.PanelOK || (degradedLatency > 0 && time.Duration(check.LatencyMs)*time.Millisecond > degradedLatency) {
+		return ServerStatusDegraded
+	}
+
+	return s.loadStatus(server, server.CurrentLoad)
+}
+
+// Uptime returns the share of successful probes per server since the given time, in percent
+func (s *ServerService) Uptime(since time.Time) (map[uuid.UUID]float64, error) {
+	var rows []struct {
+		ServerID uuid.UUID
+		Uptime   float64
+	}
+	if err := s.db.Model(&models.ServerHealthCheck{}).
+		Select("server_id, AVG(CASE WHEN reachable THEN 100.0 ELSE 0 END) AS uptime").
+		Where("created_at >= ?", since).
+		Group("server_id").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to calculate uptime: %w", err)
+	}
+
+	uptime := make(map[uuid.UUID]float64, len(rows))
+	for _, row := range rows {
+		uptime[row.ServerID] = row.Uptime
+	}
+	return uptime, nil
+}
+
+// HealthHistory returns the health checks of a server since the given time, newest first
+func (s *ServerService) HealthHistory(serverID uuid.UUID, since time.Time) ([]models.ServerHealthCheck, error) {
+	var checks []models.ServerHealthCheck
+	if err := s.db.Where("server_id = ? AND created_at >= ?", serverID, since).
+		Order("created_at DESC").
+		Find(&checks).Error; err != nil {
+		return nil, err
+	}
+	return checks, nil
+}
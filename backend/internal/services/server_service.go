@@ -0,0 +1,173 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+)
+
+const (
+	ServerStatusOnline      = "online"
+	ServerStatusMaintenance = "maintenance"
+	ServerStatusCrowded     = "crowded"
+	ServerStatusDegraded    = "degraded"
+	ServerStatusOffline     = "offline"
+)
+
+type ServerService struct {
+	db           *database.DB
+	config       *config.Config
+	panelService *XrayPanelService
+}
+
+func NewServerService(db *database.DB, config *config.Config, panelService *XrayPanelService) *ServerService {
+	return &ServerService{
+		db:           db,
+		config:       config,
+		panelService: panelService,
+	}
+}
+
+// accessibleServers scopes a query to active servers the user may connect to
+func (s *ServerService) accessibleServers(userID uuid.UUID) *gorm.DB {
+	return s.db.Where("is_active = ? AND (is_user_specific = ? OR id IN (SELECT server_id FROM server_users WHERE user_id = ?))",
+		true, false, userID)
+}
+
+// BestServer returns the least loaded server in the country that accepts new connections
+func (s *ServerService) BestServer(userID uuid.UUID, country string) (*models.Server, error) {
+	var server models.Server
+	if err := s.accessibleServers(userID).
+		Where("LOWER(country) = LOWER(?) AND status IN ?", country, []string{ServerStatusOnline, ServerStatusCrowded}).
+		Where("max_connections = 0 OR current_load < max_connections").
+		Order("CASE WHEN max_connections > 0 THEN current_load::float / max_connections ELSE 0 END ASC").
+		First(&server).Error; err != nil {
+		return nil, fmt.Errorf("no available server in %s: %w", country, err)
+	}
+	return &server, nil
+}
+
+// FailoverCandidates returns healthy servers the user may be moved to from the failed
+// server: same group, or same country when the server has no group, least loaded first
+func (s *ServerService) FailoverCandidates(userID uuid.UUID, failed *models.Server) ([]models.Server, error) {
+	query := s.accessibleServers(userID).
+		Where("id <> ? AND status IN ?", failed.ID, []string{ServerStatusOnline, ServerStatusCrowded}).
+		Where("max_connections = 0 OR current_load < max_connections")
+	if failed.Group != "" {
+		query = query.Where("\"group\" = ?", failed.Group)
+	} else {
+		query = query.Where("LOWER(country) = LOWER(?)", failed.Country)
+	}
+
+	var servers []models.Server
+	if err := query.
+		Order("CASE WHEN max_connections > 0 THEN current_load::float / max_connections ELSE 0 END ASC").
+		Find(&servers).Error; err != nil {
+		return nil, fmt.Errorf("failed to find failover servers: %w", err)
+	}
+	return servers, nil
+}
+
+// RefreshLoad recounts active connections per server, reads online clients from
+// the panels and marks servers crowded or online accordingly
+func (s *ServerService) RefreshLoad() {
+	var servers []models.Server
+	if err := s.db.Where("is_active = ?", true).Find(&servers).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load servers for load refresh")
+		return
+	}
+
+	var connections []models.Connection
+	if err := s.db.Select("id, user_id, server_id").Where("is_active = ?", true).Find(&connections).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load connections for load refresh")
+		return
+	}
+
+	// Online clients, one request per panel. Panels that fail keep the previous numbers.
+	online := make(map[uuid.UUID]map[string]bool)
+	for i := range servers {
+		panelID := servers[i].XrayPanelID
+		if _, ok := online[panelID]; ok {
+			continue
+		}
+		online[panelID] = nil
+
+		client, _, err := s.panelService.ClientForServer(&servers[i])
+		if err != nil {
+			log.Warn().Err(err).Str("server", servers[i].Name).Msg("Failed to get panel for load refresh")
+			continue
+		}
+		emails, err := client.GetOnlineClients()
+		if err != nil {
+			log.Warn().Err(err).Str("server", servers[i].Name).Msg("Failed to get online clients")
+			continue
+		}
+
+		set := make(map[string]bool, len(emails))
+		for _, email := range emails {
+			set[email] = true
+		}
+		online[panelID] = set
+	}
+
+	for i := range servers {
+		server := &servers[i]
+		emails := online[server.XrayPanelID]
+
+		load := 0
+		onlineUsers := 0
+		for j := range connections {
+			if connections[j].ServerID != server.ID {
+				continue
+			}
+			load++
+			if emails[XrayClientEmail(&connections[j])] {
+				onlineUsers++
+			}
+		}
+		if emails == nil {
+			onlineUsers = server.OnlineUsers
+		}
+
+		status := s.statusForLoad(server, load)
+		if load == server.CurrentLoad && onlineUsers == server.OnlineUsers && status == server.Status {
+			continue
+		}
+
+		if err := s.db.Model(server).Updates(map[string]interface{}{
+			"current_load": load,
+			"online_users": onlineUsers,
+			"status":       status,
+		}).Error; err != nil {
+			log.Error().Err(err).Str("server", server.Name).Msg("Failed to update server load")
+			continue
+		}
+
+		if status != server.Status {
+			log.Info().Str("server", server.Name).Str("status", status).Int("load", load).Msg("Server status changed")
+		}
+	}
+}
+
+// statusForLoad switches between online and crowded. Other statuses are set by
+// admins or health checks and are left alone.
+func (s *ServerService) statusForLoad(server *models.Server, load int) string {
+	if server.Status != ServerStatusOnline && server.Status != ServerStatusCrowded {
+		return server.Status
+	}
+	return s.loadStatus(server, load)
+}
+
+// loadStatus is the status of a healthy server with the given load
+func (s *ServerService) loadStatus(server *models.Server, load int) string {
+	if server.MaxConnections > 0 && load*100 >= server.MaxConnections*s.config.Servers.CrowdedPercent {
+		return ServerStatusCrowded
+	}
+	return ServerStatusOnline
+}
@@ -1,30 +1,62 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/base32"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
+	"xray-vpn-connect/internal/config"
 	"xray-vpn-connect/internal/database"
 	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
 )
 
+// ErrPlanMismatch is returned when buying time on a plan other than the active one
+var ErrPlanMismatch = errors.New("you have an active subscription on a different plan, change the plan instead")
+
 type SubscriptionService struct {
-	db *database.DB
+	db           *database.DB
+	config       *config.Config
+	queue        queue.TaskQueue
+	promoService *PromoCodeService
 }
 
-func NewSubscriptionService(db *database.DB) *SubscriptionService {
-	return &SubscriptionService{db: db}
+func NewSubscriptionService(db *database.DB, config *config.Config, q queue.TaskQueue, promoService *PromoCodeService) *SubscriptionService {
+	return &SubscriptionService{
+		db:           db,
+		config:       config,
+		queue:        q,
+		promoService: promoService,
+	}
+}
+
+// PlanChangeQuote is the prorated cost of switching the active subscription to another plan
+type PlanChangeQuote struct {
+	CurrentPlan models.Plan `json:"current_plan"`
+	NewPlan     models.Plan `json:"new_plan"`
+	Credit      int64       `json:"credit"`     // value of the unused time on the current plan
+	Charge      int64       `json:"charge"`     // deducted from balance, never negative
+	ExtraDays   int         `json:"extra_days"` // credit above the new plan price, added as time
+	ExpiresAt   time.Time   `json:"expires_at"`
 }
 
 func (s *SubscriptionService) GetActiveSubscription(userID uuid.UUID) (*models.Subscription, error) {
+	return s.activeSubscription(s.db.DB, userID)
+}
+
+func (s *SubscriptionService) activeSubscription(tx *gorm.DB, userID uuid.UUID) (*models.Subscription, error) {
 	var subscription models.Subscription
 	now := time.Now()
 
-	err := s.db.
+	err := tx.
 		Preload("Plan").
 		Where("user_id = ? AND is_active = ? AND expires_at > ?", userID, true, now).
 		Order("expires_at DESC").
@@ -40,81 +72,848 @@ func (s *SubscriptionService) GetActiveSubscription(userID uuid.UUID) (*models.S
 	return &subscription, nil
 }
 
-func (s *SubscriptionService) PurchaseSubscription(userID, planID uuid.UUID) (*models.Subscription, error) {
-	// Get user
-	var user models.User
-	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
-		return nil, fmt.Errorf("user not found: %w", err)
+// GetEffectiveSubscription returns the subscription that grants the user access,
+// see EffectiveSubscription
+func (s *SubscriptionService) GetEffectiveSubscription(userID uuid.UUID) (*models.Subscription, error) {
+	return EffectiveSubscription(s.db.DB, userID)
+}
+
+// EffectiveSubscription returns the user's own active or frozen subscription or,
+// for family members, the owner's one. Returns nil when the user has no access.
+func EffectiveSubscription(tx *gorm.DB, userID uuid.UUID) (*models.Subscription, error) {
+	subscription, err := ownSubscription(tx, userID)
+	if err != nil || subscription != nil {
+		return subscription, err
+	}
+
+	var member models.FamilyMember
+	err = tx.Where("user_id = ? AND status = ?", userID, FamilyMemberActive).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subscription, err = ownSubscription(tx, member.OwnerID)
+	if err != nil || subscription == nil {
+		return nil, err
+	}
+
+	// The owner may have switched to a personal plan
+	if subscription.Plan.MaxMembers == 0 {
+		return nil, nil
+	}
+
+	return subscription, nil
+}
+
+// ownSubscription returns the user's active or frozen subscription
+func ownSubscription(tx *gorm.DB, userID uuid.UUID) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := tx.
+		Preload("Plan").
+		Where("user_id = ? AND (frozen_at IS NOT NULL OR (is_active = ? AND expires_at > ?))", userID, true, time.Now()).
+		Order("expires_at DESC").
+		First(&subscription).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+// GetFrozenSubscription returns the user's frozen subscription or nil
+func (s *SubscriptionService) GetFrozenSubscription(userID uuid.UUID) (*models.Subscription, error) {
+	return s.frozenSubscription(s.db.DB, userID)
+}
+
+func (s *SubscriptionService) frozenSubscription(tx *gorm.DB, userID uuid.UUID) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := tx.
+		Preload("Plan").
+		Where("user_id = ? AND frozen_at IS NOT NULL", userID).
+		First(&subscription).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+// FreezeSubscription pauses the active subscription. Its Xray clients are disabled
+// and the remaining time is kept until UnfreezeSubscription.
+func (s *SubscriptionService) FreezeSubscription(userID uuid.UUID) (*models.Subscription, error) {
+	var subscription *models.Subscription
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		var err error
+		subscription, err = s.activeSubscription(tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if subscription == nil {
+			return fmt.Errorf("no active subscription")
+		}
+
+		now := time.Now()
+
+		if maxFreezes := s.config.Subscription.MaxFreezes; maxFreezes > 0 {
+			var freezes int64
+			if err := tx.Model(&models.SubscriptionFreeze{}).
+				Where("user_id = ? AND frozen_at > ?", userID, now.Add(-s.config.Subscription.FreezePeriod)).
+				Count(&freezes).Error; err != nil {
+				return fmt.Errorf("failed to count freezes: %w", err)
+			}
+			if freezes >= int64(maxFreezes) {
+				return fmt.Errorf("freeze limit reached: %d per %d days", maxFreezes, int(s.config.Subscription.FreezePeriod.Hours()/24))
+			}
+		}
+
+		subscription.FrozenAt = &now
+		subscription.Remaining = int64(subscription.ExpiresAt.Sub(now).Seconds())
+		subscription.IsActive = false
+		if err := tx.Omit("User", "Plan").Save(subscription).Error; err != nil {
+			return fmt.Errorf("failed to freeze subscription: %w", err)
+		}
+
+		if err := tx.Create(&models.SubscriptionFreeze{
+			SubscriptionID: subscription.ID,
+			UserID:         userID,
+			Remaining:      subscription.Remaining,
+			FrozenAt:       now,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to record freeze: %w", err)
+		}
+
+		return s.syncConnections(tx, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("user_id", userID.String()).Int64("remaining", subscription.Remaining).Msg("Subscription frozen")
+	return subscription, nil
+}
+
+// UnfreezeSubscription resumes a frozen subscription with the time it had left
+func (s *SubscriptionService) UnfreezeSubscription(userID uuid.UUID) (*models.Subscription, error) {
+	var subscription *models.Subscription
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		var err error
+		subscription, err = s.frozenSubscription(tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if subscription == nil {
+			return fmt.Errorf("subscription is not frozen")
+		}
+
+		if err := s.unfreeze(tx, subscription, time.Now()); err != nil {
+			return err
+		}
+		return s.syncConnections(tx, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("user_id", userID.String()).Msg("Subscription unfrozen")
+	return subscription, nil
+}
+
+// UnfreezeExpiredFreezes resumes subscriptions frozen longer than the configured
+// maximum and returns them
+func (s *SubscriptionService) UnfreezeExpiredFreezes() ([]models.Subscription, error) {
+	maxDuration := s.config.Subscription.MaxFreezeDuration
+	if maxDuration <= 0 {
+		return nil, nil
+	}
+
+	var subscriptions []models.Subscription
+	if err := s.db.Where("frozen_at IS NOT NULL AND frozen_at < ?", time.Now().Add(-maxDuration)).
+		Find(&subscriptions).Error; err != nil {
+		return nil, fmt.Errorf("failed to load frozen subscriptions: %w", err)
+	}
+
+	var resumed []models.Subscription
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := s.unfreeze(tx, subscription, time.Now()); err != nil {
+				return err
+			}
+			return s.syncConnections(tx, subscription.UserID)
+		}); err != nil {
+			log.Error().Err(err).Str("subscription_id", subscription.ID.String()).Msg("Failed to unfreeze subscription")
+			continue
+		}
+		resumed = append(resumed, *subscription)
+	}
+
+	return resumed, nil
+}
+
+// unfreeze restores ExpiresAt from the remaining time. Must be called inside a transaction.
+func (s *SubscriptionService) unfreeze(tx *gorm.DB, subscription *models.Subscription, now time.Time) error {
+	expiryTime := now.Add(time.Duration(subscription.Remaining) * time.Second)
+	subscription.ExpiresAt = &expiryTime
+	subscription.IsActive = true
+	subscription.FrozenAt = nil
+	subscription.Remaining = 0
+	if err := tx.Omit("User", "Plan").Save(subscription).Error; err != nil {
+		return fmt.Errorf("failed to unfreeze subscription: %w", err)
+	}
+
+	if err := tx.Model(&models.SubscriptionFreeze{}).
+		Where("subscription_id = ? AND unfrozen_at IS NULL", subscription.ID).
+		Update("unfrozen_at", now).Error; err != nil {
+		return fmt.Errorf("failed to close freeze: %w", err)
+	}
+
+	return nil
+}
+
+// QuotePlan returns the plan price after applying a promo code
+func (s *SubscriptionService) QuotePlan(userID, planID uuid.UUID, promoCode string) (*PromoQuote, error) {
+	var plan models.Plan
+	if err := s.db.First(&plan, "id = ? AND is_active = ?", planID, true).Error; err != nil {
+		return nil, fmt.Errorf("plan not found: %w", err)
+	}
+
+	return s.promoService.Quote(s.db.DB, promoCode, userID, &plan)
+}
+
+func (s *SubscriptionService) PurchaseSubscription(userID, planID uuid.UUID, promoCode string) (*models.Subscription, error) {
+	var subscription *models.Subscription
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Get user, locked to serialize concurrent purchases
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		// Get plan
+		var plan models.Plan
+		if err := tx.First(&plan, "id = ? AND is_active = ?", planID, true).Error; err != nil {
+			return fmt.Errorf("plan not found: %w", err)
+		}
+
+		// Apply promo code
+		price := plan.PriceStars
+		bonusDays := 0
+		var quote *PromoQuote
+		if promoCode != "" {
+			var err error
+			quote, err = s.promoService.Quote(tx, promoCode, userID, &plan)
+			if err != nil {
+				return err
+			}
+			price = quote.Price
+			bonusDays = quote.BonusDays
+		}
+
+		// Check balance
+		if user.Balance < price {
+			return fmt.Errorf("insufficient balance")
+		}
+
+		// Deduct balance
+		if err := tx.Model(&user).Update("balance", gorm.Expr("balance - ?", price)).Error; err != nil {
+			return fmt.Errorf("failed to deduct balance: %w", err)
+		}
+
+		var err error
+		subscription, err = s.extendSubscription(tx, userID, &plan, bonusDays, price)
+		if err != nil {
+			return err
+		}
+
+		if quote != nil {
+			if err := s.promoService.Redeem(tx, quote, userID, plan.ID, subscription.ID); err != nil {
+				return err
+			}
+		}
+
+		return s.syncConnections(tx, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Preload relations for the subscription
+	if err := s.db.Preload("User").Preload("Plan").First(subscription, "id = ?", subscription.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load subscription with relations: %w", err)
+	}
+
+	return subscription, nil
+}
+
+// QuotePlanChange returns the prorated cost of switching to another plan
+func (s *SubscriptionService) QuotePlanChange(userID, planID uuid.UUID) (*PlanChangeQuote, error) {
+	subscription, err := s.activeSubscription(s.db.DB, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	if subscription == nil {
+		return nil, fmt.Errorf("no active subscription")
 	}
 
-	// Get plan
 	var plan models.Plan
 	if err := s.db.First(&plan, "id = ? AND is_active = ?", planID, true).Error; err != nil {
 		return nil, fmt.Errorf("plan not found: %w", err)
 	}
 
-	// Check balance
-	if user.Balance < plan.PriceStars {
-		return nil, fmt.Errorf("insufficient balance")
+	if err := checkFamilySeats(s.db.DB, userID, &plan); err != nil {
+		return nil, err
+	}
+
+	return prorate(subscription, &plan, time.Now())
+}
+
+// ChangePlan switches the active subscription to another plan. The unused time on the
+// current plan is credited, at most what was paid for the period, and the new plan starts
+// now for its full duration. The difference is charged to the balance, a credit above
+// the new plan price is never paid out but extends the new plan instead.
+func (s *SubscriptionService) ChangePlan(userID, planID uuid.UUID) (*models.Subscription, *PlanChangeQuote, error) {
+	var subscription *models.Subscription
+	var quote *PlanChangeQuote
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		var err error
+		subscription, err = s.activeSubscription(tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if subscription == nil {
+			return fmt.Errorf("no active subscription")
+		}
+
+		var plan models.Plan
+		if err := tx.First(&plan, "id = ? AND is_active = ?", planID, true).Error; err != nil {
+			return fmt.Errorf("plan not found: %w", err)
+		}
+
+		if err := checkFamilySeats(tx, userID, &plan); err != nil {
+			return err
+		}
+
+		quote, err = prorate(subscription, &plan, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if quote.Charge > 0 && user.Balance < quote.Charge {
+			return fmt.Errorf("insufficient balance")
+		}
+
+		if quote.Charge > 0 {
+			if err := tx.Model(&user).Update("balance", gorm.Expr("balance - ?", quote.Charge)).Error; err != nil {
+				return fmt.Errorf("failed to update balance: %w", err)
+			}
+		}
+
+		fromPlanID := subscription.PlanID
+		subscription.PlanID = plan.ID
+		subscription.Plan = plan
+		subscription.ExpiresAt = &quote.ExpiresAt
+		subscription.PricePaid = quote.Credit + quote.Charge
+		if err := tx.Omit("User", "Plan").Save(subscription).Error; err != nil {
+			return fmt.Errorf("failed to update subscription: %w", err)
+		}
+
+		if err := tx.Create(&models.PlanChange{
+			UserID:         userID,
+			SubscriptionID: subscription.ID,
+			FromPlanID:     fromPlanID,
+			ToPlanID:       plan.ID,
+			Credit:         quote.Credit,
+			Charged:        quote.Charge,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to record plan change: %w", err)
+		}
+
+		return s.syncConnections(tx, userID)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Info().
+		Str("user_id", userID.String()).
+		Str("plan", quote.NewPlan.Name).
+		Int64("credit", quote.Credit).
+		Int64("charge", quote.Charge).
+		Msg("Subscription plan changed")
+
+	return subscription, quote, nil
+}
+
+// prorate prices a switch of the subscription to the plan at the given time. The
+// credit is the unused share of the list price, capped by what was actually paid.
+func prorate(subscription *models.Subscription, plan *models.Plan, now time.Time) (*PlanChangeQuote, error) {
+	if subscription.PlanID == plan.ID {
+		return nil, fmt.Errorf("you are already on this plan")
+	}
+
+	var credit int64
+	if subscription.ExpiresAt != nil && subscription.ExpiresAt.After(now) {
+		remaining := subscription.ExpiresAt.Sub(now)
+		period := now.AddDate(0, subscription.Plan.DurationMonths, 0).Sub(now)
+		if period > 0 {
+			credit = int64(float64(subscription.Plan.PriceStars) * remaining.Seconds() / period.Seconds())
+		}
+		if credit > subscription.PricePaid {
+			credit = subscription.PricePaid
+		}
+	}
+
+	quote := &PlanChangeQuote{
+		CurrentPlan: subscription.Plan,
+		NewPlan:     *plan,
+		Credit:      credit,
+		Charge:      plan.PriceStars - credit,
+		ExpiresAt:   now.AddDate(0, plan.DurationMonths, 0),
+	}
+
+	// The surplus buys time on the new plan at its own rate
+	if quote.Charge < 0 {
+		extra := creditTime(plan, now, -quote.Charge)
+		quote.ExpiresAt = quote.ExpiresAt.Add(extra)
+		quote.ExtraDays = int(extra.Hours() / 24)
+		quote.Charge = 0
+	}
+
+	return quote, nil
+}
+
+// creditTime is the time a credit buys on the plan at its list price
+func creditTime(plan *models.Plan, start time.Time, credit int64) time.Duration {
+	if plan.PriceStars <= 0 || credit <= 0 {
+		return 0
+	}
+	period := start.AddDate(0, plan.DurationMonths, 0).Sub(start)
+	return time.Duration(float64(period) * float64(credit) / float64(plan.PriceStars))
+}
+
+// checkFamilySeats rejects switching to a plan with fewer family seats than are taken
+func checkFamilySeats(tx *gorm.DB, userID uuid.UUID, plan *models.Plan) error {
+	var members int64
+	if err := tx.Model(&models.FamilyMember{}).
+		Where("owner_id = ? AND status IN ?", userID, []string{FamilyMemberPending, FamilyMemberActive}).
+		Count(&members).Error; err != nil {
+		return fmt.Errorf("failed to count family members: %w", err)
+	}
+	if members > int64(plan.MaxMembers) {
+		return fmt.Errorf("%s allows %d family members, remove %d first", plan.Name, plan.MaxMembers, members-int64(plan.MaxMembers))
+	}
+	return nil
+}
+
+// CancelSubscription deactivates the user's subscription immediately, without a refund.
+// Xray clients of the user and their family members are disabled by the worker.
+func (s *SubscriptionService) CancelSubscription(userID uuid.UUID) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Subscription{}).
+			Where("user_id = ? AND (is_active = ? OR frozen_at IS NOT NULL)", userID, true).
+			Updates(map[string]interface{}{
+				"is_active": false,
+				"frozen_at": nil,
+				"remaining": 0,
+			})
+		if result.Error != nil {
+			return fmt.Errorf("failed to cancel subscription: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("no active subscription")
+		}
+
+		return s.syncConnections(tx, userID)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("user_id", userID.String()).Msg("Subscription cancelled")
+	return nil
+}
+
+// syncConnections queues an update of expiry, plan limits and enabled state for the
+// Xray clients of the user and their active family members. Must be called inside
+// the transaction that changed the subscription.
+func (s *SubscriptionService) syncConnections(tx *gorm.DB, userID uuid.UUID) error {
+	userIDs := []uuid.UUID{userID}
+	var memberIDs []uuid.UUID
+	if err := tx.Model(&models.FamilyMember{}).
+		Where("owner_id = ? AND status = ? AND user_id IS NOT NULL", userID, FamilyMemberActive).
+		Pluck("user_id", &memberIDs).Error; err != nil {
+		return fmt.Errorf("failed to load family members for sync: %w", err)
 	}
+	userIDs = append(userIDs, memberIDs...)
 
-	// Deduct balance
-	if err := s.db.Model(&user).Update("balance", gorm.Expr("balance - ?", plan.PriceStars)).Error; err != nil {
-		return nil, fmt.Errorf("failed to deduct balance: %w", err)
+	var connections []models.Connection
+	if err := tx.Where("user_id IN ? AND is_active = ?", userIDs, true).Find(&connections).Error; err != nil {
+		return fmt.Errorf("failed to load connections for sync: %w", err)
+	}
+
+	for _, connection := range connections {
+		if err := EnqueueTask(tx, queue.Task{
+			Type:         queue.TaskUpdateConnection,
+			UserID:       connection.UserID,
+			ServerID:     connection.ServerID,
+			ConnectionID: connection.ID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendSubscription stacks the plan duration on top of the active subscription
+// or starts a new one. price is what the user paid for the plan.
+// Must be called inside a transaction.
+func (s *SubscriptionService) extendSubscription(tx *gorm.DB, userID uuid.UUID, plan *models.Plan, bonusDays int, price int64) (*models.Subscription, error) {
+	frozen, err := s.frozenSubscription(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	if frozen != nil {
+		return nil, fmt.Errorf("your subscription is frozen, unfreeze it first")
 	}
 
 	// Get or create active subscription
-	existing, _ := s.GetActiveSubscription(userID)
+	existing, err := s.activeSubscription(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	// Time already paid for on another plan must go through ChangePlan
+	if existing != nil && existing.PlanID != plan.ID {
+		return nil, ErrPlanMismatch
+	}
 
 	var startTime time.Time
+	pricePaid := price
 	if existing != nil && existing.ExpiresAt != nil && existing.ExpiresAt.After(time.Now()) {
 		startTime = *existing.ExpiresAt
+		pricePaid += existing.PricePaid
 	} else {
 		startTime = time.Now()
 	}
 
-	expiryTime := startTime.AddDate(0, plan.DurationMonths, 0)
+	expiryTime := startTime.AddDate(0, plan.DurationMonths, bonusDays)
 
-	subscription := models.Subscription{
+	// If existing subscription exists, update it; otherwise create new
+	if existing != nil {
+		existing.PlanID = plan.ID
+		existing.Plan = *plan
+		existing.ExpiresAt = &expiryTime
+		existing.PricePaid = pricePaid
+		existing.IsActive = true
+		if err := tx.Omit("User", "Plan").Save(existing).Error; err != nil {
+			return nil, fmt.Errorf("failed to update subscription: %w", err)
+		}
+		return existing, nil
+	}
+
+	subscription := &models.Subscription{
 		UserID:    userID,
-		PlanID:    planID,
+		PlanID:    plan.ID,
 		IsActive:  true,
 		StartedAt: &startTime,
 		ExpiresAt: &expiryTime,
+		PricePaid: pricePaid,
 	}
 
-	// If existing subscription exists, update it; otherwise create new
-	if existing != nil {
-		existing.PlanID = planID
-		existing.ExpiresAt = &expiryTime
-		existing.IsActive = true
-		if err := s.db.Save(existing).Error; err != nil {
+	if err := tx.Create(subscription).Error; err != nil {
+		return nil, fmt.Errorf("failed to create subscription: %w", err)
+	}
+
+	return subscription, nil
+}
+
+// AddBonusDays extends the user's latest subscription, reactivating it if expired.
+// Users who never had a subscription get one on the shortest active plan.
+// The user's connections are synced. Must be called inside a transaction.
+func (s *SubscriptionService) AddBonusDays(tx *gorm.DB, userID uuid.UUID, days int) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := tx.Where("user_id = ?", userID).Order("expires_at DESC").First(&subscription).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	now := time.Now()
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		var plan models.Plan
+		if err := tx.Where("is_active = ?", true).Order("duration_months ASC").First(&plan).Error; err != nil {
+			return nil, fmt.Errorf("no active plan to attach bonus days to: %w", err)
+		}
+
+		expiryTime := now.AddDate(0, 0, days)
+		subscription = models.Subscription{
+			UserID:    userID,
+			PlanID:    plan.ID,
+			IsActive:  true,
+			StartedAt: &now,
+			ExpiresAt: &expiryTime,
+		}
+		if err := tx.Create(&subscription).Error; err != nil {
+			return nil, fmt.Errorf("failed to create subscription: %w", err)
+		}
+		if err := s.syncConnections(tx, userID); err != nil {
+			return nil, err
+		}
+		return &subscription, nil
+	}
+
+	// Frozen subscriptions keep the days until they are resumed
+	if subscription.FrozenAt != nil {
+		subscription.Remaining += int64(days) * 24 * 60 * 60
+		if err := tx.Omit("User", "Plan").Save(&subscription).Error; err != nil {
 			return nil, fmt.Errorf("failed to update subscription: %w", err)
 		}
-		// Preload relations for the updated subscription
-		if err := s.db.Preload("User").Preload("Plan").First(&existing, "id = ?", existing.ID).Error; err != nil {
-			return nil, fmt.Errorf("failed to load subscription with relations: %w", err)
+		return &subscription, nil
+	}
+
+	startTime := now
+	if subscription.IsActive && subscription.ExpiresAt != nil && subscription.ExpiresAt.After(now) {
+		startTime = *subscription.ExpiresAt
+	} else {
+		// A new period made of bonus days only, nothing was paid for it
+		subscription.PricePaid = 0
+	}
+
+	expiryTime := startTime.AddDate(0, 0, days)
+	subscription.ExpiresAt = &expiryTime
+	subscription.IsActive = true
+	if err := tx.Omit("User", "Plan").Save(&subscription).Error; err != nil {
+		return nil, fmt.Errorf("failed to update subscription: %w", err)
+	}
+
+	// Push the new expiry to the panels, a reactivated subscription enables the clients
+	if err := s.syncConnections(tx, userID); err != nil {
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+// PurchaseGift charges the buyer for a plan and issues a one-time gift code instead of
+// activating the subscription
+func (s *SubscriptionService) PurchaseGift(userID, planID uuid.UUID) (*models.GiftCode, error) {
+	var gift *models.GiftCode
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		var plan models.Plan
+		if err := tx.First(&plan, "id = ? AND is_active = ?", planID, true).Error; err != nil {
+			return fmt.Errorf("plan not found: %w", err)
 		}
-		return existing, nil
+
+		if user.Balance < plan.PriceStars {
+			return fmt.Errorf("insufficient balance")
+		}
+
+		if err := tx.Model(&user).Update("balance", gorm.Expr("balance - ?", plan.PriceStars)).Error; err != nil {
+			return fmt.Errorf("failed to deduct balance: %w", err)
+		}
+
+		code, err := generateCode()
+		if err != nil {
+			return err
+		}
+
+		gift = &models.GiftCode{
+			Code:        code,
+			PlanID:      plan.ID,
+			PurchasedBy: userID,
+			PricePaid:   plan.PriceStars,
+			Plan:        plan,
+		}
+		if err := tx.Omit("Plan", "Buyer").Create(gift).Error; err != nil {
+			return fmt.Errorf("failed to create gift code: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if err := s.db.Create(&subscription).Error; err != nil {
-		return nil, fmt.Errorf("failed to create subscription: %w", err)
+	return gift, nil
+}
+
+// RedeemGift activates a gift code for the user, extending the subscription
+// the same way a purchase does. A gift for another plan than the active one
+// switches the subscription to the gift plan and keeps the unused time as credit.
+func (s *SubscriptionService) RedeemGift(userID uuid.UUID, code string) (*models.Subscription, error) {
+	var subscription *models.Subscription
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var gift models.GiftCode
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).
+			First(&gift).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invalid gift code")
+			}
+			return fmt.Errorf("failed to find gift code: %w", err)
+		}
+
+		if gift.RedeemedBy != nil {
+			return fmt.Errorf("gift code has already been redeemed")
+		}
+
+		// The plan was paid for, so it is honoured even if deactivated since
+		var plan models.Plan
+		if err := tx.First(&plan, "id = ?", gift.PlanID).Error; err != nil {
+			return fmt.Errorf("plan not found: %w", err)
+		}
+
+		existing, err := s.activeSubscription(tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if existing != nil && existing.PlanID != plan.ID {
+			subscription, err = s.switchToGiftPlan(tx, userID, existing, &plan, gift.PricePaid)
+		} else {
+			subscription, err = s.extendSubscription(tx, userID, &plan, 0, gift.PricePaid)
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.Model(&gift).Updates(map[string]interface{}{
+			"redeemed_by":     userID,
+			"redeemed_at":     now,
+			"subscription_id": subscription.ID,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to mark gift code as redeemed: %w", err)
+		}
+
+		return s.syncConnections(tx, userID)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Preload relations for the new subscription
-	if err := s.db.Preload("User").Preload("Plan").First(&subscription, "id = ?", subscription.ID).Error; err != nil {
+	if err := s.db.Preload("User").Preload("Plan").First(subscription, "id = ?", subscription.ID).Error; err != nil {
 		return nil, fmt.Errorf("failed to load subscription with relations: %w", err)
 	}
 
-	return &subscription, nil
+	return subscription, nil
 }
 
-func (s *SubscriptionService) DeactivateExpiredSubscriptions() error {
+// switchToGiftPlan moves the active subscription to the plan of a redeemed gift. The
+// gift pays for a full period of its plan, the credit for the unused time on the
+// current plan is added on top at the gift plan rate. Must be called inside a transaction.
+func (s *SubscriptionService) switchToGiftPlan(tx *gorm.DB, userID uuid.UUID, subscription *models.Subscription, plan *models.Plan, price int64) (*models.Subscription, error) {
+	if err := checkFamilySeats(tx, userID, plan); err != nil {
+		return nil, err
+	}
+
 	now := time.Now()
-	return s.db.Model(&models.Subscription{}).
-		Where("is_active = ? AND expires_at < ?", true, now).
-		Update("is_active", false).Error
+	quote, err := prorate(subscription, plan, now)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := now.AddDate(0, plan.DurationMonths, 0).Add(creditTime(plan, now, quote.Credit))
+
+	fromPlanID := subscription.PlanID
+	subscription.PlanID = plan.ID
+	subscription.Plan = *plan
+	subscription.ExpiresAt = &expiresAt
+	subscription.PricePaid = quote.Credit + price
+	if err := tx.Omit("User", "Plan").Save(subscription).Error; err != nil {
+		return nil, fmt.Errorf("failed to update subscription: %w", err)
+	}
+
+	if err := tx.Create(&models.PlanChange{
+		UserID:         userID,
+		SubscriptionID: subscription.ID,
+		FromPlanID:     fromPlanID,
+		ToPlanID:       plan.ID,
+		Credit:         quote.Credit,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to record plan change: %w", err)
+	}
+
+	return subscription, nil
+}
+
+// GetPurchasedGifts returns gift codes bought by the user
+func (s *SubscriptionService) GetPurchasedGifts(userID uuid.UUID) ([]models.GiftCode, error) {
+	var gifts []models.GiftCode
+	if err := s.db.Preload("Plan").
+		Where("purchased_by = ?", userID).
+		Order("created_at DESC").
+		Find(&gifts).Error; err != nil {
+		return nil, err
+	}
+	return gifts, nil
+}
+
+// generateCode generates a random code usable in a /start deep link
+func generateCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate code: %w", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf), nil
+}
+
+// DeactivateExpiredSubscriptions deactivates expired subscriptions and queues
+// disabling of the Xray clients of their owners and family members
+func (s *SubscriptionService) DeactivateExpiredSubscriptions() error {
+	var subscriptions []models.Subscription
+	if err := s.db.Where("is_active = ? AND expires_at < ?", true, time.Now()).Find(&subscriptions).Error; err != nil {
+		return fmt.Errorf("failed to load expired subscriptions: %w", err)
+	}
+
+	for _, subscription := range subscriptions {
+		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&subscription).Update("is_active", false).Error; err != nil {
+				return err
+			}
+			return s.syncConnections(tx, subscription.UserID)
+		}); err != nil {
+			log.Error().Err(err).Str("subscription_id", subscription.ID.String()).Msg("Failed to deactivate subscription")
+		}
+	}
+
+	return nil
 }
 
 func (s *SubscriptionService) HasActiveSubscription(userID uuid.UUID) bool {
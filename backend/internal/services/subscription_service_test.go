@@ -0,0 +1,148 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+func testPlan(months int, price int64) models.Plan {
+	return models.Plan{ID: uuid.New(), Name: "test", DurationMonths: months, PriceStars: price}
+}
+
+func testSubscription(plan models.Plan, expiresAt time.Time, pricePaid int64) *models.Subscription {
+	return &models.Subscription{
+		ID:        uuid.New(),
+		PlanID:    plan.ID,
+		Plan:      plan,
+		IsActive:  true,
+		ExpiresAt: &expiresAt,
+		PricePaid: pricePaid,
+	}
+}
+
+// listCredit is the unused share of the list price, the credit before the cap
+func listCredit(plan models.Plan, expiresAt, now time.Time) int64 {
+	period := now.AddDate(0, plan.DurationMonths, 0).Sub(now)
+	return int64(float64(plan.PriceStars) * expiresAt.Sub(now).Seconds() / period.Seconds())
+}
+
+func TestProrateLegacySubscriptionKeepsCredit(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	current := testPlan(1, 100)
+	target := testPlan(3, 250)
+	expiresAt := now.AddDate(0, 0, 15)
+
+	// Bought before the price was recorded, the migration backfills the plan price
+	subscription := testSubscription(current, expiresAt, current.PriceStars)
+
+	quote, err := prorate(subscription, &target, now)
+	if err != nil {
+		t.Fatalf("prorate: %v", err)
+	}
+
+	want := listCredit(current, expiresAt, now)
+	if want == 0 {
+		t.Fatal("test setup gives no credit")
+	}
+	if quote.Credit != want {
+		t.Fatalf("expected credit %d, got %d", want, quote.Credit)
+	}
+	if quote.Charge != target.PriceStars-want {
+		t.Fatalf("expected charge %d, got %d", target.PriceStars-want, quote.Charge)
+	}
+}
+
+func TestProrateCapsCreditAtPricePaid(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	current := testPlan(1, 100)
+	target := testPlan(3, 250)
+
+	// Bought with a promo code for 20 stars
+	subscription := testSubscription(current, now.AddDate(0, 0, 25), 20)
+
+	quote, err := prorate(subscription, &target, now)
+	if err != nil {
+		t.Fatalf("prorate: %v", err)
+	}
+	if quote.Credit != 20 {
+		t.Fatalf("expected credit capped at 20, got %d", quote.Credit)
+	}
+	if quote.Charge != 230 {
+		t.Fatalf("expected charge 230, got %d", quote.Charge)
+	}
+}
+
+func TestProrateSurplusBecomesDays(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	current := testPlan(12, 900)
+	target := testPlan(1, 100)
+	subscription := testSubscription(current, now.AddDate(0, 10, 0), 900)
+
+	quote, err := prorate(subscription, &target, now)
+	if err != nil {
+		t.Fatalf("prorate: %v", err)
+	}
+	if quote.Charge != 0 {
+		t.Fatalf("a downgrade must not pay out, got charge %d", quote.Charge)
+	}
+	if quote.ExtraDays <= 0 {
+		t.Fatalf("expected the surplus as extra days, got %d", quote.ExtraDays)
+	}
+	if !quote.ExpiresAt.After(now.AddDate(0, target.DurationMonths, quote.ExtraDays)) {
+		t.Fatalf("expiry %s does not include the extra days", quote.ExpiresAt)
+	}
+}
+
+func TestRedeemGiftOnOtherPlanKeepsCredit(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testMockConfig()
+	user := newTestUser(t, db)
+
+	current := models.Plan{Name: "test", DurationMonths: 1, PriceStars: 100, IsActive: true}
+	gifted := models.Plan{Name: "test", DurationMonths: 3, PriceStars: 250, IsActive: true}
+	for _, plan := range []*models.Plan{&current, &gifted} {
+		if err := db.Create(plan).Error; err != nil {
+			t.Fatalf("create plan: %v", err)
+		}
+	}
+
+	now := time.Now()
+	expiresAt := now.AddDate(0, 0, 15)
+	subscription := &models.Subscription{UserID: user.ID, PlanID: current.ID, IsActive: true, StartedAt: &now, ExpiresAt: &expiresAt, PricePaid: 100}
+	if err := db.Create(subscription).Error; err != nil {
+		t.Fatalf("create subscription: %v", err)
+	}
+	gift := &models.GiftCode{Code: uuid.New().String(), PlanID: gifted.ID, PurchasedBy: user.ID, PricePaid: gifted.PriceStars}
+	if err := db.Omit("Plan", "Buyer").Create(gift).Error; err != nil {
+		t.Fatalf("create gift: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Where("user_id = ?", user.ID).Delete(&models.PlanChange{})
+		db.Delete(gift)
+		db.Delete(&current)
+		db.Delete(&gifted)
+	})
+
+	subscriptions := NewSubscriptionService(db, cfg, queue.NewMemory(queue.RetryPolicy{}), NewPromoCodeService(db))
+	redeemed, err := subscriptions.RedeemGift(user.ID, gift.Code)
+	if err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+
+	if redeemed.PlanID != gifted.ID {
+		t.Fatalf("expected the subscription on the gift plan, got %s", redeemed.PlanID)
+	}
+	// About half a month of the current plan is credited on top of the gift
+	fullPeriod := time.Now().AddDate(0, gifted.DurationMonths, 0)
+	if !redeemed.ExpiresAt.After(fullPeriod.AddDate(0, 0, 7)) {
+		t.Fatalf("expected the unused time added to the gift period, expires %s", redeemed.ExpiresAt)
+	}
+	if redeemed.PricePaid <= gift.PricePaid {
+		t.Fatalf("expected the credit in the price paid, got %d", redeemed.PricePaid)
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+// TaskStore remembers handled tasks so redelivered copies are skipped
+type TaskStore struct {
+	db *database.DB
+}
+
+func NewTaskStore(db *database.DB) *TaskStore {
+	return &TaskStore{db: db}
+}
+
+// Processed reports whether a task with this ID was already handled successfully
+func (s *TaskStore) Processed(taskID uuid.UUID) (bool, error) {
+	if taskID == uuid.Nil {
+		return false, nil
+	}
+
+	var processed models.ProcessedTask
+	err := s.db.Select("task_id").First(&processed, "task_id = ?", taskID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check processed task: %w", err)
+	}
+	return true, nil
+}
+
+// MarkProcessed records a successfully handled task
+func (s *TaskStore) MarkProcessed(task queue.Task) error {
+	if task.ID == uuid.Nil {
+		return nil
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.ProcessedTask{
+		TaskID:      task.ID,
+		Type:        task.Type,
+		Attempt:     task.Attempt,
+		ProcessedAt: time.Now(),
+	}).Error; err != nil {
+		return fmt.Errorf("failed to record processed task: %w", err)
+	}
+	return nil
+}
+
+// Prune forgets tasks handled before the retention, redeliveries come within minutes
+func (s *TaskStore) Prune(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+
+	if err := s.db.Where("processed_at < ?", time.Now().Add(-retention)).
+		Delete(&models.ProcessedTask{}).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to prune processed tasks")
+	}
+}
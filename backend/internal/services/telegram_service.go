@@ -80,6 +80,9 @@ func (ts *TelegramService) SetWebhook(webhookURL string) error {
 	payload := map[string]interface{}{
 		"url": webhookURL,
 	}
+	if ts.config.Telegram.WebhookSecret != "" {
+		payload["secret_token"] = ts.config.Telegram.WebhookSecret
+	}
 
 	// Convert payload to JSON
 	jsonPayload, err := json.Marshal(payload)
@@ -348,3 +351,48 @@ func (ts *TelegramService) AnswerPreCheckoutQuery(preCheckoutQueryID string, ok
 
 	return nil
 }
+
+// RefundStarPayment refunds a successful Telegram Stars payment
+func (ts *TelegramService) RefundStarPayment(userTelegramID int64, chargeID string) error {
+	if ts.botToken == "" {
+		return fmt.Errorf("TELEGRAM_BOT_TOKEN not configured")
+	}
+
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/refundStarPayment", ts.botToken)
+	payload := map[string]interface{}{
+		"user_id":                    userTelegramID,
+		"telegram_payment_charge_id": chargeID,
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if !result.Ok {
+		return fmt.Errorf("Telegram API error: %s", result.Description)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/models"
+)
+
+// TelegramStarsProvider accepts payments in Telegram Stars (XTR)
+type TelegramStarsProvider struct {
+	telegramService *TelegramService
+	webhookSecret   string
+}
+
+func NewTelegramStarsProvider(telegramService *TelegramService, cfg *config.Config) *TelegramStarsProvider {
+	return &TelegramStarsProvider{
+		telegramService: telegramService,
+		webhookSecret:   cfg.Telegram.WebhookSecret,
+	}
+}
+
+func (p *TelegramStarsProvider) Name() string {
+	return ProviderTelegramStars
+}
+
+func (p *TelegramStarsProvider) CreateInvoice(payment *models.Payment) (*Invoice, error) {
+	link, err := p.telegramService.CreateInvoiceLink(payment.TelegramID, payment.Amount, payment.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Invoice{
+		Link:     link,
+		Currency: "XTR",
+		Amount:   strconv.FormatInt(payment.Amount, 10),
+	}, nil
+}
+
+// VerifyWebhook checks the secret token Telegram sends with every update
+// and extracts the successful_payment message
+func (p *TelegramStarsProvider) VerifyWebhook(header http.Header, body []byte) (*PaymentEvent, error) {
+	if p.webhookSecret != "" {
+		token := header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.webhookSecret)) != 1 {
+			return nil, fmt.Errorf("invalid webhook secret token")
+		}
+	}
+
+	var update struct {
+		Message struct {
+			SuccessfulPayment struct {
+				Currency                string `json:"currency"`
+				InvoicePayload          string `json:"invoice_payload"`
+				TelegramPaymentChargeID string `json:"telegram_payment_charge_id"`
+			} `json:"successful_payment"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &update); err != nil {
+		return nil, fmt.Errorf("failed to parse update: %w", err)
+	}
+
+	payment := update.Message.SuccessfulPayment
+	if payment.InvoicePayload == "" {
+		return nil, fmt.Errorf("update has no successful payment")
+	}
+
+	return &PaymentEvent{
+		Payload:    payment.InvoicePayload,
+		ExternalID: payment.TelegramPaymentChargeID,
+		Paid:       true,
+	}, nil
+}
+
+func (p *TelegramStarsProvider) Refund(payment *models.Payment) error {
+	if payment.ExternalID == "" {
+		return fmt.Errorf("payment has no telegram charge ID")
+	}
+	return p.telegramService.RefundStarPayment(payment.TelegramID, payment.ExternalID)
+}
@@ -3,9 +3,11 @@ package services
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"xray-vpn-connect/internal/database"
 	"xray-vpn-connect/internal/models"
@@ -14,10 +16,10 @@ import (
 
 type UserService struct {
 	db  *database.DB
-	queue *queue.Queue
+	queue queue.TaskQueue
 }
 
-func NewUserService(db *database.DB, queue *queue.Queue) *UserService {
+func NewUserService(db *database.DB, queue queue.TaskQueue) *UserService {
 	return &UserService{db: db, queue: queue}
 }
 
@@ -87,32 +89,60 @@ func (s *UserService) UpdateBalance(userID uuid.UUID, amount int64) error {
 	return s.db.Model(&models.User{}).Where("id = ?", userID).Update("balance", gorm.Expr("balance + ?", amount)).Error
 }
 
+// UseReferralCode links a user to the referrer. Only users that were not referred yet
+// and have no completed payments can be linked.
 func (s *UserService) UseReferralCode(userID uuid.UUID, referralCode string) error {
-	var referrer models.User
-	if err := s.db.Where("referral_code = ?", referralCode).First(&referrer).Error; err != nil {
-		return fmt.Errorf("invalid referral code")
-	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var referrer models.User
+		if err := tx.Where("referral_code = ?", referralCode).First(&referrer).Error; err != nil {
+			return fmt.Errorf("invalid referral code")
+		}
 
-	if referrer.ID == userID {
-		return fmt.Errorf("cannot use your own referral code")
-	}
+		if referrer.ID == userID {
+			return fmt.Errorf("cannot use your own referral code")
+		}
 
-	// Update user's referred_by
-	if err := s.db.Model(&models.User{}).Where("id = ?", userID).Update("referred_by", referrer.ID).Error; err != nil {
-		return err
-	}
+		var user models.User
+		if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+
+		if user.ReferredBy != nil {
+			return fmt.Errorf("referral code already applied")
+		}
 
-	// Update referral stats
-	if err := s.db.Model(&models.ReferralStats{}).
-		Where("user_id = ?", referrer.ID).
-		Updates(map[string]interface{}{
-			"total_referrals": gorm.Expr("total_referrals + 1"),
-			"last_updated":    gorm.Expr("NOW()"),
+		var payments int64
+		if err := tx.Model(&models.Payment{}).
+			Where("user_id = ? AND status IN ?", userID, []string{"completed", "refunding", "refunded"}).
+			Count(&payments).Error; err != nil {
+			return err
+		}
+		if payments > 0 {
+			return fmt.Errorf("referral codes are only available to new users")
+		}
+
+		// Update user's referred_by
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("referred_by", referrer.ID).Error; err != nil {
+			return err
+		}
+
+		// Update referral stats, referrers created before stats were introduced have no row yet
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"total_referrals": gorm.Expr("referral_stats.total_referrals + 1"),
+				"last_updated":    gorm.Expr("NOW()"),
+			}),
+		}).Create(&models.ReferralStats{
+			UserID:         referrer.ID,
+			TotalReferrals: 1,
+			LastUpdated:    time.Now(),
 		}).Error; err != nil {
-		return err
-	}
+			return fmt.Errorf("failed to update referral stats: %w", err)
+		}
 
-	return nil
+		return nil
+	})
 }
 
 func stringPtr(s string) *string {
@@ -126,19 +156,17 @@ func stringPtr(s string) *string {
 func (s *UserService) SendWelcomeNotification(userID uuid.UUID) error {
 	data := map[string]interface{}{
 		"message": "Welcome to our VPN service!",
-		"user_id": userID.String(),
 	}
 
-	return s.queue.PublishWebSocketNotification(userID, "welcome", data)
+	return s.queue.PublishWebSocketNotification(userID, EventWelcome, data)
 }
 
 // SendBalanceUpdateNotification sends a balance update WebSocket notification to a user
 func (s *UserService) SendBalanceUpdateNotification(userID uuid.UUID, newBalance int64) error {
 	data := map[string]interface{}{
 		"message":      "Your balance has been updated",
-		"user_id":      userID.String(),
 		"new_balance":  newBalance,
 	}
 
-	return s.queue.PublishWebSocketNotification(userID, "balance_update", data)
+	return s.queue.PublishWebSocketNotification(userID, EventBalanceUpdate, data)
 }
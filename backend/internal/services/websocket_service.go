@@ -2,7 +2,10 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,48 +13,122 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
+	"xray-vpn-connect/internal/config"
 	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
 )
 
 // WebSocketService handles WebSocket connections and message broadcasting
 type WebSocketService struct {
-	clients    map[*websocket.Conn]uuid.UUID // Map of connections to user IDs
+	config     config.WebSocketConfig
+	clients    map[uuid.UUID]map[*Client]bool // connections by user, one per open tab
 	broadcast  chan WebSocketMessage
 	register   chan *Client
 	unregister chan *Client
 	mutex      sync.RWMutex
 	upgrader   websocket.Upgrader
+
+	// Notification feed of this instance, bound to the users connected here
+	subscription queue.Subscription
 }
 
-// Client represents a WebSocket client connection
+// Client represents a WebSocket client connection. Only its write loop writes to
+// the connection, everything else queues messages on send.
 type Client struct {
 	conn   *websocket.Conn
 	userID uuid.UUID
+	send   chan []byte // closed by Run when the client is removed
 }
 
+// maxMessageSize limits messages from clients, they only send control frames
+const maxMessageSize = 4096
+
 // WebSocketMessage represents a message to be sent over WebSocket
 type WebSocketMessage struct {
 	Type      string      `json:"type"`
-	UserID    *uuid.UUID  `json:"user_id,omitempty"` // nil for broadcast to all users
+	UserID    *uuid.UUID  `json:"user_id,omitempty"` // recipient, nil only for broadcasts
+	Broadcast bool        `json:"-"`                 // send to all users, never implied by a missing UserID
 	Timestamp time.Time   `json:"timestamp"`
 	Data      interface{} `json:"data"`
 }
 
+// WebSocket event types, sent as the message type
+const (
+	EventWelcome              = "welcome"
+	EventBalanceUpdate        = "balance_update"
+	EventPaymentCompleted     = "payment_completed"
+	EventConnectionReady      = "connection_ready"
+	EventConnectionFailed     = "connection_failed"
+	EventDeviceLimitExceeded  = "device_limit_exceeded"
+	EventDeviceLimitSuspended = "device_limit_suspended"
+	EventDeviceLimitResumed   = "device_limit_resumed"
+	EventFamilyInvite         = "family_invite"
+	EventFamilyMemberJoined   = "family_member_joined"
+	EventFamilyMemberLeft     = "family_member_left"
+	EventFamilyMemberRemoved  = "family_member_removed"
+	EventServerFailover       = "server_failover"
+	EventSubscriptionUnfrozen = "subscription_unfrozen"
+	EventAnnouncement         = "announcement" // broadcast to all users
+	EventNotification         = "notification" // events published without a type
+)
+
 // NewWebSocketService creates a new WebSocket service
-func NewWebSocketService() *WebSocketService {
+func NewWebSocketService(cfg *config.Config) *WebSocketService {
+	wsConfig := cfg.WebSocket
+	if wsConfig.SendBuffer <= 0 {
+		wsConfig.SendBuffer = 64
+	}
+	if wsConfig.PongTimeout <= 0 {
+		wsConfig.PongTimeout = 60 * time.Second
+	}
+	if wsConfig.PingInterval <= 0 || wsConfig.PingInterval >= wsConfig.PongTimeout {
+		wsConfig.PingInterval = wsConfig.PongTimeout * 9 / 10
+	}
+	if wsConfig.WriteTimeout <= 0 {
+		wsConfig.WriteTimeout = 10 * time.Second
+	}
+
 	return &WebSocketService{
-		clients:    make(map[*websocket.Conn]uuid.UUID),
+		config:     wsConfig,
+		clients:    make(map[uuid.UUID]map[*Client]bool),
 		broadcast:  make(chan WebSocketMessage, 100),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow connections from any origin in development
-			},
+			CheckOrigin: checkOrigin(wsConfig.AllowedOrigins),
 		},
 	}
 }
 
+// checkOrigin accepts requests without an Origin header (not from a browser), from
+// the same host and from the allowed origins
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		for _, allowedOrigin := range allowed {
+			allowedOrigin = strings.TrimRight(strings.TrimSpace(allowedOrigin), "/")
+			if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+				return true
+			}
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+
+		log.Warn().Str("origin", origin).Msg("WebSocket connection from a disallowed origin")
+		return false
+	}
+}
+
 // HandleWebSocket handles WebSocket upgrade requests
 func (s *WebSocketService) HandleWebSocket(c *gin.Context) {
 	userInterface, _ := c.Get("user")
@@ -68,78 +145,279 @@ func (s *WebSocketService) HandleWebSocket(c *gin.Context) {
 		log.Error().Err(err).Msg("Failed to upgrade connection to WebSocket")
 		return
 	}
-	defer conn.Close()
 
 	client := &Client{
 		conn:   conn,
 		userID: user.ID,
+		send:   make(chan []byte, s.config.SendBuffer),
 	}
 
 	// Register client
 	s.register <- client
 
-	// Keep connection alive
+	go s.writePump(client)
+	s.readPump(client)
+}
+
+// readPump reads until the connection fails or stops answering pings, then
+// unregisters the client. Clients only send pongs and close frames.
+func (s *WebSocketService) readPump(client *Client) {
+	defer func() {
+		s.unregister <- client
+		client.conn.Close()
+	}()
+
+	client.conn.SetReadLimit(maxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(s.config.PongTimeout))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(s.config.PongTimeout))
+	})
+
 	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
+		if _, _, err := client.conn.ReadMessage(); err != nil {
 			log.Debug().Err(err).Msg("WebSocket connection closed")
-			s.unregister <- client
-			break
+			return
 		}
 	}
 }
 
-// BroadcastMessage sends a message to all connected clients or a specific user
+// writePump is the only writer of the connection. It sends queued messages and
+// pings, and closes the connection when send is closed or a write fails.
+func (s *WebSocketService) writePump(client *Client) {
+	ticker := time.NewTicker(s.config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+			if !ok {
+				// Removed by Run, usually for falling behind
+				client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Debug().Err(err).Str("user_id", client.userID.String()).Msg("Failed to send WebSocket message")
+				return
+			}
+
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// BroadcastMessage sends a message to its user, or to all connected clients when it is a broadcast
 func (s *WebSocketService) BroadcastMessage(message WebSocketMessage) {
 	s.broadcast <- message
 }
 
-// Run starts the WebSocket service message handling loop
+// ConsumeNotifications subscribes this instance to the notifications of its connected
+// users. Each instance has its own subscription, so it works with any number of replicas.
+func (s *WebSocketService) ConsumeNotifications(q queue.TaskQueue) error {
+	subscription, err := q.SubscribeNotifications(s.deliver)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to notifications: %w", err)
+	}
+
+	s.mutex.Lock()
+	s.subscription = subscription
+	users := make([]uuid.UUID, 0, len(s.clients))
+	for userID := range s.clients {
+		users = append(users, userID)
+	}
+	s.mutex.Unlock()
+
+	// Users that connected before the subscription existed
+	for _, userID := range users {
+		if err := subscription.Bind(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends a notification task to the connected clients it is meant for
+func (s *WebSocketService) deliver(task queue.Task) {
+	message, ok := notificationMessage(task)
+	if !ok {
+		log.Warn().Str("task_id", task.ID.String()).Str("event", task.Event).Msg("Dropping WebSocket notification without recipient")
+		return
+	}
+
+	log.Debug().
+		Str("type", message.Type).
+		Str("user_id", task.UserID.String()).
+		Bool("broadcast", message.Broadcast).
+		Msg("Received WebSocket notification")
+
+	s.BroadcastMessage(message)
+}
+
+// notificationMessage builds the WebSocket message of a notification task. The
+// recipient is always task.UserID, the task must be flagged to reach all users.
+func notificationMessage(task queue.Task) (WebSocketMessage, bool) {
+	message := WebSocketMessage{
+		Type:      task.Event,
+		Timestamp: time.Now(),
+		Data:      task.Data,
+	}
+
+	// Tasks published before events were typed carry the event in the data
+	if message.Type == "" {
+		if event, ok := task.Data["event"].(string); ok && event != "" {
+			message.Type = event
+		} else {
+			message.Type = EventNotification
+		}
+	}
+
+	if task.Broadcast {
+		message.Broadcast = true
+		return message, true
+	}
+	if task.UserID == uuid.Nil {
+		return message, false
+	}
+
+	userID := task.UserID
+	message.UserID = &userID
+	return message, true
+}
+
+// Run starts the WebSocket service message handling loop. It owns the client
+// set and never blocks on a connection, writes happen in the write pumps.
 func (s *WebSocketService) Run() {
 	for {
 		select {
 		case client := <-s.register:
+			s.mutex.RLock()
+			firstConnection := len(s.clients[client.userID]) == 0
+			s.mutex.RUnlock()
+
+			// Bind before the client is visible, so it gets every notification
+			// published after it was registered
+			if firstConnection {
+				s.bind(client.userID)
+			}
+
 			s.mutex.Lock()
-			s.clients[client.conn] = client.userID
+			if s.clients[client.userID] == nil {
+				s.clients[client.userID] = make(map[*Client]bool)
+			}
+			s.clients[client.userID][client] = true
+			connections := len(s.clients[client.userID])
 			s.mutex.Unlock()
+
 			log.Info().
 				Str("user_id", client.userID.String()).
+				Int("connections", connections).
 				Msg("Client registered")
 
 		case client := <-s.unregister:
 			s.mutex.Lock()
-			if userID, ok := s.clients[client.conn]; ok {
-				delete(s.clients, client.conn)
+			removed, lastConnection := s.removeClient(client)
+			s.mutex.Unlock()
+
+			if removed {
 				log.Info().
-					Str("user_id", userID.String()).
+					Str("user_id", client.userID.String()).
 					Msg("Client unregistered")
 			}
-			s.mutex.Unlock()
+			if lastConnection {
+				s.unbind(client.userID)
+			}
 
 		case message := <-s.broadcast:
-			s.mutex.RLock()
-			// Send message to appropriate clients
-			for conn, userID := range s.clients {
-				// If UserID is nil, send to all clients (broadcast)
-				// If UserID is specified, send only to that user
-				if message.UserID == nil || *message.UserID == userID {
-					messageBytes, err := json.Marshal(message)
-					if err != nil {
-						log.Error().Err(err).Msg("Failed to marshal WebSocket message")
-						continue
-					}
-
-					// Send message asynchronously to avoid blocking
-					go func(connection *websocket.Conn, msg []byte) {
-						err := connection.WriteMessage(websocket.TextMessage, msg)
-						if err != nil {
-							log.Error().Err(err).Msg("Failed to send WebSocket message")
-							s.unregister <- &Client{conn: connection}
-						}
-					}(conn, messageBytes)
+			s.send(message)
+		}
+	}
+}
+
+// send queues a message for its recipients. A client whose queue is full is too
+// slow to keep up and is dropped instead of holding up everyone else.
+func (s *WebSocketService) send(message WebSocketMessage) {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal WebSocket message")
+		return
+	}
+
+	var unbound []uuid.UUID
+
+	s.mutex.Lock()
+	for userID, clients := range s.clients {
+		// Only explicit broadcasts go to every user
+		if !message.Broadcast && (message.UserID == nil || *message.UserID != userID) {
+			continue
+		}
+
+		for client := range clients {
+			select {
+			case client.send <- messageBytes:
+			default:
+				log.Warn().Str("user_id", userID.String()).Msg("WebSocket client too slow, disconnecting")
+				if _, lastConnection := s.removeClient(client); lastConnection {
+					unbound = append(unbound, userID)
 				}
 			}
-			s.mutex.RUnlock()
 		}
 	}
+	s.mutex.Unlock()
+
+	for _, userID := range unbound {
+		s.unbind(userID)
+	}
+}
+
+// removeClient deletes a client and closes its send queue, which ends its write
+// pump. Reports whether the client was still registered and whether it was the
+// last connection of its user. The caller holds the write lock.
+func (s *WebSocketService) removeClient(client *Client) (removed, lastConnection bool) {
+	clients := s.clients[client.userID]
+	if !clients[client] {
+		return false, false
+	}
+
+	delete(clients, client)
+	close(client.send)
+	if len(clients) == 0 {
+		delete(s.clients, client.userID)
+		return true, true
+	}
+	return true, false
+}
+
+// bind routes the user's notifications to this instance
+func (s *WebSocketService) bind(userID uuid.UUID) {
+	s.mutex.RLock()
+	subscription := s.subscription
+	s.mutex.RUnlock()
+
+	if subscription == nil {
+		return
+	}
+	if err := subscription.Bind(userID); err != nil {
+		log.Error().Err(err).Str("user_id", userID.String()).Msg("Failed to subscribe to user notifications")
+	}
+}
+
+// unbind stops routing the user's notifications to this instance after their last connection closed
+func (s *WebSocketService) unbind(userID uuid.UUID) {
+	s.mutex.RLock()
+	subscription := s.subscription
+	s.mutex.RUnlock()
+
+	if subscription == nil {
+		return
+	}
+	if err := subscription.Unbind(userID); err != nil {
+		log.Error().Err(err).Str("user_id", userID.String()).Msg("Failed to unsubscribe from user notifications")
+	}
 }
@@ -0,0 +1,360 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+)
+
+// newTestHub serves a WebSocket service on an httptest server. The X-User-ID header
+// stands in for the auth middleware.
+func newTestHub(t *testing.T) (*WebSocketService, *httptest.Server) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	ws := NewWebSocketService(&config.Config{})
+	go ws.Run()
+
+	r := gin.New()
+	r.GET("/ws", func(c *gin.Context) {
+		userID, err := uuid.Parse(c.GetHeader("X-User-ID"))
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("user", models.User{ID: userID})
+		c.Next()
+	}, ws.HandleWebSocket)
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return ws, server
+}
+
+func dial(t *testing.T, server *httptest.Server, userID uuid.UUID) *websocket.Conn {
+	t.Helper()
+
+	header := http.Header{}
+	header.Set("X-User-ID", userID.String())
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connections counts the registered connections of all users
+func connections(ws *WebSocketService) int {
+	ws.mutex.RLock()
+	defer ws.mutex.RUnlock()
+
+	count := 0
+	for _, clients := range ws.clients {
+		count += len(clients)
+	}
+	return count
+}
+
+// waitForClients waits until the hub has registered n connections
+func waitForClients(t *testing.T, ws *WebSocketService, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if connections(ws) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("hub did not register %d clients", n)
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) WebSocketMessage {
+	t.Helper()
+
+	var message WebSocketMessage
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return message
+}
+
+// expectNoMessage fails if a message arrives shortly, the connection is unusable afterwards
+func expectNoMessage(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var message WebSocketMessage
+	if err := conn.ReadJSON(&message); err == nil {
+		t.Fatalf("unexpected message %q for user %v", message.Type, message.UserID)
+	}
+}
+
+func TestNotificationsOnlyReachTheirUser(t *testing.T) {
+	ws, server := newTestHub(t)
+
+	q := queue.NewMemory(queue.RetryPolicy{MaxAttempts: 1})
+	t.Cleanup(func() { q.Shutdown(context.Background()) })
+	if err := ws.ConsumeNotifications(q); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	alice, bob := uuid.New(), uuid.New()
+	aliceConn := dial(t, server, alice)
+	bobConn := dial(t, server, bob)
+	waitForClients(t, ws, 2)
+
+	// The user_id in the data used to decide the recipient, it must not anymore
+	if err := q.PublishWebSocketNotification(alice, EventPaymentCompleted, map[string]interface{}{
+		"user_id": bob.String(),
+		"amount":  100,
+	}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := q.PublishWebSocketNotification(bob, EventBalanceUpdate, nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	message := readMessage(t, aliceConn)
+	if message.Type != EventPaymentCompleted {
+		t.Fatalf("alice got %q, want %q", message.Type, EventPaymentCompleted)
+	}
+	if message.UserID == nil || *message.UserID != alice {
+		t.Fatalf("user_id = %v, want %v", message.UserID, alice)
+	}
+
+	message = readMessage(t, bobConn)
+	if message.Type != EventBalanceUpdate {
+		t.Fatalf("bob got %q, want %q", message.Type, EventBalanceUpdate)
+	}
+
+	// A timed out read breaks the connection, so these come last
+	expectNoMessage(t, aliceConn)
+	expectNoMessage(t, bobConn)
+}
+
+func TestNotificationWithoutRecipientIsDropped(t *testing.T) {
+	ws, server := newTestHub(t)
+
+	q := queue.NewMemory(queue.RetryPolicy{MaxAttempts: 1})
+	t.Cleanup(func() { q.Shutdown(context.Background()) })
+	if err := ws.ConsumeNotifications(q); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	conn := dial(t, server, uuid.New())
+	waitForClients(t, ws, 1)
+
+	if err := q.PublishWebSocketNotification(uuid.Nil, EventWelcome, nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	expectNoMessage(t, conn)
+}
+
+func TestBroadcastReachesEveryUser(t *testing.T) {
+	ws, server := newTestHub(t)
+
+	q := queue.NewMemory(queue.RetryPolicy{MaxAttempts: 1})
+	t.Cleanup(func() { q.Shutdown(context.Background()) })
+	if err := ws.ConsumeNotifications(q); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	conns := []*websocket.Conn{dial(t, server, uuid.New()), dial(t, server, uuid.New())}
+	waitForClients(t, ws, len(conns))
+
+	if err := q.PublishWebSocketBroadcast(EventAnnouncement, map[string]interface{}{"message": "maintenance"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	for _, conn := range conns {
+		if message := readMessage(t, conn); message.Type != EventAnnouncement || message.UserID != nil {
+			t.Fatalf("got %q for %v, want announcement broadcast", message.Type, message.UserID)
+		}
+	}
+}
+
+func TestNotificationMessageType(t *testing.T) {
+	userID := uuid.New()
+
+	tests := []struct {
+		name string
+		task queue.Task
+		want string
+	}{
+		{"typed event", queue.WebSocketEvent(userID, EventConnectionReady, nil), EventConnectionReady},
+		{"legacy event in data", queue.Task{Type: queue.TaskWebSocketNotification, UserID: userID, Data: map[string]interface{}{"event": EventFamilyInvite}}, EventFamilyInvite},
+		{"untyped", queue.Task{Type: queue.TaskWebSocketNotification, UserID: userID}, EventNotification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, ok := notificationMessage(tt.task)
+			if !ok {
+				t.Fatal("message dropped")
+			}
+			if message.Type != tt.want {
+				t.Fatalf("type = %q, want %q", message.Type, tt.want)
+			}
+			if message.Broadcast || message.UserID == nil || *message.UserID != userID {
+				t.Fatalf("message not addressed to %v", userID)
+			}
+		})
+	}
+}
+
+// Two instances share one broker like replicas behind a load balancer. Every event
+// must reach its user on whichever instance they are connected to.
+func TestNotificationsReachUsersOnEveryInstance(t *testing.T) {
+	q := queue.NewMemory(queue.RetryPolicy{MaxAttempts: 1})
+	t.Cleanup(func() { q.Shutdown(context.Background()) })
+
+	first, firstServer := newTestHub(t)
+	second, secondServer := newTestHub(t)
+	for _, ws := range []*WebSocketService{first, second} {
+		if err := ws.ConsumeNotifications(q); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+
+	alice, bob := uuid.New(), uuid.New()
+	aliceConn := dial(t, firstServer, alice)
+	bobConn := dial(t, secondServer, bob)
+	waitForClients(t, first, 1)
+	waitForClients(t, second, 1)
+
+	// Competing consumers would split these between the instances
+	for i := 0; i < 10; i++ {
+		if err := q.PublishWebSocketNotification(alice, EventBalanceUpdate, map[string]interface{}{"seq": i}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		if err := q.PublishWebSocketNotification(bob, EventPaymentCompleted, map[string]interface{}{"seq": i}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+
+		if message := readMessage(t, aliceConn); message.Type != EventBalanceUpdate || message.UserID == nil || *message.UserID != alice {
+			t.Fatalf("alice got %q for %v", message.Type, message.UserID)
+		}
+		if message := readMessage(t, bobConn); message.Type != EventPaymentCompleted || message.UserID == nil || *message.UserID != bob {
+			t.Fatalf("bob got %q for %v", message.Type, message.UserID)
+		}
+	}
+
+	if err := q.PublishWebSocketBroadcast(EventAnnouncement, nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+		if message := readMessage(t, conn); message.Type != EventAnnouncement {
+			t.Fatalf("got %q, want %q", message.Type, EventAnnouncement)
+		}
+	}
+
+	// A timed out read breaks the connection, so these come last
+	expectNoMessage(t, aliceConn)
+	expectNoMessage(t, bobConn)
+}
+
+func TestUserWithSeveralTabsGetsEveryEvent(t *testing.T) {
+	ws, server := newTestHub(t)
+
+	q := queue.NewMemory(queue.RetryPolicy{MaxAttempts: 1})
+	t.Cleanup(func() { q.Shutdown(context.Background()) })
+	if err := ws.ConsumeNotifications(q); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	userID := uuid.New()
+	tabs := []*websocket.Conn{dial(t, server, userID), dial(t, server, userID), dial(t, server, userID)}
+	waitForClients(t, ws, len(tabs))
+
+	// Closing one tab keeps the others subscribed
+	tabs[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for connections(ws) != len(tabs)-1 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed tab was not unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Several messages in a row must not interleave writes on one connection
+	for i := 0; i < 20; i++ {
+		if err := q.PublishWebSocketNotification(userID, EventBalanceUpdate, map[string]interface{}{"seq": i}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	for _, tab := range tabs[1:] {
+		for i := 0; i < 20; i++ {
+			if message := readMessage(t, tab); message.Type != EventBalanceUpdate {
+				t.Fatalf("got %q, want %q", message.Type, EventBalanceUpdate)
+			}
+		}
+	}
+}
+
+func TestSlowClientIsDropped(t *testing.T) {
+	ws := NewWebSocketService(&config.Config{})
+	go ws.Run()
+
+	// No write pump drains this client, so its queue stays full
+	userID := uuid.New()
+	client := &Client{userID: userID, send: make(chan []byte, 1)}
+	ws.register <- client
+
+	for i := 0; i < 2; i++ {
+		ws.BroadcastMessage(WebSocketMessage{Type: EventBalanceUpdate, UserID: &userID})
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for connections(ws) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow client was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The queued message is still there, then the queue is closed
+	<-client.send
+	if _, ok := <-client.send; ok {
+		t.Fatal("send queue of dropped client is open")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := []string{"https://app.example.com/"}
+
+	tests := []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{allowed, "", true},
+		{allowed, "https://app.example.com", true},
+		{allowed, "https://api.example.com", true}, // same host
+		{allowed, "https://evil.example.net", false},
+		{allowed, "http://app.example.com", false},
+		{nil, "https://app.example.com", false},
+		{[]string{"*"}, "https://evil.example.net", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.Host = "api.example.com"
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkOrigin(tt.allowed)(r); got != tt.want {
+			t.Errorf("origin %q allowed by %v: got %v, want %v", tt.origin, tt.allowed, got, tt.want)
+		}
+	}
+}
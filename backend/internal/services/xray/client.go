@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -25,6 +27,7 @@ type XrayClient struct {
 	Password   string `json:"password,omitempty"`
 	TotalGB    int64  `json:"totalGB"`
 	ExpiryTime int64  `json:"expiryTime"`
+	LimitIP    int    `json:"limitIp"` // simultaneous IPs, 0 = unlimited
 	Enable     bool   `json:"enable"`
 }
 
@@ -46,6 +49,17 @@ type XrayInbound struct {
 	Clients        []XrayClient `json:"clients"`
 }
 
+// Network returns the transport of the inbound (tcp, ws, grpc...) from its stream settings
+func (i *XrayInbound) Network() string {
+	var settings struct {
+		Network string `json:"network"`
+	}
+	if err := json.Unmarshal([]byte(i.StreamSettings), &settings); err != nil {
+		return ""
+	}
+	return settings.Network
+}
+
 type ClientStat struct {
 	ID         int    `json:"id"`
 	InboundID  int    `json:"inboundId"`
@@ -197,7 +211,32 @@ func (c *Client) GetInbound(inboundID int) (*XrayInbound, error) {
 	return &result.Obj, nil
 }
 
-func (c *Client) AddClient(inboundID int, email string, uuid string, expiryTime int64, totalGB int64) (int, error) {
+// ListInbounds returns all inbounds of the panel
+func (c *Client) ListInbounds() ([]XrayInbound, error) {
+	resp, err := c.makeAuthenticatedRequest("POST", "/panel/inbound/list", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to list inbounds: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var result InboundListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if !result.Success {
+		return nil, fmt.Errorf("api returned error: %s", result.Msg)
+	}
+
+	return result.Obj, nil
+}
+
+func (c *Client) AddClient(inboundID int, email string, uuid string, expiryTime int64, totalGB int64, limitIP int) (int, error) {
 	// First get the inbound to get current clients
 	inbound, err := c.GetInbound(inboundID)
 	if err != nil {
@@ -210,6 +249,7 @@ func (c *Client) AddClient(inboundID int, email string, uuid string, expiryTime
 		UUID:       uuid,
 		TotalGB:    totalGB,
 		ExpiryTime: expiryTime,
+		LimitIP:    limitIP,
 		Enable:     true,
 	}
 
@@ -235,6 +275,22 @@ func (c *Client) AddClient(inboundID int, email string, uuid string, expiryTime
 	return len(updatedInbound.Clients) - 1, nil
 }
 
+// FindClient returns the client with the given email and its index in the inbound,
+// nil when the inbound has no such client
+func (c *Client) FindClient(inboundID int, email string) (*XrayClient, int, error) {
+	inbound, err := c.GetInbound(inboundID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get inbound: %w", err)
+	}
+
+	for i := range inbound.Clients {
+		if inbound.Clients[i].Email == email {
+			return &inbound.Clients[i], i, nil
+		}
+	}
+	return nil, 0, nil
+}
+
 func (c *Client) UpdateInbound(inboundID int, inbound *XrayInbound) error {
 	url := fmt.Sprintf("/panel/inbound/update/%d", inboundID)
 
@@ -265,6 +321,49 @@ func (c *Client) UpdateInbound(inboundID int, inbound *XrayInbound) error {
 	return nil
 }
 
+// UpdateClient changes expiry, limits and enabled state of an existing client
+func (c *Client) UpdateClient(inboundID int, email string, expiryTime int64, totalGB int64, limitIP int, enable bool) error {
+	return c.modifyClient(inboundID, email, func(client *XrayClient) {
+		client.ExpiryTime = expiryTime
+		client.TotalGB = totalGB
+		client.LimitIP = limitIP
+		client.Enable = enable
+	})
+}
+
+// SetClientEnabled enables or disables an existing client without removing it
+func (c *Client) SetClientEnabled(inboundID int, email string, enable bool) error {
+	return c.modifyClient(inboundID, email, func(client *XrayClient) {
+		client.Enable = enable
+	})
+}
+
+// modifyClient applies fn to the client with the given email and saves the inbound
+func (c *Client) modifyClient(inboundID int, email string, fn func(*XrayClient)) error {
+	inbound, err := c.GetInbound(inboundID)
+	if err != nil {
+		return fmt.Errorf("failed to get inbound: %w", err)
+	}
+
+	found := false
+	for i := range inbound.Clients {
+		if inbound.Clients[i].Email == email {
+			fn(&inbound.Clients[i])
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("client %s not found in inbound %d", email, inboundID)
+	}
+
+	if err := c.UpdateInbound(inboundID, inbound); err != nil {
+		return fmt.Errorf("failed to update inbound: %w", err)
+	}
+
+	return nil
+}
+
 func (c *Client) DeleteClient(inboundID int, email string) error {
 	inbound, err := c.GetInbound(inboundID)
 	if err != nil {
@@ -279,6 +378,11 @@ func (c *Client) DeleteClient(inboundID int, email string) error {
 		}
 	}
 
+	// Already deleted, a redelivered task must not fail
+	if len(updatedClients) == len(inbound.Clients) {
+		return nil
+	}
+
 	inbound.Clients = updatedClients
 
 	// Update inbound
@@ -318,6 +422,113 @@ func (c *Client) GetClientStats(inboundID int) ([]ClientStat, error) {
 	return result.Obj, nil
 }
 
+// GetOnlineClients returns emails of the clients currently online on the panel
+func (c *Client) GetOnlineClients() ([]string, error) {
+	resp, err := c.makeAuthenticatedRequest("POST", "/panel/inbound/onlines", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get online clients: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Success bool     `json:"success"`
+		Obj     []string `json:"obj,omitempty"`
+		Msg     string   `json:"msg,omitempty"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if !result.Success {
+		return nil, fmt.Errorf("api returned error: %s", result.Msg)
+	}
+
+	return result.Obj, nil
+}
+
+// GetClientIPs returns the IPs recorded for a client since the last ClearClientIPs call
+func (c *Client) GetClientIPs(email string) ([]string, error) {
+	resp, err := c.makeAuthenticatedRequest("POST", fmt.Sprintf("/panel/inbound/clientIps/%s", email), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get client IPs: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Success bool            `json:"success"`
+		Obj     json.RawMessage `json:"obj,omitempty"`
+		Msg     string          `json:"msg,omitempty"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if !result.Success {
+		return nil, fmt.Errorf("api returned error: %s", result.Msg)
+	}
+
+	return parseClientIPs(result.Obj), nil
+}
+
+// ClearClientIPs resets the IP log of a client
+func (c *Client) ClearClientIPs(email string) error {
+	resp, err := c.makeAuthenticatedRequest("POST", fmt.Sprintf("/panel/inbound/clearClientIps/%s", email), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to clear client IPs: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// parseClientIPs handles the formats 3x-ui uses for the IP log: a JSON array,
+// a string holding a JSON array, or "No IP Record". Entries may carry a
+// " (timestamp)" suffix.
+func parseClientIPs(raw json.RawMessage) []string {
+	var entries []string
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(text), &entries); err != nil {
+			entries = strings.Fields(text)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var ips []string
+	for _, entry := range entries {
+		ip := strings.TrimSpace(entry)
+		if i := strings.Index(ip, " "); i >= 0 {
+			ip = ip[:i]
+		}
+		if net.ParseIP(ip) == nil || seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
 // GenerateConnectionKey generates a connection key based on protocol and client info
 func GenerateConnectionKey(protocol, uuid, serverHost string, port int, remark string) string {
 	baseKey := fmt.Sprintf("%s://%s@%s:%d", protocol, uuid, serverHost, port)
@@ -333,3 +544,17 @@ func GenerateConnectionKey(protocol, uuid, serverHost string, port int, remark s
 		return baseKey
 	}
 }
+
+// ClientUUIDFromKey extracts the client UUID from a key generated by GenerateConnectionKey
+func ClientUUIDFromKey(key string) (string, bool) {
+	scheme := strings.Index(key, "://")
+	if scheme < 0 {
+		return "", false
+	}
+	rest := key[scheme+3:]
+	at := strings.Index(rest, "@")
+	if at <= 0 {
+		return "", false
+	}
+	return rest[:at], true
+}
@@ -5,17 +5,115 @@ import (
 	"fmt"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 
 	"xray-vpn-connect/internal/database"
 	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/secrets"
+	"xray-vpn-connect/internal/services/xray"
 )
 
 type XrayPanelService struct {
-	db *database.DB
+	db  *database.DB
+	box *secrets.Box
 }
 
-func NewXrayPanelService(db *database.DB) *XrayPanelService {
-	return &XrayPanelService{db: db}
+func NewXrayPanelService(db *database.DB, box *secrets.Box) *XrayPanelService {
+	return &XrayPanelService{db: db, box: box}
+}
+
+// sealPassword encrypts the plaintext password of the panel and clears it
+func (s *XrayPanelService) sealPassword(panel *models.XrayPanel) error {
+	sealed, err := s.box.Seal(panel.Password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt panel password: %w", err)
+	}
+	panel.Password = ""
+	panel.PasswordCiphertext = sealed.Ciphertext
+	panel.PasswordDataKey = sealed.DataKey
+	panel.PasswordKeyID = sealed.KeyID
+	return nil
+}
+
+// panelPassword returns the plaintext password of the panel
+func (s *XrayPanelService) panelPassword(panel *models.XrayPanel) (string, error) {
+	if panel.PasswordCiphertext == "" {
+		// Unsaved panel or saved before encryption
+		return panel.Password, nil
+	}
+	password, err := s.box.Open(secrets.Sealed{
+		Ciphertext: panel.PasswordCiphertext,
+		DataKey:    panel.PasswordDataKey,
+		KeyID:      panel.PasswordKeyID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt password of panel %s: %w", panel.Name, err)
+	}
+	return password, nil
+}
+
+// NewClient returns an API client for the panel
+func (s *XrayPanelService) NewClient(panel *models.XrayPanel) (*xray.Client, error) {
+	password, err := s.panelPassword(panel)
+	if err != nil {
+		return nil, err
+	}
+	return xray.NewClient(panel.URL, panel.Username, password), nil
+}
+
+// EncryptLegacyPasswords encrypts passwords of panels saved before encryption was added
+func (s *XrayPanelService) EncryptLegacyPasswords() (int, error) {
+	var panels []models.XrayPanel
+	if err := s.db.Unscoped().Where("password <> '' AND COALESCE(password_ciphertext, '') = ''").Find(&panels).Error; err != nil {
+		return 0, fmt.Errorf("failed to load panels: %w", err)
+	}
+
+	for i := range panels {
+		if err := s.sealPassword(&panels[i]); err != nil {
+			return i, err
+		}
+		if err := s.saveSecret(&panels[i]); err != nil {
+			return i, err
+		}
+	}
+
+	if len(panels) > 0 {
+		log.Info().Int("panels", len(panels)).Msg("Encrypted plaintext panel passwords")
+	}
+	return len(panels), nil
+}
+
+// RotateKeys re-encrypts every panel password with a new data key under the primary master key
+func (s *XrayPanelService) RotateKeys() (int, error) {
+	var panels []models.XrayPanel
+	if err := s.db.Unscoped().Where("COALESCE(password_ciphertext, '') <> ''").Find(&panels).Error; err != nil {
+		return 0, fmt.Errorf("failed to load panels: %w", err)
+	}
+
+	for i := range panels {
+		password, err := s.panelPassword(&panels[i])
+		if err != nil {
+			return i, err
+		}
+		panels[i].Password = password
+		if err := s.sealPassword(&panels[i]); err != nil {
+			return i, err
+		}
+		if err := s.saveSecret(&panels[i]); err != nil {
+			return i, err
+		}
+	}
+
+	return len(panels), nil
+}
+
+func (s *XrayPanelService) saveSecret(panel *models.XrayPanel) error {
+	if err := s.db.Unscoped().Model(panel).
+		Select("password", "password_ciphertext", "password_data_key", "password_key_id").
+		Updates(panel).Error; err != nil {
+		return fmt.Errorf("failed to save password of panel %s: %w", panel.Name, err)
+	}
+	return nil
 }
 
 // GetActivePanels returns all active Xray panels
@@ -50,27 +148,88 @@ func (s *XrayPanelService) GetPanelByServerID(serverID uuid.UUID) (*models.XrayP
 	return &server.XrayPanel, nil
 }
 
-// CreatePanel creates a new Xray panel
+// CreatePanel creates a new Xray panel, the plaintext Password is stored encrypted
 func (s *XrayPanelService) CreatePanel(panel *models.XrayPanel) error {
+	if err := s.sealPassword(panel); err != nil {
+		return err
+	}
 	if err := s.db.Create(panel).Error; err != nil {
 		return fmt.Errorf("failed to create panel: %w", err)
 	}
 	return nil
 }
 
-// UpdatePanel updates existing panel
+// UpdatePanel updates existing panel, zero values are saved too so panels can be disabled.
+// The password is only changed when a plaintext Password is set.
 func (s *XrayPanelService) UpdatePanel(panelID uuid.UUID, panel *models.XrayPanel) error {
-	if err := s.db.Model(&models.XrayPanel{}).Where("id = ?", panelID).Updates(panel).Error; err != nil {
+	columns := []interface{}{"type", "url", "username", "inbound_id", "is_active"}
+	if panel.Password != "" {
+		if err := s.sealPassword(panel); err != nil {
+			return err
+		}
+		columns = append(columns, "password", "password_ciphertext", "password_data_key", "password_key_id")
+	}
+
+	if err := s.db.Model(&models.XrayPanel{}).
+		Where("id = ?", panelID).
+		Select("name", columns...).
+		Updates(panel).Error; err != nil {
 		return fmt.Errorf("failed to update panel: %w", err)
 	}
 	return nil
 }
 
-// DeletePanel soft deletes a panel
+// DeletePanel soft deletes a panel that no server uses anymore
 func (s *XrayPanelService) DeletePanel(panelID uuid.UUID) error {
+	var servers int64
+	if err := s.db.Model(&models.Server{}).Where("xray_panel_id = ?", panelID).Count(&servers).Error; err != nil {
+		return fmt.Errorf("failed to count panel servers: %w", err)
+	}
+	if servers > 0 {
+		return fmt.Errorf("panel is used by %d servers, move or delete them first", servers)
+	}
 	return s.db.Delete(&models.XrayPanel{}, "id = ?", panelID).Error
 }
 
+// PanelInbound is an inbound found on a panel during a connection test
+type PanelInbound struct {
+	ID       int    `json:"id"`
+	Remark   string `json:"remark"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	Enable   bool   `json:"enable"`
+	Clients  int    `json:"clients"`
+}
+
+// TestPanel logs in to the panel and lists its inbounds
+func (s *XrayPanelService) TestPanel(panel *models.XrayPanel) ([]PanelInbound, error) {
+	client, err := s.NewClient(panel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Login(); err != nil {
+		return nil, fmt.Errorf("login failed: %w", err)
+	}
+
+	inbounds, err := client.ListInbounds()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]PanelInbound, 0, len(inbounds))
+	for _, inbound := range inbounds {
+		result = append(result, PanelInbound{
+			ID:       inbound.ID,
+			Remark:   inbound.Remark,
+			Protocol: inbound.Protocol,
+			Port:     inbound.Port,
+			Enable:   inbound.Enable,
+			Clients:  len(inbound.ClientStats),
+		})
+	}
+	return result, nil
+}
+
 // ListPanels returns all panels (active and inactive)
 func (s *XrayPanelService) ListPanels() ([]models.XrayPanel, error) {
 	var panels []models.XrayPanel
@@ -79,3 +238,46 @@ func (s *XrayPanelService) ListPanels() ([]models.XrayPanel, error) {
 	}
 	return panels, nil
 }
+
+// ClientForServer returns an API client for the server's panel and the inbound its clients live in
+func (s *XrayPanelService) ClientForServer(server *models.Server) (*xray.Client, int, error) {
+	panel, err := s.GetPanelByServerID(server.ID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get panel: %w", err)
+	}
+
+	client, err := s.NewClient(panel)
+	if err != nil {
+		return nil, 0, err
+	}
+	return client, serverInboundID(server, panel), nil
+}
+
+// InboundKey identifies the panel inbound a server's clients live in. Servers that
+// share an inbound have the same key.
+func (s *XrayPanelService) InboundKey(serverID uuid.UUID) (string, error) {
+	var server models.Server
+	if err := s.db.Preload("XrayPanel").First(&server, "id = ?", serverID).Error; err != nil {
+		return "", fmt.Errorf("server not found: %w", err)
+	}
+	if server.XrayPanelID == uuid.Nil {
+		return "", errors.New("server has no associated panel")
+	}
+	return fmt.Sprintf("%s/%d", server.XrayPanelID, serverInboundID(&server, &server.XrayPanel)), nil
+}
+
+// serverInboundID is the server's inbound, the panel default or inbound 1
+func serverInboundID(server *models.Server, panel *models.XrayPanel) int {
+	if server.InboundID > 0 {
+		return server.InboundID
+	}
+	if panel.InboundID > 0 {
+		return panel.InboundID
+	}
+	return 1 // default
+}
+
+// XrayClientEmail is the client email in the panel, user_<user_id>_<connection_id>
+func XrayClientEmail(connection *models.Connection) string {
+	return fmt.Sprintf("user_%s_%s", connection.UserID.String(), connection.ID.String())
+}
@@ -0,0 +1,338 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/models"
+	"xray-vpn-connect/internal/queue"
+	"xray-vpn-connect/internal/services"
+	"xray-vpn-connect/internal/services/xray"
+)
+
+// taskKey returns the key that serializes tasks, by connection or by panel inbound.
+// The panel rewrites the whole client list of an inbound on every change, and several
+// servers can share one inbound, so tasks are keyed by the panel and inbound they touch.
+func taskKey(serializeBy string, panelService *services.XrayPanelService) func(queue.Task) string {
+	return func(task queue.Task) string {
+		if serializeBy != "connection" && task.ServerID != uuid.Nil {
+			key, err := panelService.InboundKey(task.ServerID)
+			if err == nil {
+				return key
+			}
+			log.Warn().Err(err).Str("server_id", task.ServerID.String()).Msg("Failed to resolve task inbound, keying by server")
+			return task.ServerID.String()
+		}
+		if task.ConnectionID != uuid.Nil {
+			return task.ConnectionID.String()
+		}
+		return task.UserID.String()
+	}
+}
+
+// handleTask runs the handler of the task type
+func handleTask(db *database.DB, task queue.Task, panelService *services.XrayPanelService, notificationService *services.NotificationService, failoverService *services.FailoverService) error {
+	switch task.Type {
+	case queue.TaskCreateConnection:
+		return handleCreateConnection(db, task, panelService, notificationService, failoverService)
+	case queue.TaskDeleteConnection:
+		return handleDeleteConnection(db, task, panelService)
+	case queue.TaskUpdateConnection:
+		return handleUpdateConnection(db, task, panelService)
+	case queue.TaskUpdateTraffic:
+		return handleUpdateTraffic(db, task)
+	default:
+		log.Warn().Str("type", task.Type).Msg("Unknown task type")
+		return nil
+	}
+}
+
+// handleCreateConnection adds the Xray client of a connection. A failover replacement
+// takes over from the old connection once it is provisioned.
+func handleCreateConnection(db *database.DB, task queue.Task, panelService *services.XrayPanelService, notificationService *services.NotificationService, failoverService *services.FailoverService) error {
+	// Get connection
+	var connection models.Connection
+	if err := db.Preload("Server").Preload("User").First(&connection, "id = ?", task.ConnectionID).Error; err != nil {
+		return fmt.Errorf("connection not found: %w", err)
+	}
+
+	// Already provisioned by an earlier delivery
+	if connection.XrayClientUUID != "" && connection.ConnectionKey != "" {
+		log.Info().Str("connection_id", connection.ID.String()).Msg("Connection already provisioned, skipping")
+		return failoverService.CompleteMigration(&connection)
+	}
+
+	if err := db.Model(&connection).Update("status", services.ConnectionStatusProvisioning).Error; err != nil {
+		return fmt.Errorf("failed to update connection status: %w", err)
+	}
+
+	// Get server's Xray panel
+	var server models.Server
+	if err := db.Preload("XrayPanel").First(&server, "id = ?", connection.ServerID).Error; err != nil {
+		return fmt.Errorf("server not found: %w", err)
+	}
+
+	// Same client and inbound as the update and delete handlers
+	client, inboundID, err := panelService.ClientForServer(&server)
+	if err != nil {
+		return err
+	}
+
+	if !server.XrayPanel.IsActive {
+		return fmt.Errorf("panel is not active")
+	}
+
+	// Calculate expiry time
+	var expiryTime int64
+	if connection.ExpiresAt != nil {
+		expiryTime = connection.ExpiresAt.Unix() * 1000
+	} else {
+		// Default to 30 days
+		expiryTime = time.Now().AddDate(0, 0, 30).Unix() * 1000
+	}
+
+	email := services.XrayClientEmail(&connection)
+
+	// A previous attempt may have added the client and failed before saving it,
+	// reuse that client instead of adding a duplicate
+	existing, clientID, err := client.FindClient(inboundID, email)
+	if err != nil {
+		return err
+	}
+
+	var clientUUID string
+	if existing != nil {
+		clientUUID = existing.UUID
+		log.Info().Str("connection_id", connection.ID.String()).Msg("Reusing existing Xray client")
+	} else {
+		clientUUID = uuid.New().String()
+
+		// Add client to Xray panel
+		clientID, err = client.AddClient(
+			inboundID,
+			email,
+			clientUUID,
+			expiryTime,
+			connection.TrafficLimit, // 0 = unlimited
+			connection.DeviceLimit,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to add client to Xray: %w", err)
+		}
+	}
+
+	port := server.Port
+	if port == 0 {
+		port = 443
+	}
+
+	// Generate connection key
+	connectionKey := xray.GenerateConnectionKey(
+		server.Protocol,
+		clientUUID,
+		server.Host, // Use actual server host from config
+		port,
+		fmt.Sprintf("%s-User", server.Country),
+	)
+
+	// Update connection with Xray IDs and key
+	connection.XrayClientID = clientID
+	connection.XrayClientUUID = clientUUID
+	connection.ConnectionKey = connectionKey
+	connection.Status = services.ConnectionStatusReady
+	connection.LastError = ""
+	connection.SubscriptionLink = fmt.Sprintf("https://api.xray-service.io/sub/%s", connection.ID.String())
+
+	if err := db.Save(&connection).Error; err != nil {
+		return fmt.Errorf("failed to update connection: %w", err)
+	}
+
+	log.Info().
+		Str("connection_id", connection.ID.String()).
+		Str("client_id", fmt.Sprintf("%d", clientID)).
+		Msg("Connection created in Xray panel")
+
+	notificationService.Notify(connection.UserID, services.EventConnectionReady, "", map[string]interface{}{
+		"connection_id":  connection.ID.String(),
+		"server_id":      connection.ServerID.String(),
+		"connection_key": connection.ConnectionKey,
+	})
+
+	// Retried on failure, the connection is skipped as provisioned and only the migration runs
+	return failoverService.CompleteMigration(&connection)
+}
+
+// provisioningFailed records why creating the Xray client failed. The connection
+// stays provisioning while the task is retried and becomes failed after the last attempt.
+// The user only gets a generic message, the error can contain panel details.
+func provisioningFailed(db *database.DB, notificationService *services.NotificationService, task queue.Task, cause error, final bool) {
+	status := services.ConnectionStatusProvisioning
+	if final {
+		status = services.ConnectionStatusFailed
+	}
+
+	result := db.Model(&models.Connection{}).
+		Where("id = ? AND status IN ?", task.ConnectionID, []string{services.ConnectionStatusPending, services.ConnectionStatusProvisioning}).
+		Updates(map[string]interface{}{
+			"status":     status,
+			"last_error": cause.Error(),
+		})
+	if result.Error != nil {
+		log.Error().Err(result.Error).Str("connection_id", task.ConnectionID.String()).Msg("Failed to record provisioning error")
+		return
+	}
+
+	if final && result.RowsAffected > 0 {
+		notificationService.Notify(task.UserID, services.EventConnectionFailed, "", map[string]interface{}{
+			"connection_id": task.ConnectionID.String(),
+			"server_id":     task.ServerID.String(),
+			"error":         services.ConnectionFailedMessage,
+		})
+	}
+}
+
+func handleDeleteConnection(db *database.DB, task queue.Task, panelService *services.XrayPanelService) error {
+	// The reconciler deletes clients left without a live connection by email
+	if email, ok := task.Data["email"].(string); ok && email != "" {
+		return deleteClientByEmail(db, task, panelService, email)
+	}
+
+	// Get connection, it is usually soft deleted by the time the task runs
+	var connection models.Connection
+	if err := db.Unscoped().Preload("Server").Preload("Server.XrayPanel").First(&connection, "id = ?", task.ConnectionID).Error; err != nil {
+		return fmt.Errorf("connection not found: %w", err)
+	}
+
+	if connection.ConnectionKey == "" {
+		// Never created in Xray, the reconciler removes the client if the create task still runs
+		log.Warn().Str("connection_id", connection.ID.String()).Msg("Connection was not provisioned in Xray")
+		return nil
+	}
+
+	client, inboundID, err := panelService.ClientForServer(&connection.Server)
+	if err != nil {
+		return err
+	}
+
+	// The task is retried on failure, clients left behind are removed by the reconciler
+	if err := client.DeleteClient(inboundID, services.XrayClientEmail(&connection)); err != nil {
+		return fmt.Errorf("failed to delete client from Xray: %w", err)
+	}
+
+	log.Info().
+		Str("connection_id", connection.ID.String()).
+		Msg("Connection deleted from Xray panel")
+
+	return nil
+}
+
+// deleteClientByEmail removes a client from the inbound of the task's server
+func deleteClientByEmail(db *database.DB, task queue.Task, panelService *services.XrayPanelService, email string) error {
+	var server models.Server
+	if err := db.First(&server, "id = ?", task.ServerID).Error; err != nil {
+		return fmt.Errorf("server not found: %w", err)
+	}
+
+	client, inboundID, err := panelService.ClientForServer(&server)
+	if err != nil {
+		return err
+	}
+
+	if err := client.DeleteClient(inboundID, email); err != nil {
+		return fmt.Errorf("failed to delete client from Xray: %w", err)
+	}
+
+	log.Info().Str("email", email).Str("server", server.Name).Msg("Orphaned client deleted from Xray panel")
+	return nil
+}
+
+// handleUpdateConnection applies the current subscription expiry and plan limits
+// to the Xray client, adding it back if it is missing from the panel. The client is
+// disabled while the connection is inactive, while the subscription is frozen and
+// when the user no longer has one (expired, cancelled, left the family).
+func handleUpdateConnection(db *database.DB, task queue.Task, panelService *services.XrayPanelService) error {
+	var connection models.Connection
+	if err := db.Preload("Server").Preload("Server.XrayPanel").First(&connection, "id = ?", task.ConnectionID).Error; err != nil {
+		return fmt.Errorf("connection not found: %w", err)
+	}
+
+	if connection.ConnectionKey == "" {
+		// Not created in Xray yet, the create task will use the new limits
+		log.Debug().Str("connection_id", connection.ID.String()).Msg("Connection not provisioned yet, skipping update")
+		return nil
+	}
+
+	subscription, err := services.EffectiveSubscription(db.DB, connection.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	client, inboundID, err := panelService.ClientForServer(&connection.Server)
+	if err != nil {
+		return err
+	}
+
+	email := services.XrayClientEmail(&connection)
+
+	// Removed from the panel by hand or lost, add it back with the same key
+	existing, _, err := client.FindClient(inboundID, email)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		clientUUID, ok := xray.ClientUUIDFromKey(connection.ConnectionKey)
+		if !ok {
+			return fmt.Errorf("client UUID not found in connection key")
+		}
+		var expiryTime int64
+		if connection.ExpiresAt != nil {
+			expiryTime = connection.ExpiresAt.Unix() * 1000
+		}
+		if _, err := client.AddClient(inboundID, email, clientUUID, expiryTime, connection.TrafficLimit, connection.DeviceLimit); err != nil {
+			return fmt.Errorf("failed to restore client in Xray: %w", err)
+		}
+		log.Info().Str("connection_id", connection.ID.String()).Msg("Missing client restored in Xray panel")
+	}
+
+	if !connection.IsActive || subscription == nil || subscription.FrozenAt != nil {
+		if err := client.SetClientEnabled(inboundID, email, false); err != nil {
+			return fmt.Errorf("failed to disable client in Xray: %w", err)
+		}
+		log.Info().Str("connection_id", connection.ID.String()).Msg("Connection disabled, no usable subscription")
+		return nil
+	}
+
+	// Clients stay disabled while suspended for exceeding the device limit
+	enable := connection.SuspendedUntil == nil
+
+	trafficLimit := subscription.Plan.TrafficLimitGB * services.GB
+	deviceLimit := subscription.Plan.DeviceLimit
+	if err := client.UpdateClient(inboundID, email, subscription.ExpiresAt.Unix()*1000, trafficLimit, deviceLimit, enable); err != nil {
+		return fmt.Errorf("failed to update client in Xray: %w", err)
+	}
+
+	if err := db.Model(&connection).Updates(map[string]interface{}{
+		"expires_at":    subscription.ExpiresAt,
+		"traffic_limit": trafficLimit,
+		"device_limit":  deviceLimit,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update connection: %w", err)
+	}
+
+	log.Info().
+		Str("connection_id", connection.ID.String()).
+		Str("plan", subscription.Plan.Name).
+		Msg("Connection limits updated in Xray panel")
+
+	return nil
+}
+
+func handleUpdateTraffic(db *database.DB, task queue.Task) error {
+	// Implement traffic update logic
+	log.Info().Msg("Traffic update task received")
+	return nil
+}
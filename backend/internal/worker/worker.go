@@ -0,0 +1,184 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"xray-vpn-connect/internal/config"
+	"xray-vpn-connect/internal/database"
+	"xray-vpn-connect/internal/queue"
+	"xray-vpn-connect/internal/secrets"
+	"xray-vpn-connect/internal/services"
+)
+
+// Worker handles queued tasks and runs the periodic jobs. It runs in the worker
+// process, or inside the API process in all-in-one mode.
+type Worker struct {
+	config              *config.Config
+	db                  *database.DB
+	queue               queue.TaskQueue
+	panelService        *services.XrayPanelService
+	notificationService *services.NotificationService
+	deviceLimitService  *services.DeviceLimitService
+	subscriptionService *services.SubscriptionService
+	serverService       *services.ServerService
+	reconcileService    *services.ReconcileService
+	outboxService       *services.OutboxService
+	failoverService     *services.FailoverService
+	taskStore           *services.TaskStore
+}
+
+func New(cfg *config.Config, db *database.DB, q queue.TaskQueue, box *secrets.Box) *Worker {
+	panelService := services.NewXrayPanelService(db, box)
+	notificationService := services.NewNotificationService(db, cfg, q, services.NewTelegramService(cfg))
+	serverService := services.NewServerService(db, cfg, panelService)
+
+	return &Worker{
+		config:              cfg,
+		db:                  db,
+		queue:               q,
+		panelService:        panelService,
+		notificationService: notificationService,
+		deviceLimitService:  services.NewDeviceLimitService(db, cfg, panelService, notificationService),
+		subscriptionService: services.NewSubscriptionService(db, cfg, q, services.NewPromoCodeService(db)),
+		serverService:       serverService,
+		reconcileService:    services.NewReconcileService(db, panelService),
+		outboxService:       services.NewOutboxService(db, cfg, q),
+		failoverService:     services.NewFailoverService(db, cfg, serverService, services.NewConnectionService(db, q), notificationService),
+		taskStore:           services.NewTaskStore(db),
+	}
+}
+
+// Start begins consuming tasks and starts the periodic jobs
+func (w *Worker) Start() error {
+	cfg := w.config
+
+	// Tasks with the same key never run in parallel so concurrent changes
+	// to one panel inbound don't race
+	if err := w.queue.ConsumeTasksWith("tasks", queue.ConsumerOptions{
+		Prefetch: cfg.Worker.Prefetch,
+		Workers:  cfg.Worker.Concurrency,
+		Key:      taskKey(cfg.Worker.SerializeBy, w.panelService),
+	}, w.handle); err != nil {
+		return fmt.Errorf("failed to start consuming tasks: %w", err)
+	}
+
+	log.Info().Msg("Worker started, consuming tasks...")
+
+	if cfg.Worker.OutboxInterval > 0 {
+		go runPeriodically(cfg.Worker.OutboxInterval, w.outboxService.Relay)
+	}
+	// Every replica runs the jobs, the lock lets one of them do the work per interval
+	if cfg.Worker.ProcessedTaskRetention > 0 {
+		go runPeriodically(time.Hour, w.exclusive("prune_processed_tasks", func() {
+			w.taskStore.Prune(cfg.Worker.ProcessedTaskRetention)
+		}))
+	}
+	if cfg.Worker.DeviceCheckInterval > 0 {
+		// Each check clears the IP window, checks from several replicas would reset each other
+		go runPeriodically(cfg.Worker.DeviceCheckInterval, w.exclusive("device_check", w.deviceLimitService.CheckDeviceLimits))
+	}
+	if cfg.Worker.HealthCheckInterval > 0 {
+		go runPeriodically(cfg.Worker.HealthCheckInterval, w.exclusive("health_check", func() {
+			w.serverService.ProbeServers()
+			w.failoverService.MigrateFailedServers()
+		}))
+	}
+	if cfg.Worker.ReconcileInterval > 0 {
+		go runPeriodically(cfg.Worker.ReconcileInterval, func() {
+			// Locks itself, it also runs from the admin API
+			_, err := w.reconcileService.Reconcile(cfg.Worker.ReconcileDryRun)
+			if errors.Is(err, services.ErrReconcileRunning) {
+				log.Debug().Msg("Reconciliation is running on another worker, skipping")
+				return
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to reconcile panels")
+			}
+		})
+	}
+	if cfg.Worker.LoadRefreshInterval > 0 {
+		go runPeriodically(cfg.Worker.LoadRefreshInterval, w.exclusive("load_refresh", w.serverService.RefreshLoad))
+	}
+	if cfg.Worker.SubscriptionCheckInterval > 0 {
+		go runPeriodically(cfg.Worker.SubscriptionCheckInterval, w.exclusive("subscription_check", w.checkSubscriptions))
+	}
+
+	return nil
+}
+
+// handle runs a task, a redelivered task that already succeeded is skipped
+func (w *Worker) handle(task queue.Task) error {
+	processed, err := w.taskStore.Processed(task.ID)
+	if err != nil {
+		return err
+	}
+	if processed {
+		log.Info().Str("task_id", task.ID.String()).Str("type", task.Type).Msg("Task already processed, skipping")
+		return nil
+	}
+
+	log.Info().
+		Str("type", task.Type).
+		Str("task_id", task.ID.String()).
+		Int("attempt", task.Attempt).
+		Str("user_id", task.UserID.String()).
+		Msg("Processing task")
+
+	if err := handleTask(w.db, task, w.panelService, w.notificationService, w.failoverService); err != nil {
+		if task.Type == queue.TaskCreateConnection {
+			provisioningFailed(w.db, w.notificationService, task, err, task.Attempt >= w.config.RabbitMQ.MaxAttempts)
+		}
+		return err
+	}
+
+	// The handlers are idempotent, a failed mark only costs a repeated run
+	if err := w.taskStore.MarkProcessed(task); err != nil {
+		log.Error().Err(err).Str("task_id", task.ID.String()).Msg("Failed to mark task processed")
+	}
+	return nil
+}
+
+func (w *Worker) checkSubscriptions() {
+	if err := w.subscriptionService.DeactivateExpiredSubscriptions(); err != nil {
+		log.Error().Err(err).Msg("Failed to deactivate expired subscriptions")
+	}
+
+	resumed, err := w.subscriptionService.UnfreezeExpiredFreezes()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to unfreeze expired freezes")
+		return
+	}
+	for _, subscription := range resumed {
+		w.notificationService.Notify(subscription.UserID, services.EventSubscriptionUnfrozen,
+			"▶️ Your subscription reached the maximum freeze time and has been resumed.",
+			map[string]interface{}{"expires_at": subscription.ExpiresAt})
+	}
+}
+
+// exclusive wraps a periodic job so only one worker replica runs it at a time
+func (w *Worker) exclusive(name string, job func()) func() {
+	return func() {
+		ran, err := services.RunExclusive(w.db, name, job)
+		if err != nil {
+			log.Error().Err(err).Str("job", name).Msg("Failed to run periodic job")
+			return
+		}
+		if !ran {
+			log.Debug().Str("job", name).Msg("Periodic job is running on another worker, skipping")
+		}
+	}
+}
+
+// runPeriodically calls job every interval until the process exits
+func runPeriodically(interval time.Duration, job func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		job()
+	}
+}